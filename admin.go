@@ -0,0 +1,367 @@
+package redismq
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// defaultPeekLimit is the number of packages returned by peek endpoints without a limit parameter,
+// maxPeekLimit caps the limit parameter
+const (
+	defaultPeekLimit = 20
+	maxPeekLimit     = 1000
+)
+
+// adminHandler serves the admin API under /admin/.
+//
+//	GET    /admin/queues
+//	GET    /admin/queues/<queue>
+//	DELETE /admin/queues/<queue>
+//	POST   /admin/queues/<queue>/requeue-failed?header=name:value&error=timeout&created-after=<RFC3339>&created-before=<RFC3339>&payload=<regexp>
+//	POST   /admin/queues/<queue>/reset-failed?header=name:value&error=timeout&created-after=<RFC3339>&created-before=<RFC3339>&payload=<regexp>
+//	POST   /admin/queues/<queue>/reset-input
+//	POST   /admin/queues/<queue>/pause
+//	POST   /admin/queues/<queue>/resume
+//	GET    /admin/queues/<queue>/input?offset=0&limit=20&group=<group>
+//	GET    /admin/queues/<queue>/failed?offset=0&limit=20&group=<group>
+//	GET    /admin/queues/<queue>/consumers
+//	GET    /admin/queues/<queue>/consumers/<consumer>/working?offset=0&limit=20&group=<group>
+//	POST   /admin/queues/<queue>/consumers/<consumer>/reclaim
+//
+// Filter parameters are optional, with any of them only matching failed packages are
+// requeued or deleted and their number is returned.
+// Peek endpoints return a page of packages in the order they would be fetched
+// along with the total length of the list, with a group parameter those of a consumer group.
+// Queues that can't be peeked, e.g. stream queues, are answered with 501.
+// Destructive calls are refused with 409 while consumers are active.
+type adminHandler struct {
+	server *Server
+}
+
+// peekPage is the answer of peek endpoints, Total is the length of the whole list
+type peekPage struct {
+	Offset   int64
+	Limit    int64
+	Total    int64
+	Packages []*Package
+}
+
+func newAdminHandler(server *Server) *adminHandler {
+	return &adminHandler{server: server}
+}
+
+func (handler *adminHandler) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
+	path := strings.Trim(strings.TrimPrefix(request.URL.Path, "/admin"), "/")
+	parts := strings.Split(path, "/")
+	if parts[0] != "queues" {
+		writeError(writer, http.StatusNotFound, fmt.Errorf("not found"))
+		return
+	}
+
+	switch {
+	case len(parts) == 1 && request.Method == "GET":
+		handler.listQueues(writer)
+	case len(parts) == 1:
+		writeError(writer, http.StatusMethodNotAllowed, fmt.Errorf("method not allowed"))
+	default:
+		handler.serveQueue(writer, request, parts[1], parts[2:])
+	}
+}
+
+func (handler *adminHandler) serveQueue(writer http.ResponseWriter, request *http.Request, name string, parts []string) {
+	queue, err := handler.queue(name)
+	if err != nil {
+		writeError(writer, http.StatusNotFound, err)
+		return
+	}
+
+	action := strings.Join(parts, "/")
+	switch {
+	case action == "" && request.Method == "GET":
+		handler.showQueue(writer, queue)
+	case action == "" && request.Method == "DELETE":
+		handler.deleteQueue(writer, queue)
+	case action == "requeue-failed" && request.Method == "POST":
+		handler.failedAction(writer, request, queue, false, queue.RequeueFailed, queue.RequeueFailedMatching)
+	case action == "reset-failed" && request.Method == "POST":
+		handler.failedAction(writer, request, queue, true, queue.ResetFailed, queue.ResetFailedMatching)
+	case action == "reset-input" && request.Method == "POST":
+		handler.queueAction(writer, queue, true, queue.ResetInput)
+	case action == "pause" && request.Method == "POST":
+		handler.queueAction(writer, queue, false, queue.Pause)
+	case action == "resume" && request.Method == "POST":
+		handler.queueAction(writer, queue, false, queue.Resume)
+	case action == "input" && request.Method == "GET":
+		handler.peekQueue(writer, request, queue, false)
+	case action == "failed" && request.Method == "GET":
+		handler.peekQueue(writer, request, queue, true)
+	case action == "consumers" && request.Method == "GET":
+		handler.listConsumers(writer, queue)
+	case len(parts) == 3 && parts[0] == "consumers" && parts[2] == "working" && request.Method == "GET":
+		handler.peekWorking(writer, request, queue, parts[1])
+	case len(parts) == 3 && parts[0] == "consumers" && parts[2] == "reclaim" && request.Method == "POST":
+		handler.reclaim(writer, queue, parts[1])
+	default:
+		writeError(writer, http.StatusNotFound, fmt.Errorf("not found"))
+	}
+}
+
+// queue selects the queue for one request on the backend of the server, it has no stats
+// writer so nothing keeps running after the request
+func (handler *adminHandler) queue(name string) (*Queue, error) {
+	return selectQueue(handler.server.backend, name)
+}
+
+func (handler *adminHandler) listQueues(writer http.ResponseWriter) {
+	names, err := handler.server.observer.GetAllQueues()
+	if err != nil {
+		writeError(writer, http.StatusServiceUnavailable, err)
+		return
+	}
+
+	infos := make([]*QueueInfo, 0, len(names))
+	for _, name := range names {
+		queue, err := handler.queue(name)
+		if err != nil {
+			// the queue has been deleted in the meantime
+			continue
+		}
+		info, err := queue.Info()
+		if err != nil {
+			writeError(writer, http.StatusServiceUnavailable, err)
+			return
+		}
+		infos = append(infos, info)
+	}
+	writeJSON(writer, http.StatusOK, infos)
+}
+
+func (handler *adminHandler) showQueue(writer http.ResponseWriter, queue *Queue) {
+	info, err := queue.Info()
+	if err != nil {
+		writeError(writer, http.StatusServiceUnavailable, err)
+		return
+	}
+	writeJSON(writer, http.StatusOK, info)
+}
+
+func (handler *adminHandler) listConsumers(writer http.ResponseWriter, queue *Queue) {
+	info, err := queue.Info()
+	if err != nil {
+		writeError(writer, http.StatusServiceUnavailable, err)
+		return
+	}
+	writeJSON(writer, http.StatusOK, info.Consumers)
+}
+
+func (handler *adminHandler) deleteQueue(writer http.ResponseWriter, queue *Queue) {
+	if !handler.refuseWhileActive(writer, queue) {
+		return
+	}
+	err := queue.Delete()
+	if err != nil {
+		writeError(writer, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(writer, http.StatusOK, map[string]string{"Deleted": queue.Name})
+}
+
+func (handler *adminHandler) queueAction(writer http.ResponseWriter, queue *Queue, destructive bool, action func() error) {
+	if destructive && !handler.refuseWhileActive(writer, queue) {
+		return
+	}
+	err := action()
+	if err != nil {
+		writeError(writer, http.StatusInternalServerError, err)
+		return
+	}
+	handler.showQueue(writer, queue)
+}
+
+// failedAction runs action or matching if filter parameters are given
+func (handler *adminHandler) failedAction(writer http.ResponseWriter, request *http.Request, queue *Queue, destructive bool, action func() error, matching func(*Filter) (int64, error)) {
+	filter, err := queryFilter(request)
+	if err != nil {
+		writeError(writer, http.StatusBadRequest, err)
+		return
+	}
+	if filter == nil {
+		handler.queueAction(writer, queue, destructive, action)
+		return
+	}
+
+	if destructive && !handler.refuseWhileActive(writer, queue) {
+		return
+	}
+	matched, err := matching(filter)
+	if err != nil {
+		writeError(writer, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(writer, http.StatusOK, map[string]int64{"Matched": matched})
+}
+
+// refuseWhileActive writes a conflict and returns false if the queue has active consumers
+func (handler *adminHandler) refuseWhileActive(writer http.ResponseWriter, queue *Queue) bool {
+	active, err := queue.HasActiveConsumers()
+	if err != nil {
+		writeError(writer, http.StatusServiceUnavailable, err)
+		return false
+	}
+	if active {
+		writeError(writer, http.StatusConflict, fmt.Errorf("queue %s has active consumers", queue.Name))
+		return false
+	}
+	return true
+}
+
+// reclaim moves all unacked packages of a dead consumer back to input
+func (handler *adminHandler) reclaim(writer http.ResponseWriter, queue *Queue, name string) {
+	reclaimed, err := queue.ReclaimConsumer(name)
+	switch err {
+	case nil:
+		writeJSON(writer, http.StatusOK, map[string]int64{"Reclaimed": reclaimed})
+	case ErrConsumerNotFound:
+		writeError(writer, http.StatusNotFound, err)
+	case ErrConsumerActive:
+		writeError(writer, http.StatusConflict, err)
+	default:
+		writeError(writer, http.StatusServiceUnavailable, err)
+	}
+}
+
+// peekQueue serves a page of the input or failed queue
+func (handler *adminHandler) peekQueue(writer http.ResponseWriter, request *http.Request, queue *Queue, failed bool) {
+	queue, err := handler.peekedQueue(request, queue)
+	if err != nil {
+		writeError(writer, http.StatusNotFound, err)
+		return
+	}
+	if failed {
+		handler.peek(writer, request, queue.PeekFailed, queue.GetFailedLength)
+		return
+	}
+	handler.peek(writer, request, queue.PeekInput, queue.GetInputLength)
+}
+
+// peekWorking serves a page of the working queue of a consumer
+func (handler *adminHandler) peekWorking(writer http.ResponseWriter, request *http.Request, queue *Queue, name string) {
+	queue, err := handler.peekedQueue(request, queue)
+	if err != nil {
+		writeError(writer, http.StatusNotFound, err)
+		return
+	}
+	// the consumer isn't added, peeking leaves the consumers untouched
+	consumer := &Consumer{Name: name, Queue: queue}
+	handler.peek(writer, request, consumer.PeekWorking, consumer.GetUnackedLength)
+}
+
+// peekedQueue returns the queue of the group parameter, queue itself without it
+func (handler *adminHandler) peekedQueue(request *http.Request, queue *Queue) (*Queue, error) {
+	group := request.URL.Query().Get("group")
+	if group == "" {
+		return queue, nil
+	}
+	groups, err := queue.GetGroups()
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range groups {
+		if name == group {
+			return queue.group(group), nil
+		}
+	}
+	return nil, fmt.Errorf("group %s of queue %s doesn't exist", group, queue.Name)
+}
+
+func (handler *adminHandler) peek(writer http.ResponseWriter, request *http.Request, fetch func(offset, limit int64) ([]*Package, error), length func() int64) {
+	offset, err := queryInt(request, "offset", 0)
+	if err != nil {
+		writeError(writer, http.StatusBadRequest, err)
+		return
+	}
+	limit, err := queryInt(request, "limit", defaultPeekLimit)
+	if err != nil {
+		writeError(writer, http.StatusBadRequest, err)
+		return
+	}
+
+	if limit > maxPeekLimit {
+		limit = maxPeekLimit
+	}
+
+	packages, err := fetch(offset, limit)
+	if err == errStreamUnsupported || err == errPartitionsUnsupported {
+		writeError(writer, http.StatusNotImplemented, err)
+		return
+	}
+	if err != nil {
+		writeError(writer, http.StatusServiceUnavailable, err)
+		return
+	}
+	writeJSON(writer, http.StatusOK, &peekPage{Offset: offset, Limit: limit, Total: length(), Packages: packages})
+}
+
+// queryFilter returns nil if the request has no filter parameters
+func queryFilter(request *http.Request) (*Filter, error) {
+	query := request.URL.Query()
+	filter := &Filter{ErrorContains: query.Get("error")}
+	filtered := filter.ErrorContains != ""
+
+	for _, header := range query["header"] {
+		parts := strings.SplitN(header, ":", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid header %q", header)
+		}
+		if filter.Headers == nil {
+			filter.Headers = make(map[string]string)
+		}
+		filter.Headers[parts[0]] = parts[1]
+		filtered = true
+	}
+	for name, created := range map[string]*time.Time{"created-after": &filter.CreatedAfter, "created-before": &filter.CreatedBefore} {
+		value := query.Get(name)
+		if value == "" {
+			continue
+		}
+		var err error
+		*created, err = time.Parse(time.RFC3339, value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s %q", name, value)
+		}
+		filtered = true
+	}
+	if value := query.Get("payload"); value != "" {
+		var err error
+		filter.Payload, err = regexp.Compile(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid payload %q", value)
+		}
+		filtered = true
+	}
+
+	if !filtered {
+		return nil, nil
+	}
+	return filter, nil
+}
+
+func queryInt(request *http.Request, name string, fallback int64) (int64, error) {
+	value := request.URL.Query().Get(name)
+	if value == "" {
+		return fallback, nil
+	}
+	number, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || number < 0 {
+		return 0, fmt.Errorf("invalid %s %q", name, value)
+	}
+	return number, nil
+}
+
+func writeError(writer http.ResponseWriter, status int, err error) {
+	writeJSON(writer, status, map[string]string{"Error": err.Error()})
+}
@@ -0,0 +1,211 @@
+package redismq
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+
+	. "github.com/matttproud/gocheck"
+)
+
+func (suite *TestSuite) adminRequest(method, path string) *httptest.ResponseRecorder {
+	server := NewServer(redisHost, redisPort, redisPassword, redisDB, "9999")
+	handler := requireToken("secret", newAdminHandler(server))
+	request := httptest.NewRequest(method, path, nil)
+	request.Header.Set("Authorization", "Bearer secret")
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, request)
+	return recorder
+}
+
+// should refuse requests without the admin token
+func (suite *TestSuite) TestAdminUnauthorized(c *C) {
+	handler := requireToken("secret", newAdminHandler(NewServer(redisHost, redisPort, redisPassword, redisDB, "9999")))
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest("GET", "/admin/queues", nil))
+	c.Check(recorder.Code, Equals, http.StatusUnauthorized)
+}
+
+// should list queues with their lengths and consumers
+func (suite *TestSuite) TestAdminListQueues(c *C) {
+	c.Check(suite.queue.Put("testpayload"), Equals, nil)
+	recorder := suite.adminRequest("GET", "/admin/queues")
+	c.Assert(recorder.Code, Equals, http.StatusOK)
+
+	var infos []*QueueInfo
+	c.Assert(json.Unmarshal(recorder.Body.Bytes(), &infos), IsNil)
+	c.Assert(infos, HasLen, 1)
+	c.Check(infos[0].Name, Equals, "teststuff")
+	c.Check(infos[0].InputLength, Equals, int64(1))
+	c.Assert(infos[0].Consumers, HasLen, 1)
+	c.Check(infos[0].Consumers[0].Active, Equals, true)
+}
+
+// should not find unknown queues
+func (suite *TestSuite) TestAdminUnknownQueue(c *C) {
+	c.Check(suite.adminRequest("GET", "/admin/queues/i_dont_exist").Code, Equals, http.StatusNotFound)
+}
+
+// should refuse destructive calls while consumers are active
+func (suite *TestSuite) TestAdminRefuseWhileActive(c *C) {
+	c.Check(suite.queue.Put("testpayload"), Equals, nil)
+	c.Check(suite.adminRequest("POST", "/admin/queues/teststuff/reset-input").Code, Equals, http.StatusConflict)
+	c.Check(suite.adminRequest("DELETE", "/admin/queues/teststuff").Code, Equals, http.StatusConflict)
+	c.Check(suite.queue.GetInputLength(), Equals, int64(1))
+
+	suite.consumer.Quit()
+	c.Check(suite.adminRequest("POST", "/admin/queues/teststuff/reset-input").Code, Equals, http.StatusOK)
+	c.Check(suite.queue.GetInputLength(), Equals, int64(0))
+}
+
+// should requeue failed packages
+func (suite *TestSuite) TestAdminRequeueFailed(c *C) {
+	c.Check(suite.queue.Put("testpayload"), Equals, nil)
+	p, err := suite.consumer.Get()
+	c.Assert(err, Equals, nil)
+	c.Check(p.Fail(), Equals, nil)
+
+	c.Check(suite.adminRequest("POST", "/admin/queues/teststuff/requeue-failed").Code, Equals, http.StatusOK)
+	c.Check(suite.queue.GetFailedLength(), Equals, int64(0))
+	c.Check(suite.queue.GetInputLength(), Equals, int64(1))
+}
+
+// should reclaim the working queue of dead consumers only
+func (suite *TestSuite) TestAdminReclaim(c *C) {
+	c.Check(suite.queue.Put("testpayload"), Equals, nil)
+	_, err := suite.consumer.Get()
+	c.Assert(err, Equals, nil)
+	c.Check(suite.adminRequest("POST", "/admin/queues/teststuff/consumers/testconsumer/reclaim").Code, Equals, http.StatusConflict)
+
+	suite.consumer.Quit()
+	c.Check(suite.adminRequest("POST", "/admin/queues/teststuff/consumers/testconsumer/reclaim").Code, Equals, http.StatusOK)
+	c.Check(suite.consumer.GetUnackedLength(), Equals, int64(0))
+	c.Check(suite.queue.GetInputLength(), Equals, int64(1))
+}
+
+// should peek packages in delivery order without removing them
+func (suite *TestSuite) TestAdminPeek(c *C) {
+	for _, payload := range []string{"first", "second", "third"} {
+		c.Check(suite.queue.Put(payload), Equals, nil)
+	}
+	recorder := suite.adminRequest("GET", "/admin/queues/teststuff/input?offset=1&limit=5")
+	c.Assert(recorder.Code, Equals, http.StatusOK)
+
+	var page peekPage
+	c.Assert(json.Unmarshal(recorder.Body.Bytes(), &page), IsNil)
+	c.Check(page.Offset, Equals, int64(1))
+	c.Check(page.Limit, Equals, int64(5))
+	c.Check(page.Total, Equals, int64(3))
+	c.Assert(page.Packages, HasLen, 2)
+	c.Check(page.Packages[0].Payload, Equals, "second")
+	c.Check(page.Packages[1].Payload, Equals, "third")
+	c.Check(suite.queue.GetInputLength(), Equals, int64(3))
+}
+
+// should only requeue failed packages matching the filter parameters
+func (suite *TestSuite) TestAdminRequeueFailedFiltered(c *C) {
+	for _, payload := range []string{"customer 1", "customer 2"} {
+		c.Check(suite.queue.Put(payload), IsNil)
+		p, err := suite.consumer.Get()
+		c.Assert(err, IsNil)
+		c.Check(p.Fail(), IsNil)
+	}
+	recorder := suite.adminRequest("POST", "/admin/queues/teststuff/requeue-failed?payload=2$")
+	c.Assert(recorder.Code, Equals, http.StatusOK)
+	c.Check(strings.TrimSpace(recorder.Body.String()), Equals, `{"Matched":1}`)
+	c.Check(suite.queue.GetFailedLength(), Equals, int64(1))
+	c.Check(suite.queue.GetInputLength(), Equals, int64(1))
+
+	c.Check(suite.adminRequest("POST", "/admin/queues/teststuff/requeue-failed?created-after=yesterday").Code, Equals, http.StatusBadRequest)
+}
+
+// should pause and resume queues and report it in stats
+func (suite *TestSuite) TestAdminPause(c *C) {
+	recorder := suite.adminRequest("POST", "/admin/queues/teststuff/pause")
+	c.Assert(recorder.Code, Equals, http.StatusOK)
+	var info QueueInfo
+	c.Assert(json.Unmarshal(recorder.Body.Bytes(), &info), IsNil)
+	c.Check(info.Paused, Equals, true)
+
+	observer := NewObserver(redisHost, redisPort, redisPassword, redisDB)
+	c.Assert(observer.UpdateAllStats(), IsNil)
+	c.Check(observer.Snapshot().Stats["teststuff"].Paused, Equals, true)
+
+	c.Check(suite.adminRequest("POST", "/admin/queues/teststuff/resume").Code, Equals, http.StatusOK)
+	paused, err := suite.queue.IsPaused()
+	c.Check(err, IsNil)
+	c.Check(paused, Equals, false)
+}
+
+// should not register unknown consumers on reclaim and peek consumer groups
+func (suite *UnitSuite) TestAdminReclaimUnknownAndPeekGroup(c *C) {
+	backend := NewMemoryBackend()
+	queue := CreateQueueWithBackend(backend, "memoryadmin")
+	c.Assert(queue.AddGroup("billing"), IsNil)
+	c.Check(queue.Put("testpayload"), IsNil)
+	server, err := NewServerWithOptions(&ServerOptions{Backend: backend})
+	c.Assert(err, IsNil)
+	handler := newAdminHandler(server)
+	request := func(method, path string) *httptest.ResponseRecorder {
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, httptest.NewRequest(method, path, nil))
+		return recorder
+	}
+
+	c.Check(request("POST", "/admin/queues/memoryadmin/consumers/ghost/reclaim").Code, Equals, http.StatusNotFound)
+	consumers, err := queue.getConsumers()
+	c.Check(err, IsNil)
+	c.Check(consumers, HasLen, 0)
+
+	recorder := request("GET", "/admin/queues/memoryadmin/input?group=billing")
+	c.Assert(recorder.Code, Equals, http.StatusOK)
+	var page peekPage
+	c.Assert(json.Unmarshal(recorder.Body.Bytes(), &page), IsNil)
+	c.Check(page.Total, Equals, int64(1))
+	c.Assert(page.Packages, HasLen, 1)
+	c.Check(page.Packages[0].Payload, Equals, "testpayload")
+	c.Check(request("GET", "/admin/queues/memoryadmin/input?group=unknown").Code, Equals, http.StatusNotFound)
+}
+
+// deleting a queue should not leave its dead consumers active
+func (suite *UnitSuite) TestAdminDeleteDeadConsumers(c *C) {
+	backend := NewMemoryBackend()
+	queue := CreateQueueWithBackend(backend, "memorydelete")
+	consumer, err := queue.AddConsumer("dead")
+	c.Assert(err, IsNil)
+	consumer.Quit()
+	server, err := NewServerWithOptions(&ServerOptions{Backend: backend})
+	c.Assert(err, IsNil)
+	handler := newAdminHandler(server)
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest("DELETE", "/admin/queues/memorydelete", nil))
+	c.Check(recorder.Code, Equals, http.StatusOK)
+
+	recreated := CreateQueueWithBackend(backend, "memorydelete")
+	info, err := recreated.Info()
+	c.Assert(err, IsNil)
+	c.Check(info.Consumers, HasLen, 0)
+	c.Check(recreated.isActiveConsumer("dead"), Equals, false)
+	consumer, err = recreated.AddConsumer("dead")
+	c.Assert(err, IsNil)
+	consumer.Quit()
+}
+
+// queues deleted outside the admin API should not be served from a cache
+func (suite *UnitSuite) TestAdminQueueDeletedElsewhere(c *C) {
+	backend := NewMemoryBackend()
+	queue := CreateQueueWithBackend(backend, "memoryelsewhere")
+	server, err := NewServerWithOptions(&ServerOptions{Backend: backend})
+	c.Assert(err, IsNil)
+	handler := newAdminHandler(server)
+	request := func() int {
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, httptest.NewRequest("GET", "/admin/queues/memoryelsewhere", nil))
+		return recorder.Code
+	}
+
+	c.Check(request(), Equals, http.StatusOK)
+	c.Check(queue.Delete(), IsNil)
+	c.Check(request(), Equals, http.StatusNotFound)
+}
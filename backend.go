@@ -0,0 +1,478 @@
+package redismq
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	"gopkg.in/redis.v3"
+)
+
+// ErrNoValue is returned by backends for missing values and empty lists
+var ErrNoValue = redis.Nil
+
+// Backend stores the lists, sets, heartbeats and stats of queues. Lists work like redis lists,
+// values are pushed on the left end and popped from the right end and negative indexes count
+// from the right end. Every method has to be atomic.
+type Backend interface {
+	// LPush adds the values to the left end of the list in order
+	LPush(key string, values ...string) error
+	// RPop removes the rightmost value of the list
+	RPop(key string) (string, error)
+	// RPopLPush moves the rightmost value of source to the left end of destination
+	RPopLPush(source, destination string) (string, error)
+	// BRPopLPush works like RPopLPush but waits up to timeout for a value, 0 waits forever
+	BRPopLPush(source, destination string, timeout time.Duration) (string, error)
+	// RPopRPush moves the rightmost value of source to the right end of destination, so it is popped next
+	RPopRPush(source, destination string) error
+	// MultiRPopLPush moves up to count values like RPopLPush and returns them
+	MultiRPopLPush(source, destination string, count int64) ([]string, error)
+	// RPopLPushValue removes the rightmost value of source and pushes value to destination instead,
+	// nothing is pushed if source is empty
+	RPopLPushValue(source, destination, value string) error
+	// LPushBounded pushes values unless the list would exceed max values. Mode "all" pushes
+	// all values or none, "some" pushes as many as fit and "drop" pushes all values and removes
+	// the rightmost ones, adding their number to the counter droppedKey. It returns the pushed number.
+	LPushBounded(key, droppedKey string, max int64, mode string, values []string) (int64, error)
+	// LPushEach adds the values to the left end of every list in keys at once
+	LPushEach(keys []string, values []string) error
+	// RotateChecked handles the values expected at the right end of key one by one. Values are
+	// removed and pushed to destination for action "r", dropped for "d" and pushed back
+	// to the left end of key for "k". It stops at the first value that isn't at the right end
+	// and returns the number of handled values and of those that weren't kept.
+	RotateChecked(key, destination string, actions, values []string) (processed, matched int64, err error)
+	LLen(key string) (int64, error)
+	LRange(key string, start, stop int64) ([]string, error)
+	LIndex(key string, index int64) (string, error)
+	LTrim(key string, start, stop int64) error
+
+	SAdd(key string, members ...string) (int64, error)
+	SRem(key string, members ...string) error
+	SMembers(key string) ([]string, error)
+	SIsMember(key, member string) (bool, error)
+
+	// Get returns the value of key, values expire after the expiration passed to Set or IncrBy
+	Get(key string) (string, error)
+	// MGet returns the values of all keys, nil for missing ones
+	MGet(keys ...string) ([]interface{}, error)
+	// Set stores value at key, 0 never expires
+	Set(key, value string, expiration time.Duration) error
+	// IncrBy adds value to the counter at key, a positive expiration replaces its expiry
+	IncrBy(key string, value int64, expiration time.Duration) error
+	Exists(key string) (bool, error)
+	// AcquireSlots increments the counter at key by up to count without exceeding max
+	// and returns the increment
+	AcquireSlots(key string, max, count int64) (int64, error)
+	// ReleaseSlots decrements the counter at key by count, it never goes below 0
+	ReleaseSlots(key string, count int64) error
+	// ReleaseHeldSlots removes ids from the set holders and decrements the counter at key by the
+	// number of removed ids, so every slot held by an id is released once
+	ReleaseHeldSlots(key, holders string, ids ...string) error
+	// ReserveTokens takes count tokens from the token bucket at key, which is refilled with rate
+	// tokens per second up to burst tokens. Tokens may be taken in advance, it returns how long
+	// to wait until they are earned.
+	ReserveTokens(key string, rate float64, burst, count int64) (time.Duration, error)
+	// AcquireLease sets key to owner for ttl unless another owner holds it, the owner's lease is extended.
+	// It returns true if owner holds the lease.
+	AcquireLease(key, owner string, ttl time.Duration) (bool, error)
+	// ReleaseLease removes key if owner holds it
+	ReleaseLease(key, owner string) error
+	// Del removes the keys of any type
+	Del(keys ...string) error
+
+	Ping() error
+	Close() error
+}
+
+// RedisBackend stores queues in redis, it is used by all constructors taking a client
+type RedisBackend struct {
+	client RedisClient
+}
+
+// NewRedisBackend returns a backend using the client, which may be wrapped by
+// UseClusterLayout or UseNamespace
+func NewRedisBackend(client RedisClient) *RedisBackend {
+	return &RedisBackend{client: client}
+}
+
+// keysForBackend returns the key layout used with the backend
+func keysForBackend(backend Backend) keyScheme {
+	if redisBackend, ok := backend.(*RedisBackend); ok {
+		return keysFor(redisBackend.client)
+	}
+	return keyScheme{}
+}
+
+func (backend *RedisBackend) LPush(key string, values ...string) error {
+	return backend.client.LPush(key, values...).Err()
+}
+
+func (backend *RedisBackend) RPop(key string) (string, error) {
+	return backend.client.RPop(key).Result()
+}
+
+func (backend *RedisBackend) RPopLPush(source, destination string) (string, error) {
+	return backend.client.RPopLPush(source, destination).Result()
+}
+
+func (backend *RedisBackend) BRPopLPush(source, destination string, timeout time.Duration) (string, error) {
+	if timeout > 0 && timeout < time.Second {
+		// redis only supports whole seconds
+		timeout = time.Second
+	}
+	return backend.client.BRPopLPush(source, destination, timeout).Result()
+}
+
+// rPopRPushScript moves the rightmost value of KEYS[1] to the right end of KEYS[2]
+var rPopRPushScript = `
+local answer = redis.call('RPOP', KEYS[1])
+if answer then
+	redis.call('RPUSH', KEYS[2], answer)
+end
+return 1`
+
+func (backend *RedisBackend) RPopRPush(source, destination string) error {
+	return backend.client.Eval(rPopRPushScript, []string{source, destination}, nil).Err()
+}
+
+// multiRPopLPushScript moves up to ARGV[1] values from KEYS[1] to KEYS[2] and returns them
+var multiRPopLPushScript = `
+local answers = {}
+for i = 1, tonumber(ARGV[1]) do
+	local answer = redis.call('RPOPLPUSH', KEYS[1], KEYS[2])
+	if not answer then
+		break
+	end
+	answers[i] = answer
+end
+return answers`
+
+func (backend *RedisBackend) MultiRPopLPush(source, destination string, count int64) ([]string, error) {
+	result, err := backend.client.Eval(
+		multiRPopLPushScript,
+		[]string{source, destination},
+		[]string{fmt.Sprintf("%d", count)},
+	).Result()
+	if err != nil {
+		return nil, err
+	}
+	values, ok := result.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("unexpected pop result %v", result)
+	}
+	answers := make([]string, 0, len(values))
+	for _, value := range values {
+		answer, ok := value.(string)
+		if !ok {
+			return nil, fmt.Errorf("unexpected pop result %v", result)
+		}
+		answers = append(answers, answer)
+	}
+	return answers, nil
+}
+
+// rPopLPushValueScript replaces the rightmost value of KEYS[1] with ARGV[1] while moving it
+var rPopLPushValueScript = `
+if redis.call('RPOP', KEYS[1]) then
+	redis.call('LPUSH', KEYS[2], ARGV[1])
+end
+return 1`
+
+func (backend *RedisBackend) RPopLPushValue(source, destination, value string) error {
+	return backend.client.Eval(rPopLPushValueScript, []string{source, destination}, []string{value}).Err()
+}
+
+// lPushBoundedScript implements LPushBounded with ARGV[1] as max and ARGV[2] as mode
+var lPushBoundedScript = `
+local max = tonumber(ARGV[1])
+local mode = ARGV[2]
+local length = redis.call('LLEN', KEYS[1])
+local count = #ARGV - 2
+if mode ~= 'drop' and length + count > max then
+	if mode == 'all' or length >= max then
+		return 0
+	end
+	count = max - length
+end
+for i = 3, count + 2 do
+	redis.call('LPUSH', KEYS[1], ARGV[i])
+end
+if mode == 'drop' and length + count > max then
+	redis.call('LTRIM', KEYS[1], 0, max - 1)
+	redis.call('INCRBY', KEYS[2], length + count - max)
+end
+return count`
+
+func (backend *RedisBackend) LPushBounded(key, droppedKey string, max int64, mode string, values []string) (int64, error) {
+	args := make([]string, 0, len(values)+2)
+	args = append(args, fmt.Sprintf("%d", max), mode)
+	args = append(args, values...)
+	result, err := backend.client.Eval(lPushBoundedScript, []string{key, droppedKey}, args).Result()
+	if err != nil {
+		return 0, err
+	}
+	pushed, ok := result.(int64)
+	if !ok {
+		return 0, fmt.Errorf("unexpected push result %v", result)
+	}
+	return pushed, nil
+}
+
+// lPushEachScript pushes all ARGV to every list in KEYS, in batches to stay within the stack of lua
+var lPushEachScript = `
+for _, key in ipairs(KEYS) do
+	for i = 1, #ARGV, 1000 do
+		redis.call('LPUSH', key, unpack(ARGV, i, math.min(i + 999, #ARGV)))
+	end
+end
+return #KEYS`
+
+func (backend *RedisBackend) LPushEach(keys []string, values []string) error {
+	return backend.client.Eval(lPushEachScript, keys, values).Err()
+}
+
+// rotateCheckedScript implements RotateChecked with pairs of action and value as ARGV
+var rotateCheckedScript = `
+local processed, matched = 0, 0
+for i = 1, #ARGV, 2 do
+	local action, answer = ARGV[i], ARGV[i + 1]
+	if redis.call('LINDEX', KEYS[1], -1) ~= answer then
+		break
+	end
+	redis.call('RPOP', KEYS[1])
+	if action == 'r' then
+		redis.call('LPUSH', KEYS[2], answer)
+	elseif action == 'k' then
+		redis.call('LPUSH', KEYS[1], answer)
+	end
+	if action ~= 'k' then
+		matched = matched + 1
+	end
+	processed = processed + 1
+end
+return {processed, matched}`
+
+func (backend *RedisBackend) RotateChecked(key, destination string, actions, values []string) (processed, matched int64, err error) {
+	args := make([]string, 0, 2*len(values))
+	for i, value := range values {
+		args = append(args, actions[i], value)
+	}
+	result, err := backend.client.Eval(rotateCheckedScript, []string{key, destination}, args).Result()
+	if err != nil {
+		return 0, 0, err
+	}
+	return parseRotateResult(result)
+}
+
+func parseRotateResult(result interface{}) (processed, matched int64, err error) {
+	values, ok := result.([]interface{})
+	if !ok || len(values) != 2 {
+		return 0, 0, fmt.Errorf("unexpected rotate result %v", result)
+	}
+	processed, ok = values[0].(int64)
+	if !ok {
+		return 0, 0, fmt.Errorf("unexpected rotate result %v", result)
+	}
+	matched, ok = values[1].(int64)
+	if !ok {
+		return 0, 0, fmt.Errorf("unexpected rotate result %v", result)
+	}
+	return processed, matched, nil
+}
+
+func (backend *RedisBackend) LLen(key string) (int64, error) {
+	return backend.client.LLen(key).Result()
+}
+
+func (backend *RedisBackend) LRange(key string, start, stop int64) ([]string, error) {
+	return backend.client.LRange(key, start, stop).Result()
+}
+
+func (backend *RedisBackend) LIndex(key string, index int64) (string, error) {
+	return backend.client.LIndex(key, index).Result()
+}
+
+func (backend *RedisBackend) LTrim(key string, start, stop int64) error {
+	return backend.client.LTrim(key, start, stop).Err()
+}
+
+func (backend *RedisBackend) SAdd(key string, members ...string) (int64, error) {
+	return backend.client.SAdd(key, members...).Result()
+}
+
+func (backend *RedisBackend) SRem(key string, members ...string) error {
+	return backend.client.SRem(key, members...).Err()
+}
+
+func (backend *RedisBackend) SMembers(key string) ([]string, error) {
+	return backend.client.SMembers(key).Result()
+}
+
+func (backend *RedisBackend) SIsMember(key, member string) (bool, error) {
+	return backend.client.SIsMember(key, member).Result()
+}
+
+func (backend *RedisBackend) Get(key string) (string, error) {
+	return backend.client.Get(key).Result()
+}
+
+func (backend *RedisBackend) MGet(keys ...string) ([]interface{}, error) {
+	return backend.client.MGet(keys...).Result()
+}
+
+func (backend *RedisBackend) Set(key, value string, expiration time.Duration) error {
+	return backend.client.Set(key, value, expiration).Err()
+}
+
+func (backend *RedisBackend) IncrBy(key string, value int64, expiration time.Duration) error {
+	err := backend.client.IncrBy(key, value).Err()
+	if err != nil || expiration <= 0 {
+		return err
+	}
+	return backend.client.Expire(key, expiration).Err()
+}
+
+func (backend *RedisBackend) Exists(key string) (bool, error) {
+	return backend.client.Exists(key).Result()
+}
+
+// acquireSlotsScript increments KEYS[1] by up to ARGV[2] without exceeding ARGV[1]
+var acquireSlotsScript = `
+local inFlight = tonumber(redis.call('GET', KEYS[1]) or '0')
+local count = math.min(tonumber(ARGV[2]), tonumber(ARGV[1]) - inFlight)
+if count <= 0 then
+	return 0
+end
+redis.call('INCRBY', KEYS[1], count)
+return count`
+
+func (backend *RedisBackend) AcquireSlots(key string, max, count int64) (int64, error) {
+	result, err := backend.client.Eval(
+		acquireSlotsScript,
+		[]string{key},
+		[]string{fmt.Sprintf("%d", max), fmt.Sprintf("%d", count)},
+	).Result()
+	if err != nil {
+		return 0, err
+	}
+	acquired, ok := result.(int64)
+	if !ok {
+		return 0, fmt.Errorf("unexpected slots result %v", result)
+	}
+	return acquired, nil
+}
+
+// releaseSlotsScript decrements KEYS[1] by ARGV[1] but not below 0
+var releaseSlotsScript = `
+local count = math.min(tonumber(redis.call('GET', KEYS[1]) or '0'), tonumber(ARGV[1]))
+if count > 0 then
+	redis.call('DECRBY', KEYS[1], count)
+end
+return count`
+
+func (backend *RedisBackend) ReleaseSlots(key string, count int64) error {
+	return backend.client.Eval(releaseSlotsScript, []string{key}, []string{fmt.Sprintf("%d", count)}).Err()
+}
+
+// releaseHeldSlotsScript removes ARGV from the set KEYS[2] and decrements KEYS[1] by the removed number
+var releaseHeldSlotsScript = `
+local count = math.min(tonumber(redis.call('GET', KEYS[1]) or '0'), redis.call('SREM', KEYS[2], unpack(ARGV)))
+if count > 0 then
+	redis.call('DECRBY', KEYS[1], count)
+end
+return count`
+
+func (backend *RedisBackend) ReleaseHeldSlots(key, holders string, ids ...string) error {
+	if len(ids) == 0 {
+		return nil
+	}
+	return backend.client.Eval(releaseHeldSlotsScript, []string{key, holders}, ids).Err()
+}
+
+// reserveTokensScript takes ARGV[3] tokens from the bucket KEYS[1] refilled with ARGV[1] tokens
+// per second up to ARGV[2] at the time ARGV[4] in unix milliseconds and returns the milliseconds to wait
+var reserveTokensScript = `
+local rate, burst, count, now = tonumber(ARGV[1]), tonumber(ARGV[2]), tonumber(ARGV[3]), tonumber(ARGV[4])
+local tokens = burst
+local state = redis.call('GET', KEYS[1])
+if state then
+	local separator = string.find(state, ' ')
+	tokens = tonumber(string.sub(state, 1, separator - 1))
+	local updated = tonumber(string.sub(state, separator + 1))
+	if now > updated then
+		tokens = math.min(burst, tokens + (now - updated) * rate / 1000)
+	end
+end
+tokens = tokens - count
+local ttl = math.ceil((burst - tokens) * 1000 / rate) + 1000
+redis.call('SET', KEYS[1], string.format('%.6f', tokens) .. ' ' .. now, 'PX', ttl)
+if tokens >= 0 then
+	return 0
+end
+return math.ceil(-tokens * 1000 / rate)`
+
+func (backend *RedisBackend) ReserveTokens(key string, rate float64, burst, count int64) (time.Duration, error) {
+	result, err := backend.client.Eval(
+		reserveTokensScript,
+		[]string{key},
+		[]string{
+			strconv.FormatFloat(rate, 'f', -1, 64),
+			fmt.Sprintf("%d", burst),
+			fmt.Sprintf("%d", count),
+			// the clock of the client is used as scripts can't write after reading the time
+			fmt.Sprintf("%d", time.Now().UnixNano()/int64(time.Millisecond)),
+		},
+	).Result()
+	if err != nil {
+		return 0, err
+	}
+	wait, ok := result.(int64)
+	if !ok {
+		return 0, fmt.Errorf("unexpected tokens result %v", result)
+	}
+	return time.Duration(wait) * time.Millisecond, nil
+}
+
+// acquireLeaseScript sets KEYS[1] to the owner ARGV[1] for ARGV[2] milliseconds unless another owner holds it
+var acquireLeaseScript = `
+local owner = redis.call('GET', KEYS[1])
+if owner and owner ~= ARGV[1] then
+	return 0
+end
+redis.call('SET', KEYS[1], ARGV[1], 'PX', ARGV[2])
+return 1`
+
+func (backend *RedisBackend) AcquireLease(key, owner string, ttl time.Duration) (bool, error) {
+	result, err := backend.client.Eval(
+		acquireLeaseScript,
+		[]string{key},
+		[]string{owner, fmt.Sprintf("%d", ttl/time.Millisecond)},
+	).Result()
+	if err != nil {
+		return false, err
+	}
+	return result == int64(1), nil
+}
+
+// releaseLeaseScript removes KEYS[1] if it is held by the owner ARGV[1]
+var releaseLeaseScript = `
+if redis.call('GET', KEYS[1]) == ARGV[1] then
+	redis.call('DEL', KEYS[1])
+end
+return 1`
+
+func (backend *RedisBackend) ReleaseLease(key, owner string) error {
+	return backend.client.Eval(releaseLeaseScript, []string{key}, []string{owner}).Err()
+}
+
+func (backend *RedisBackend) Del(keys ...string) error {
+	return backend.client.Del(keys...).Err()
+}
+
+func (backend *RedisBackend) Ping() error {
+	return backend.client.Ping().Err()
+}
+
+func (backend *RedisBackend) Close() error {
+	return backend.client.Close()
+}
@@ -0,0 +1,235 @@
+package redismq
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// OverflowPolicy decides what happens to puts into a bounded queue that is full
+type OverflowPolicy int
+
+const (
+	// OverflowReject fails puts with ErrQueueFull
+	OverflowReject OverflowPolicy = iota
+	// OverflowBlock waits until there is space or the context of the put is done
+	OverflowBlock
+	// OverflowDropOldest accepts puts and deletes the oldest packages, they are counted in the stats
+	OverflowDropOldest
+)
+
+// ErrQueueFull is returned by puts into a bounded queue that is full
+var ErrQueueFull = errors.New("queue is full")
+
+// overflowPollInterval is how often blocked puts check for space
+const overflowPollInterval = 100 * time.Millisecond
+
+// layoutRefreshInterval is how often puts reload the partitions, groups and limits of the queue
+const layoutRefreshInterval = 500 * time.Millisecond
+
+// modes of Backend.LPushBounded
+const (
+	pushAll  = "all"
+	pushSome = "some"
+	pushDrop = "drop"
+)
+
+// SetMaxLength bounds the input queue to max packages, 0 removes the bound.
+// The bound and its policy are stored in redis, producers in other processes pick them up within a second.
+// The bound is checked atomically with every put so it holds for concurrent producers.
+// Stream queues and queues with groups or partitions can't be bounded.
+func (queue *Queue) SetMaxLength(max int64, policy OverflowPolicy) error {
+	if max < 0 {
+		return fmt.Errorf("max length must not be negative")
+	}
+	if max == 0 {
+		err := queue.backend.Del(queue.keys.queueMaxLengthKey(queue.Name))
+		if err != nil {
+			return err
+		}
+		return queue.loadLimits()
+	}
+	if policy < OverflowReject || policy > OverflowDropOldest {
+		return fmt.Errorf("invalid overflow policy %d", policy)
+	}
+	if queue.streams {
+		return errStreamUnsupported
+	}
+	queue.forgetLayout()
+	partitions, groups, err := queue.putLayout()
+	if err != nil {
+		return err
+	}
+	if partitions > 0 {
+		return errPartitionsUnsupported
+	}
+	if len(groups) > 0 {
+		return errGroupsBounded
+	}
+	err = queue.backend.Set(queue.keys.queueMaxLengthKey(queue.Name), formatMaxLength(max, policy), 0)
+	if err != nil {
+		return err
+	}
+	return queue.loadLimits()
+}
+
+// isBounded reloads the limits and reports whether the input queue is bounded
+func (queue *Queue) isBounded() (bool, error) {
+	err := queue.loadLimits()
+	if err != nil {
+		return false, err
+	}
+	maxLength, _ := queue.currentMaxLength()
+	return maxLength > 0, nil
+}
+
+// push writes the packages into the input queue keeping their order
+func (queue *Queue) push(ctx context.Context, packages []*Package) error {
+	if len(packages) == 0 {
+		return nil
+	}
+	values := make([]string, len(packages))
+	for i, p := range packages {
+		values[i] = p.getString()
+	}
+	if queue.streams {
+		return queue.streamPush(values)
+	}
+	partitions, groups, err := queue.putLayout()
+	if err != nil {
+		return err
+	}
+	if partitions > 0 {
+		return queue.pushPartitions(packages, partitions)
+	}
+	maxLength, policy := queue.currentMaxLength()
+	if len(groups) > 0 && maxLength > 0 {
+		return errGroupsBounded
+	}
+	if len(groups) > 0 {
+		return queue.pushGroups(groups, values)
+	}
+	if maxLength <= 0 {
+		err := queue.backend.LPush(queue.keys.queueInputKey(queue.Name), values...)
+		queue.incrRate(queue.keys.queueInputRateKey(queue.Name), int64(len(values)))
+		return err
+	}
+
+	switch policy {
+	case OverflowDropOldest:
+		_, err := queue.pushBounded(values, maxLength, pushDrop)
+		return err
+	case OverflowReject:
+		pushed, err := queue.pushBounded(values, maxLength, pushAll)
+		if err == nil && pushed == 0 {
+			return ErrQueueFull
+		}
+		return err
+	}
+
+	if int64(len(values)) > maxLength {
+		return ErrQueueFull
+	}
+	for {
+		pushed, err := queue.pushBounded(values, maxLength, pushAll)
+		if err != nil || pushed > 0 {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(overflowPollInterval):
+		}
+	}
+}
+
+// boundError returns why the bound can't be applied to puts of the queue, nil without bound
+func (queue *Queue) boundError() error {
+	partitions, groups, err := queue.putLayout()
+	if err != nil {
+		return err
+	}
+	if maxLength, _ := queue.currentMaxLength(); maxLength <= 0 {
+		return nil
+	}
+	if queue.streams {
+		return errStreamUnsupported
+	}
+	if partitions > 0 {
+		return errPartitionsUnsupported
+	}
+	if len(groups) > 0 {
+		return errGroupsBounded
+	}
+	return nil
+}
+
+// putLayout returns the partitions and the input keys of the groups of the queue for puts.
+// Other processes may change them and the limits, they are reloaded at most every layoutRefreshInterval.
+func (queue *Queue) putLayout() (int64, []string, error) {
+	queue.layoutMutex.Lock()
+	defer queue.layoutMutex.Unlock()
+	if time.Since(queue.layoutLoadedAt) >= layoutRefreshInterval {
+		err := queue.reloadPartitions()
+		if err != nil {
+			return 0, nil, err
+		}
+		err = queue.loadLimits()
+		if err != nil {
+			return 0, nil, err
+		}
+		groups, err := queue.groupInputKeys()
+		if err != nil {
+			return 0, nil, err
+		}
+		queue.groupKeys = groups
+		queue.layoutLoadedAt = time.Now()
+	}
+	return queue.GetPartitions(), queue.groupKeys, nil
+}
+
+// forgetLayout makes the next put reload the partitions, groups and limits
+func (queue *Queue) forgetLayout() {
+	queue.layoutMutex.Lock()
+	queue.layoutLoadedAt = time.Time{}
+	queue.layoutMutex.Unlock()
+}
+
+// pushBounded pushes the values within maxLength and returns their number
+func (queue *Queue) pushBounded(values []string, maxLength int64, mode string) (int64, error) {
+	pushed, err := queue.backend.LPushBounded(
+		queue.keys.queueInputKey(queue.Name),
+		queue.keys.queueDroppedKey(queue.Name),
+		maxLength,
+		mode,
+		values,
+	)
+	if err != nil {
+		return 0, err
+	}
+	if pushed > 0 {
+		queue.incrRate(queue.keys.queueInputRateKey(queue.Name), pushed)
+	}
+	return pushed, nil
+}
+
+// formatMaxLength stores the bound and the policy separated by a space
+func formatMaxLength(max int64, policy OverflowPolicy) string {
+	return strconv.FormatInt(max, 10) + " " + strconv.Itoa(int(policy))
+}
+
+func parseMaxLength(value string) (max int64, policy OverflowPolicy, err error) {
+	fields := strings.Fields(value)
+	if len(fields) != 2 {
+		return 0, 0, fmt.Errorf("invalid max length %q", value)
+	}
+	max, err = strconv.ParseInt(fields[0], 10, 64)
+	if err != nil {
+		return 0, 0, err
+	}
+	code, err := strconv.Atoi(fields[1])
+	return max, OverflowPolicy(code), err
+}
@@ -0,0 +1,128 @@
+package redismq
+
+import (
+	"context"
+	"time"
+
+	. "github.com/matttproud/gocheck"
+)
+
+// should reject puts into a full queue without changing it
+func (suite *TestSuite) TestBoundedReject(c *C) {
+	c.Assert(suite.queue.SetMaxLength(2, OverflowReject), IsNil)
+	c.Check(suite.queue.MultiPut("first", "second"), IsNil)
+	c.Check(suite.queue.Put("third"), Equals, ErrQueueFull)
+	c.Check(suite.queue.GetInputLength(), Equals, int64(2))
+
+	c.Assert(suite.queue.SetMaxLength(3, OverflowReject), IsNil)
+	c.Check(suite.queue.MultiPut("third", "fourth"), Equals, ErrQueueFull)
+	c.Check(suite.queue.GetInputLength(), Equals, int64(2))
+}
+
+// should wait for space until the context is done
+func (suite *TestSuite) TestBoundedBlock(c *C) {
+	c.Assert(suite.queue.SetMaxLength(1, OverflowBlock), IsNil)
+	c.Check(suite.queue.Put("first"), IsNil)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	c.Check(suite.queue.PutContext(ctx, "second"), Equals, context.DeadlineExceeded)
+
+	go func() {
+		time.Sleep(200 * time.Millisecond)
+		p, err := suite.consumer.Get()
+		if err == nil {
+			p.Ack()
+		}
+	}()
+	c.Check(suite.queue.PutContext(context.Background(), "second"), IsNil)
+	p, err := suite.queue.PeekInput(0, 1)
+	c.Assert(err, IsNil)
+	c.Check(p[0].Payload, Equals, "second")
+}
+
+// should drop the oldest packages and count them in the stats
+func (suite *TestSuite) TestBoundedDropOldest(c *C) {
+	c.Assert(suite.queue.SetMaxLength(2, OverflowDropOldest), IsNil)
+	c.Check(suite.queue.MultiPut("first", "second", "third"), IsNil)
+	c.Check(suite.queue.Put("fourth"), IsNil)
+
+	packages, err := suite.queue.PeekInput(0, 10)
+	c.Assert(err, IsNil)
+	c.Assert(packages, HasLen, 2)
+	c.Check(packages[0].Payload, Equals, "third")
+	c.Check(packages[1].Payload, Equals, "fourth")
+
+	observer := NewObserver(redisHost, redisPort, redisPassword, redisDB)
+	c.Assert(observer.UpdateAllStats(), IsNil)
+	c.Check(observer.Snapshot().Stats["teststuff"].Dropped, Equals, int64(2))
+}
+
+// should reject buffered puts while the buffer can't be written
+func (suite *TestSuite) TestBoundedBufferedQueue(c *C) {
+	queue := CreateBufferedQueue(redisHost, redisPort, redisPassword, redisDB, "testbounded", 1)
+	c.Assert(queue.SetMaxLength(1, OverflowReject), IsNil)
+	c.Assert(queue.Start(), IsNil)
+
+	c.Check(queue.Put("first"), IsNil)
+	queue.FlushBuffer()
+	c.Check(queue.GetInputLength(), Equals, int64(1))
+
+	rejected := false
+	for i := 0; i < 10 && !rejected; i++ {
+		rejected = queue.Put("more") == ErrQueueFull
+		time.Sleep(50 * time.Millisecond)
+	}
+	c.Check(rejected, Equals, true)
+	c.Check(queue.GetInputLength(), Equals, int64(1))
+}
+
+// bounded buffered queues should refuse groups and partitions instead of dropping buffered packages
+func (suite *UnitSuite) TestBoundedBufferedQueueLayout(c *C) {
+	backend := NewMemoryBackend()
+	partitioned := CreateBufferedQueueWithBackend(backend, "bufferedpartitioned", 10)
+	c.Check(partitioned.SetPartitions(2), IsNil)
+	c.Check(partitioned.SetMaxLength(5, OverflowReject), Equals, errPartitionsUnsupported)
+
+	queue := CreateQueueWithBackend(backend, "bufferedgrouped")
+	buffered := CreateBufferedQueueWithBackend(backend, "bufferedgrouped", 10)
+	c.Assert(buffered.SetMaxLength(5, OverflowReject), IsNil)
+	c.Check(queue.AddGroup("billing"), Equals, errGroupsBounded)
+	// a group added by a process racing with SetMaxLength
+	_, err := backend.SAdd(queue.keys.queueGroupsKey(queue.Name), "billing")
+	c.Assert(err, IsNil)
+	buffered.forgetLayout()
+	c.Check(buffered.Start(), Equals, errGroupsBounded)
+	c.Check(buffered.Put("refused"), Equals, errGroupsBounded)
+
+	written, err := buffered.writePackages([]*Package{newPackage("accepted", buffered)})
+	c.Check(err, Equals, errGroupsBounded)
+	c.Check(written, Equals, 0)
+	c.Check(queue.RemoveGroup("billing"), IsNil)
+	buffered.forgetLayout()
+	written, err = buffered.writePackages([]*Package{newPackage("accepted", buffered)})
+	c.Check(err, IsNil)
+	c.Check(written, Equals, 1)
+	c.Check(queue.GetInputLength(), Equals, int64(1))
+}
+
+// should apply a bound set by another producer and keep it in redis
+func (suite *UnitSuite) TestBoundedSharedByProducers(c *C) {
+	backend := NewMemoryBackend()
+	producer := CreateQueueWithBackend(backend, "boundedshared")
+	admin := CreateQueueWithBackend(backend, "boundedshared")
+	c.Check(admin.SetMaxLength(-1, OverflowReject), Not(IsNil))
+	c.Assert(admin.SetMaxLength(1, OverflowReject), IsNil)
+
+	producer.forgetLayout()
+	c.Check(producer.Put("first"), IsNil)
+	c.Check(producer.Put("second"), Equals, ErrQueueFull)
+	late := CreateQueueWithBackend(backend, "boundedshared")
+	c.Check(late.Put("second"), Equals, ErrQueueFull)
+	c.Check(late.SetPartitions(2), Equals, errPartitionsUnsupported)
+
+	c.Assert(admin.SetMaxLength(0, OverflowReject), IsNil)
+	producer.forgetLayout()
+	c.Check(producer.Put("second"), IsNil)
+	c.Check(producer.GetInputLength(), Equals, int64(2))
+}
@@ -1,7 +1,10 @@
 package redismq
 
 import (
+	"context"
 	"fmt"
+	"log"
+	"sync/atomic"
 	"time"
 )
 
@@ -15,6 +18,8 @@ type BufferedQueue struct {
 	nextWrite    int64
 	flushStatus  chan (chan bool)
 	flushCommand chan bool
+	// full is set while the writer waits for space in a bounded queue
+	full int32
 }
 
 // CreateBufferedQueue returns BufferedQueue.
@@ -23,13 +28,17 @@ type BufferedQueue struct {
 // Works like SelectBufferedQueue for existing queues
 func CreateBufferedQueue(redisHost, redisPort, redisPassword string, redisDB int64, name string, bufferSize int) *BufferedQueue {
 	q := CreateQueue(redisHost, redisPort, redisPassword, redisDB, name)
-	return &BufferedQueue{
-		Queue:        q,
-		BufferSize:   bufferSize,
-		Buffer:       make(chan *Package, bufferSize*2),
-		flushStatus:  make(chan chan bool, 1),
-		flushCommand: make(chan bool, bufferSize*2),
-	}
+	return newBufferedQueue(q, bufferSize)
+}
+
+// CreateBufferedQueueWithClient works like CreateBufferedQueue but uses the given client, see CreateQueueWithClient
+func CreateBufferedQueueWithClient(redisClient RedisClient, name string, bufferSize int) *BufferedQueue {
+	return newBufferedQueue(CreateQueueWithClient(redisClient, name), bufferSize)
+}
+
+// CreateBufferedQueueWithBackend works like CreateBufferedQueue but uses the given backend, see CreateQueueWithBackend
+func CreateBufferedQueueWithBackend(backend Backend, name string, bufferSize int) *BufferedQueue {
+	return newBufferedQueue(CreateQueueWithBackend(backend, name), bufferSize)
 }
 
 // SelectBufferedQueue returns a BufferedQueue if a queue with the name exists
@@ -38,21 +47,47 @@ func SelectBufferedQueue(redisHost, redisPort, redisPassword string, redisDB int
 	if err != nil {
 		return nil, err
 	}
+	return newBufferedQueue(q, bufferSize), nil
+}
+
+// SelectBufferedQueueWithClient works like SelectBufferedQueue but uses the given client, see CreateQueueWithClient
+func SelectBufferedQueueWithClient(redisClient RedisClient, name string, bufferSize int) (queue *BufferedQueue, err error) {
+	q, err := SelectQueueWithClient(redisClient, name)
+	if err != nil {
+		return nil, err
+	}
+	return newBufferedQueue(q, bufferSize), nil
+}
 
+// SelectBufferedQueueWithBackend works like SelectBufferedQueue but uses the given backend, see CreateQueueWithBackend
+func SelectBufferedQueueWithBackend(backend Backend, name string, bufferSize int) (queue *BufferedQueue, err error) {
+	q, err := SelectQueueWithBackend(backend, name)
+	if err != nil {
+		return nil, err
+	}
+	return newBufferedQueue(q, bufferSize), nil
+}
+
+func newBufferedQueue(q *Queue, bufferSize int) *BufferedQueue {
 	return &BufferedQueue{
 		Queue:        q,
 		BufferSize:   bufferSize,
 		Buffer:       make(chan *Package, bufferSize*2),
 		flushStatus:  make(chan chan bool, 1),
 		flushCommand: make(chan bool, bufferSize*2),
-	}, nil
+	}
 }
 
 // Start dispatches the background writer that flushes the buffer.
-// If there is already a BufferedQueue running it will return an error.
+// If there is already a BufferedQueue running it will return an error, as well as for bounds
+// of queues with groups or partitions and of stream queues.
 func (queue *BufferedQueue) Start() error {
-	queue.redisClient.SAdd(masterQueueKey(), queue.Name)
-	val := queue.redisClient.Get(queueHeartbeatKey(queue.Name)).Val()
+	err := queue.boundError()
+	if err != nil {
+		return err
+	}
+	queue.backend.SAdd(queue.keys.masterQueueKey(), queue.Name)
+	val, _ := queue.backend.Get(queue.keys.queueHeartbeatKey(queue.Name))
 	if val == "ping" {
 		return fmt.Errorf("buffered queue with this name is already started")
 	}
@@ -64,9 +99,41 @@ func (queue *BufferedQueue) Start() error {
 
 // Put writes the payload to the buffer
 func (queue *BufferedQueue) Put(payload string) error {
-	p := &Package{CreatedAt: time.Now(), Payload: payload, Queue: queue}
-	queue.Buffer <- p
-	queue.flushCommand <- true
+	return queue.PutContext(context.Background(), payload)
+}
+
+// PutContext writes the payload to the buffer. If the queue is bounded packages in the buffer
+// are written as soon as there is space, unless the policy is OverflowDropOldest.
+// With OverflowReject puts fail with ErrQueueFull while the buffer can't be written,
+// with OverflowBlock they wait for space in the buffer at most until the context is done.
+// Puts fail while groups or partitions, which can't be bounded, were added to a bounded queue.
+func (queue *BufferedQueue) PutContext(ctx context.Context, payload string) error {
+	err := queue.boundError()
+	if err != nil {
+		return err
+	}
+	p := newPackage(payload, queue)
+	if maxLength, policy := queue.currentMaxLength(); maxLength > 0 && policy == OverflowReject {
+		if atomic.LoadInt32(&queue.full) == 1 {
+			return ErrQueueFull
+		}
+		select {
+		case queue.Buffer <- p:
+		default:
+			return ErrQueueFull
+		}
+	} else {
+		select {
+		case queue.Buffer <- p:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	// the writer might be waiting for space, it flushes again after that anyway
+	select {
+	case queue.flushCommand <- true:
+	default:
+	}
 	return nil
 }
 
@@ -85,13 +152,11 @@ func (queue *BufferedQueue) startWritingBufferToRedis() {
 		for {
 			if len(queue.Buffer) >= queue.BufferSize || time.Now().Unix() >= queue.nextWrite {
 				size := len(queue.Buffer)
-				a := []string{}
+				a := []*Package{}
 				for i := 0; i < size; i++ {
-					p := <-queue.Buffer
-					a = append(a, p.getString())
+					a = append(a, <-queue.Buffer)
 				}
-				queue.redisClient.LPush(queueInputKey(queue.Name), a...)
-				queue.incrRate(queueInputRateKey(queue.Name), int64(size))
+				queue.writeBuffer(a)
 				for i := 0; i < len(queue.flushStatus); i++ {
 					c := <-queue.flushStatus
 					c <- true
@@ -103,6 +168,65 @@ func (queue *BufferedQueue) startWritingBufferToRedis() {
 	}()
 }
 
+// writeBuffer pushes the packages, for bounded queues it waits until all of them fit.
+// Packages that can't be written are retried, accepted packages are never dropped.
+func (queue *BufferedQueue) writeBuffer(packages []*Package) {
+	for len(packages) > 0 {
+		written, err := queue.writePackages(packages)
+		if err != nil {
+			log.Printf("REDISMQ FAILED TO WRITE BUFFER OF %s [%s]", queue.Name, err.Error())
+		}
+		packages = packages[written:]
+		if len(packages) > 0 {
+			atomic.StoreInt32(&queue.full, 1)
+			time.Sleep(overflowPollInterval)
+		}
+	}
+	atomic.StoreInt32(&queue.full, 0)
+}
+
+// writePackages pushes the packages and returns how many of them were written
+func (queue *BufferedQueue) writePackages(packages []*Package) (int, error) {
+	partitions, groups, err := queue.putLayout()
+	if err != nil {
+		return 0, err
+	}
+	if partitions > 0 {
+		err = queue.pushPartitions(packages, partitions)
+		if err != nil {
+			return 0, err
+		}
+		return len(packages), nil
+	}
+	values := make([]string, len(packages))
+	for i, p := range packages {
+		values[i] = p.getString()
+	}
+	maxLength, policy := queue.currentMaxLength()
+	switch {
+	case queue.streams:
+		err = queue.streamPush(values)
+	case len(groups) > 0 && maxLength > 0:
+		err = errGroupsBounded
+	case len(groups) > 0:
+		err = queue.pushGroups(groups, values)
+	case maxLength <= 0:
+		err = queue.backend.LPush(queue.keys.queueInputKey(queue.Name), values...)
+		if err == nil {
+			queue.incrRate(queue.keys.queueInputRateKey(queue.Name), int64(len(values)))
+		}
+	case policy == OverflowDropOldest:
+		_, err = queue.pushBounded(values, maxLength, pushDrop)
+	default:
+		pushed, err := queue.pushBounded(values, maxLength, pushSome)
+		return int(pushed), err
+	}
+	if err != nil {
+		return 0, err
+	}
+	return len(packages), nil
+}
+
 func (queue *BufferedQueue) startPacemaker() {
 	go func() {
 		for {
@@ -117,7 +241,7 @@ func (queue *BufferedQueue) startHeartbeat() {
 	go func() {
 		firstRun := true
 		for {
-			queue.redisClient.Set(queueHeartbeatKey(queue.Name), "ping", time.Second)
+			queue.backend.Set(queue.keys.queueHeartbeatKey(queue.Name), "ping", time.Second)
 			if firstRun {
 				firstWrite <- true
 				firstRun = false
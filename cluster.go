@@ -0,0 +1,280 @@
+package redismq
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	"gopkg.in/redis.v3"
+)
+
+// RedisClient is the part of the redis API used by redismq. It is implemented by *redis.Client,
+// including the sentinel client of NewSentinelClient, and *redis.ClusterClient.
+// Queues, observers and gateways using a *redis.ClusterClient or a client wrapped by
+// UseClusterLayout store their keys in the cluster layout.
+type RedisClient interface {
+	BRPopLPush(source, destination string, timeout time.Duration) *redis.StringCmd
+	Close() error
+	Del(keys ...string) *redis.IntCmd
+	Eval(script string, keys []string, args []string) *redis.Cmd
+	Exists(key string) *redis.BoolCmd
+	Expire(key string, expiration time.Duration) *redis.BoolCmd
+	Get(key string) *redis.StringCmd
+	IncrBy(key string, value int64) *redis.IntCmd
+	LIndex(key string, index int64) *redis.StringCmd
+	LLen(key string) *redis.IntCmd
+	LPush(key string, values ...string) *redis.IntCmd
+	LRange(key string, start, stop int64) *redis.StringSliceCmd
+	LTrim(key string, start, stop int64) *redis.StatusCmd
+	MGet(keys ...string) *redis.SliceCmd
+	Ping() *redis.StatusCmd
+	Process(cmd redis.Cmder)
+	RPop(key string) *redis.StringCmd
+	RPopLPush(source, destination string) *redis.StringCmd
+	SAdd(key string, members ...string) *redis.IntCmd
+	SIsMember(key string, member interface{}) *redis.BoolCmd
+	SMembers(key string) *redis.StringSliceCmd
+	SRem(key string, members ...string) *redis.IntCmd
+	Set(key string, value interface{}, expiration time.Duration) *redis.StatusCmd
+}
+
+// clusterLayoutClient is a standalone client that uses the cluster layout
+type clusterLayoutClient struct {
+	*redis.Client
+}
+
+// UseClusterLayout returns the client for use with the *WithClient constructors so that
+// queues store their keys in the cluster layout on a standalone redis or sentinel setup.
+// Use it to keep one layout while moving between a standalone redis and a cluster.
+func UseClusterLayout(client *redis.Client) RedisClient {
+	return &clusterLayoutClient{client}
+}
+
+// NewClusterClient returns a client for the redis cluster with the given seed nodes
+func NewClusterClient(addrs []string, redisPassword string) *redis.ClusterClient {
+	return redis.NewClusterClient(&redis.ClusterOptions{
+		Addrs:    addrs,
+		Password: redisPassword,
+	})
+}
+
+// migrateListScript moves up to ARGV[1] packages from KEYS[1] to the right end of KEYS[2],
+// newest first, so that they are fetched before packages already in KEYS[2]. It returns the moved number.
+var migrateListScript = `
+for i = 1, tonumber(ARGV[1]) do
+	local answer = redis.call('LPOP', KEYS[1])
+	if not answer then
+		return i - 1
+	end
+	redis.call('RPUSH', KEYS[2], answer)
+end
+return tonumber(ARGV[1])`
+
+// migrateStreamScript renames the stream KEYS[1] to KEYS[2] unless KEYS[2] exists, it returns 0 in that case
+var migrateStreamScript = `
+if redis.call('EXISTS', KEYS[2]) == 1 then
+	return 0
+end
+if redis.call('EXISTS', KEYS[1]) == 1 then
+	redis.call('RENAME', KEYS[1], KEYS[2])
+end
+return 1`
+
+// MigrateToClusterLayout moves the packages, consumers, counters and limits of a queue from the
+// original key layout to the cluster layout on the same standalone redis, packages already put
+// with the cluster layout are fetched after the migrated ones. Stats history isn't migrated.
+// Stream queues keep their stream with its pending packages, they are refused if the stream
+// already exists in the cluster layout. Partitioned queues keep their partitions, they are refused
+// if the cluster layout has a different number of partitions.
+// It is refused while consumers are active. To move a queue into a cluster afterwards
+// use Export and Import. The client may be wrapped by UseNamespace.
+func MigrateToClusterLayout(client RedisClient, name string) error {
+	if keysFor(client).cluster {
+		return fmt.Errorf("client already uses the cluster layout")
+	}
+	legacy, err := SelectQueueWithClient(client, name)
+	if err != nil {
+		return err
+	}
+	clustered := &Queue{Name: name, backend: legacy.backend, keys: legacy.keys, limits: &limits{}}
+	clustered.keys.cluster = true
+
+	consumers, err := legacy.getConsumers()
+	if err != nil {
+		return err
+	}
+	for _, consumer := range consumers {
+		if legacy.isActiveConsumer(consumer) {
+			return fmt.Errorf("cannot migrate queue with active consumers")
+		}
+	}
+	groups, err := legacy.GetGroups()
+	if err != nil {
+		return err
+	}
+	if len(groups) > 0 {
+		return fmt.Errorf("cannot migrate queue with groups")
+	}
+
+	lists := [][2]string{
+		{legacy.keys.queueInputKey(name), clustered.keys.queueInputKey(name)},
+		{legacy.keys.queueFailedKey(name), clustered.keys.queueFailedKey(name)},
+	}
+	for _, consumer := range consumers {
+		lists = append(lists, [2]string{
+			legacy.keys.consumerWorkingQueueKey(name, consumer),
+			clustered.keys.consumerWorkingQueueKey(name, consumer),
+		})
+	}
+	partitions := legacy.GetPartitions()
+	if partitions > 0 {
+		current, err := loadPartitions(legacy.backend, clustered.keys, name)
+		if err != nil {
+			return err
+		}
+		if current != 0 && current != partitions {
+			return fmt.Errorf("queue %s has %d partitions in the cluster layout", name, current)
+		}
+	}
+	for partition := int64(0); partition < partitions; partition++ {
+		lists = append(lists, [2]string{
+			legacy.keys.queuePartitionKey(name, partition),
+			clustered.keys.queuePartitionKey(name, partition),
+		})
+	}
+	if legacy.streams {
+		// the stream is moved first, nothing else is touched if it can't be
+		result, err := client.Eval(
+			migrateStreamScript,
+			[]string{legacy.keys.queueStreamKey(name), clustered.keys.queueStreamKey(name)},
+			nil,
+		).Result()
+		if err != nil {
+			return err
+		}
+		if result != int64(1) {
+			return fmt.Errorf("stream of queue %s already exists in the cluster layout", name)
+		}
+	}
+	for _, list := range lists {
+		err = migrateList(client, list[0], list[1])
+		if err != nil {
+			return err
+		}
+	}
+
+	if partitions > 0 {
+		err = client.Set(clustered.keys.queuePartitionsKey(name), strconv.FormatInt(partitions, 10), 0).Err()
+		if err != nil {
+			return err
+		}
+	}
+
+	if len(consumers) > 0 {
+		err = client.SAdd(clustered.keys.queueWorkersKey(name), consumers...).Err()
+		if err != nil {
+			return err
+		}
+	}
+
+	paused, err := legacy.IsPaused()
+	if err != nil {
+		return err
+	}
+	if paused {
+		err = clustered.Pause()
+		if err != nil {
+			return err
+		}
+	}
+
+	dropped, err := client.Get(legacy.keys.queueDroppedKey(name)).Int64()
+	if err != nil && err != redis.Nil {
+		return err
+	}
+	if dropped > 0 {
+		err = client.IncrBy(clustered.keys.queueDroppedKey(name), dropped).Err()
+		if err != nil {
+			return err
+		}
+	}
+
+	// the limits are kept, the tokens of the rate limit start with a full burst
+	for _, key := range [][2]string{
+		{legacy.keys.queueRateLimitKey(name), clustered.keys.queueRateLimitKey(name)},
+		{legacy.keys.queueInFlightLimitKey(name), clustered.keys.queueInFlightLimitKey(name)},
+		{legacy.keys.queueMaxLengthKey(name), clustered.keys.queueMaxLengthKey(name)},
+	} {
+		value, err := client.Get(key[0]).Result()
+		if err == redis.Nil {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		err = client.Set(key[1], value, 0).Err()
+		if err != nil {
+			return err
+		}
+	}
+	// unacked packages in the migrated working queues keep their in-flight slots
+	inFlight, err := client.Get(legacy.keys.queueInFlightKey(name)).Int64()
+	if err != nil && err != redis.Nil {
+		return err
+	}
+	if inFlight > 0 {
+		err = client.IncrBy(clustered.keys.queueInFlightKey(name), inFlight).Err()
+		if err != nil {
+			return err
+		}
+	}
+	holders, err := client.SMembers(legacy.keys.queueInFlightPackagesKey(name)).Result()
+	if err != nil {
+		return err
+	}
+	if len(holders) > 0 {
+		err = client.SAdd(clustered.keys.queueInFlightPackagesKey(name), holders...).Err()
+		if err != nil {
+			return err
+		}
+	}
+
+	legacyKeys := []string{
+		legacy.keys.queueWorkersKey(name),
+		legacy.keys.queuePausedKey(name),
+		legacy.keys.queueDroppedKey(name),
+		legacy.keys.queuePartitionsKey(name),
+		legacy.keys.queueRateLimitKey(name),
+		legacy.keys.queueTokensKey(name),
+		legacy.keys.queueInFlightLimitKey(name),
+		legacy.keys.queueInFlightKey(name),
+		legacy.keys.queueInFlightPackagesKey(name),
+		legacy.keys.queueMaxLengthKey(name),
+	}
+	for partition := int64(0); partition < partitions; partition++ {
+		// the leases of inactive consumers are dropped, partitions are acquired again in the cluster layout
+		legacyKeys = append(legacyKeys, legacy.keys.queuePartitionOwnerKey(name, partition))
+	}
+	return client.Del(legacyKeys...).Err()
+}
+
+// migrateList moves all packages from source to destination in batches
+func migrateList(client RedisClient, source, destination string) error {
+	for {
+		result, err := client.Eval(
+			migrateListScript,
+			[]string{source, destination},
+			[]string{fmt.Sprintf("%d", exportBatch)},
+		).Result()
+		if err != nil {
+			return err
+		}
+		moved, ok := result.(int64)
+		if !ok {
+			return fmt.Errorf("unexpected migrate result %v", result)
+		}
+		if moved < exportBatch {
+			return nil
+		}
+	}
+}
@@ -0,0 +1,107 @@
+package redismq
+
+import (
+	"fmt"
+
+	. "github.com/matttproud/gocheck"
+)
+
+func (suite *UnitSuite) TestClusterKeys(c *C) {
+	keys := keyScheme{cluster: true}
+	c.Check(keys.queueInputKey("clicks"), Equals, "redismq::{clicks}")
+	c.Check(keys.queueWorkersKey("clicks"), Equals, "redismq::{clicks}::workers")
+	c.Check(keys.consumerHeartbeatKey("clicks", "worker"), Equals, "redismq::{clicks}::working::worker::heartbeat")
+	c.Check(keyScheme{}.queueWorkersKey("clicks"), Equals, "redismq::clicks::workers")
+	c.Check(keyScheme{}.queueFailedKey("clicks"), Equals, "redismq::clicks::failed")
+}
+
+// consumers registered without prefix by older versions should be moved to the prefixed key
+func (suite *UnitSuite) TestMigrateLegacyWorkers(c *C) {
+	backend := NewMemoryBackend()
+	_, err := backend.SAdd(legacyWorkersKey("legacy"), "old")
+	c.Assert(err, IsNil)
+	queue := CreateQueueWithBackend(backend, "legacy")
+	consumers, err := queue.getConsumers()
+	c.Assert(err, IsNil)
+	c.Check(consumers, DeepEquals, []string{"old"})
+	legacy, err := backend.SMembers(legacyWorkersKey("legacy"))
+	c.Assert(err, IsNil)
+	c.Check(legacy, HasLen, 0)
+}
+
+// queues using the cluster layout should work the same with tagged keys
+func (suite *TestSuite) TestClusterLayout(c *C) {
+	client := UseClusterLayout(suite.redisClient)
+	queue := CreateQueueWithClient(client, "testcluster")
+	consumer, err := queue.AddConsumer("clusterconsumer")
+	c.Assert(err, IsNil)
+	for i := 0; i < 3; i++ {
+		c.Check(queue.Put(fmt.Sprintf("%d", i)), IsNil)
+	}
+	c.Check(suite.redisClient.LLen("redismq::{testcluster}").Val(), Equals, int64(3))
+	c.Check(suite.redisClient.Exists("redismq::testcluster").Val(), Equals, false)
+
+	packages, err := consumer.MultiGet(5)
+	c.Assert(err, IsNil)
+	c.Assert(packages, HasLen, 3)
+	c.Check(packages[0].Payload, Equals, "0")
+	c.Check(packages[2].Payload, Equals, "2")
+	c.Check(packages[2].MultiAck(), IsNil)
+	c.Check(consumer.HasUnacked(), Equals, false)
+
+	c.Check(queue.Put("failing"), IsNil)
+	p, err := consumer.Get()
+	c.Assert(err, IsNil)
+	c.Check(p.Fail(), IsNil)
+	c.Check(queue.GetFailedLength(), Equals, int64(1))
+
+	observer := NewObserverWithClient(client)
+	c.Check(observer.UpdateQueueStats("testcluster"), IsNil)
+	c.Check(observer.Snapshot().Stats["testcluster"].FailedLength, Equals, int64(1))
+
+	consumer.Quit()
+	c.Check(queue.Delete(), IsNil)
+}
+
+// migrated queues should keep packages, order and consumers
+func (suite *TestSuite) TestMigrateToClusterLayout(c *C) {
+	for i := 0; i < 3; i++ {
+		c.Check(suite.queue.Put(fmt.Sprintf("%d", i)), IsNil)
+	}
+	p, err := suite.consumer.Get()
+	c.Assert(err, IsNil)
+	c.Check(p.Payload, Equals, "0")
+	c.Check(suite.queue.Pause(), IsNil)
+	c.Check(suite.queue.SetRateLimit(100, 10), IsNil)
+	c.Check(suite.queue.SetMaxInFlight(10), IsNil)
+
+	c.Check(MigrateToClusterLayout(suite.redisClient, "teststuff"), Not(IsNil))
+	suite.consumer.Quit()
+
+	clustered := CreateQueueWithClient(UseClusterLayout(suite.redisClient), "teststuff")
+	c.Check(clustered.Put("3"), IsNil)
+	c.Check(MigrateToClusterLayout(suite.redisClient, "teststuff"), IsNil)
+	c.Check(suite.queue.GetInputLength(), Equals, int64(0))
+
+	c.Check(clustered.loadLimits(), IsNil)
+	rate, burst, maxInFlight := clustered.currentLimits()
+	c.Check(rate, Equals, 100.0)
+	c.Check(burst, Equals, int64(10))
+	c.Check(maxInFlight, Equals, int64(10))
+
+	paused, err := clustered.IsPaused()
+	c.Assert(err, IsNil)
+	c.Check(paused, Equals, true)
+	c.Check(clustered.Resume(), IsNil)
+
+	consumer, err := clustered.AddConsumer("testconsumer")
+	c.Assert(err, IsNil)
+	c.Check(consumer.GetUnackedLength(), Equals, int64(1))
+	packages, err := consumer.MultiGet(3)
+	c.Assert(err, IsNil)
+	c.Assert(packages, HasLen, 3)
+	c.Check(packages[0].Payload, Equals, "1")
+	c.Check(packages[1].Payload, Equals, "2")
+	c.Check(packages[2].Payload, Equals, "3")
+	consumer.Quit()
+}
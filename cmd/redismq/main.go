@@ -0,0 +1,596 @@
+// Command redismq lets operators inspect and manage queues from a shell.
+//
+//	redismq [-host localhost] [-port 6379] [-password ""] [-db 0] [-json] <command> [arguments]
+//	redismq -sentinel-master mymaster [-sentinels localhost:26379,...] [-password ""] [-db 0] [-json] <command> [arguments]
+//
+// Run redismq without arguments to list all commands.
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"regexp"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/adjust/redismq"
+	"gopkg.in/redis.v3"
+)
+
+type connection struct {
+	host     string
+	port     string
+	password string
+	db       int64
+	// sentinelMaster and sentinels locate the master instead of host and port
+	sentinelMaster string
+	sentinels      string
+	// cluster lists seed nodes of a redis cluster instead of host and port
+	cluster       string
+	clusterLayout bool
+	namespace     string
+	json          bool
+	out           io.Writer
+	client        redismq.RedisClient
+}
+
+type command struct {
+	name  string
+	usage string
+	run   func(conn *connection, args []string) error
+}
+
+var commands = []*command{
+	{"queues", "list all queues with their lengths", runQueues},
+	{"stats", "[queue] show rates and lengths of all or one queue", runStats},
+	{"consumers", "<queue> list the consumers of a queue", runConsumers},
+	{"put", "<queue> [payload...] put payloads or lines from stdin into a queue", runPut},
+	{"peek", "[-failed] [-offset n] [-limit n] <queue> show packages without removing them", runPeek},
+	{"requeue-failed", "[filter flags] <queue> move all or matching failed packages back to input", runRequeueFailed},
+	{"reset-failed", "[filter flags] <queue> delete all or matching failed packages, refused while consumers are active", runResetFailed},
+	{"reset-input", "<queue> delete all input packages, refused while consumers are active", runResetInput},
+	{"pause", "<queue> stop consumers from getting packages, put still works", runPause},
+	{"resume", "<queue> let consumers get packages again", runResume},
+	{"delete", "<queue> delete a queue, refused while consumers are active", runDelete},
+	{"reclaim", "<queue> <consumer> move the unacked packages of a dead consumer back to input", runReclaim},
+	{"tail", "[-interval 1s] <queue> print packages as they are put into a queue", runTail},
+	{"export", "[-move] [-o file] <queue> write input, failed and working packages as JSON Lines", runExport},
+	{"import", "[-requeue-working] [-i file] <queue> put the packages of an export into a queue", runImport},
+	{"migrate-layout", "<queue> move a queue to the cluster layout on a standalone redis, refused while consumers are active", runMigrateLayout},
+}
+
+func main() {
+	conn := &connection{out: os.Stdout}
+	flags := flag.NewFlagSet("redismq", flag.ExitOnError)
+	flags.StringVar(&conn.host, "host", "localhost", "redis host")
+	flags.StringVar(&conn.port, "port", "6379", "redis port")
+	flags.StringVar(&conn.password, "password", "", "redis password")
+	flags.Int64Var(&conn.db, "db", 0, "redis database")
+	flags.StringVar(&conn.sentinelMaster, "sentinel-master", "", "name of the master to ask the sentinels for instead of using host and port")
+	flags.StringVar(&conn.sentinels, "sentinels", "localhost:26379", "comma separated sentinel addresses")
+	flags.StringVar(&conn.cluster, "cluster", "", "comma separated seed nodes of a redis cluster to use instead of host and port")
+	flags.BoolVar(&conn.clusterLayout, "cluster-layout", false, "use the cluster key layout on a standalone redis")
+	flags.StringVar(&conn.namespace, "namespace", "", "prefix of all keys, defaults to redismq")
+	flags.BoolVar(&conn.json, "json", false, "print JSON instead of tables")
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: redismq [flags] <command> [arguments]\n\nflags:\n")
+		flags.PrintDefaults()
+		fmt.Fprintf(os.Stderr, "\ncommands:\n")
+		for _, c := range commands {
+			fmt.Fprintf(os.Stderr, "  %-15s %s\n", c.name, c.usage)
+		}
+	}
+	flags.Parse(os.Args[1:])
+
+	if flags.NArg() == 0 {
+		flags.Usage()
+		os.Exit(2)
+	}
+	for _, c := range commands {
+		if c.name != flags.Arg(0) {
+			continue
+		}
+		conn.connect()
+		err := c.run(conn, flags.Args()[1:])
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "redismq %s: %s\n", c.name, err)
+			os.Exit(1)
+		}
+		return
+	}
+	fmt.Fprintf(os.Stderr, "redismq: unknown command %q\n", flags.Arg(0))
+	flags.Usage()
+	os.Exit(2)
+}
+
+func (conn *connection) connect() {
+	var standalone *redis.Client
+	switch {
+	case conn.cluster != "":
+		conn.client = redismq.NewClusterClient(strings.Split(conn.cluster, ","), conn.password)
+	case conn.sentinelMaster != "":
+		standalone = redismq.NewSentinelClient(conn.sentinelMaster, strings.Split(conn.sentinels, ","), conn.password, conn.db)
+	default:
+		standalone = redis.NewClient(&redis.Options{
+			Addr:     conn.host + ":" + conn.port,
+			Password: conn.password,
+			DB:       conn.db,
+		})
+	}
+	if standalone != nil {
+		conn.client = standalone
+		if conn.clusterLayout {
+			conn.client = redismq.UseClusterLayout(standalone)
+		}
+	}
+	if conn.namespace != "" {
+		conn.client = redismq.UseNamespace(conn.client, conn.namespace)
+	}
+}
+
+func (conn *connection) selectQueue(name string) (*redismq.Queue, error) {
+	return redismq.SelectQueueWithClient(conn.client, name)
+}
+
+func (conn *connection) createQueue(name string) *redismq.Queue {
+	return redismq.CreateQueueWithClient(conn.client, name)
+}
+
+func (conn *connection) observer() *redismq.Observer {
+	return redismq.NewObserverWithClient(conn.client)
+}
+
+// print writes value as JSON or lets table write rows into a tab aligned table
+func (conn *connection) print(value interface{}, header string, table func(out io.Writer)) error {
+	if conn.json {
+		encoder := json.NewEncoder(conn.out)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(value)
+	}
+	out := tabwriter.NewWriter(conn.out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(out, header)
+	table(out)
+	return out.Flush()
+}
+
+// parseArgs parses the flags of a command and checks the number of remaining arguments
+func parseArgs(flags *flag.FlagSet, args []string, min, max int) ([]string, error) {
+	err := flags.Parse(args)
+	if err != nil {
+		return nil, err
+	}
+	if flags.NArg() < min || (max >= 0 && flags.NArg() > max) {
+		return nil, fmt.Errorf("wrong number of arguments, see redismq -help")
+	}
+	return flags.Args(), nil
+}
+
+func runQueues(conn *connection, args []string) error {
+	if _, err := parseArgs(flag.NewFlagSet("queues", flag.ExitOnError), args, 0, 0); err != nil {
+		return err
+	}
+	names, err := conn.observer().GetAllQueues()
+	if err != nil {
+		return err
+	}
+	sort.Strings(names)
+
+	infos := make([]*redismq.QueueInfo, 0, len(names))
+	for _, name := range names {
+		queue, err := conn.selectQueue(name)
+		if err != nil {
+			// deleted in the meantime
+			continue
+		}
+		info, err := queue.Info()
+		if err != nil {
+			return err
+		}
+		infos = append(infos, info)
+	}
+
+	return conn.print(infos, "QUEUE\tINPUT\tFAILED\tCONSUMERS\tACTIVE\tPAUSED", func(out io.Writer) {
+		for _, info := range infos {
+			active := 0
+			for _, consumer := range info.Consumers {
+				if consumer.Active {
+					active++
+				}
+			}
+			fmt.Fprintf(out, "%s\t%d\t%d\t%d\t%d\t%t\n", info.Name, info.InputLength, info.FailedLength, len(info.Consumers), active, info.Paused)
+		}
+	})
+}
+
+func runStats(conn *connection, args []string) error {
+	args, err := parseArgs(flag.NewFlagSet("stats", flag.ExitOnError), args, 0, 1)
+	if err != nil {
+		return err
+	}
+	observer := conn.observer()
+	if len(args) == 1 {
+		err = observer.UpdateQueueStats(args[0])
+	} else {
+		err = observer.UpdateAllStats()
+	}
+	if err != nil {
+		return err
+	}
+
+	stats := observer.Snapshot().Stats
+	names := make([]string, 0, len(stats))
+	for name := range stats {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return conn.print(stats, "QUEUE\tINPUT\tFAILED\tDROPPED\tIN/S\tIN/M\tIN/H\tWORK/S\tWORK/M\tWORK/H", func(out io.Writer) {
+		for _, name := range names {
+			stat := stats[name]
+			fmt.Fprintf(out, "%s\t%d\t%d\t%d\t%d\t%d\t%d\t%d\t%d\t%d\n", name, stat.InputLength, stat.FailedLength, stat.Dropped,
+				stat.InputRateSecond, stat.InputRateMinute, stat.InputRateHour,
+				stat.WorkRateSecond, stat.WorkRateMinute, stat.WorkRateHour)
+		}
+	})
+}
+
+func runConsumers(conn *connection, args []string) error {
+	args, err := parseArgs(flag.NewFlagSet("consumers", flag.ExitOnError), args, 1, 1)
+	if err != nil {
+		return err
+	}
+	queue, err := conn.selectQueue(args[0])
+	if err != nil {
+		return err
+	}
+	info, err := queue.Info()
+	if err != nil {
+		return err
+	}
+	sort.Slice(info.Consumers, func(i, j int) bool { return info.Consumers[i].Name < info.Consumers[j].Name })
+
+	return conn.print(info.Consumers, "CONSUMER\tACTIVE\tUNACKED", func(out io.Writer) {
+		for _, consumer := range info.Consumers {
+			fmt.Fprintf(out, "%s\t%t\t%d\n", consumer.Name, consumer.Active, consumer.WorkingLength)
+		}
+	})
+}
+
+func runPut(conn *connection, args []string) error {
+	args, err := parseArgs(flag.NewFlagSet("put", flag.ExitOnError), args, 1, -1)
+	if err != nil {
+		return err
+	}
+	queue := conn.createQueue(args[0])
+	payloads := args[1:]
+	if len(payloads) == 0 {
+		payloads, err = readLines(os.Stdin)
+		if err != nil {
+			return err
+		}
+	}
+	err = queue.MultiPut(payloads...)
+	if err != nil {
+		return err
+	}
+	return conn.print(map[string]int{"Put": len(payloads)}, "PUT", func(out io.Writer) {
+		fmt.Fprintf(out, "%d\n", len(payloads))
+	})
+}
+
+func runPeek(conn *connection, args []string) error {
+	flags := flag.NewFlagSet("peek", flag.ExitOnError)
+	failed := flags.Bool("failed", false, "peek into the failed queue instead of input")
+	offset := flags.Int64("offset", 0, "number of packages to skip")
+	limit := flags.Int64("limit", 10, "maximum number of packages")
+	args, err := parseArgs(flags, args, 1, 1)
+	if err != nil {
+		return err
+	}
+	queue, err := conn.selectQueue(args[0])
+	if err != nil {
+		return err
+	}
+
+	var packages []*redismq.Package
+	if *failed {
+		packages, err = queue.PeekFailed(*offset, *limit)
+	} else {
+		packages, err = queue.PeekInput(*offset, *limit)
+	}
+	if err != nil {
+		return err
+	}
+	return conn.print(packages, "ID\tCREATED\tPAYLOAD", func(out io.Writer) {
+		for _, p := range packages {
+			printPackage(out, p)
+		}
+	})
+}
+
+func runRequeueFailed(conn *connection, args []string) error {
+	flags := flag.NewFlagSet("requeue-failed", flag.ExitOnError)
+	filter := filterFlags(flags)
+	return queueCommand(conn, flags, args, false, func(queue *redismq.Queue) error {
+		if filter.empty() {
+			return queue.RequeueFailed()
+		}
+		_, err := queue.RequeueFailedMatching(filter.build())
+		return err
+	})
+}
+
+func runResetFailed(conn *connection, args []string) error {
+	flags := flag.NewFlagSet("reset-failed", flag.ExitOnError)
+	filter := filterFlags(flags)
+	return queueCommand(conn, flags, args, true, func(queue *redismq.Queue) error {
+		if filter.empty() {
+			return queue.ResetFailed()
+		}
+		_, err := queue.ResetFailedMatching(filter.build())
+		return err
+	})
+}
+
+func runResetInput(conn *connection, args []string) error {
+	return queueCommand(conn, flag.NewFlagSet("reset-input", flag.ExitOnError), args, true, (*redismq.Queue).ResetInput)
+}
+
+func runPause(conn *connection, args []string) error {
+	return queueCommand(conn, flag.NewFlagSet("pause", flag.ExitOnError), args, false, (*redismq.Queue).Pause)
+}
+
+func runResume(conn *connection, args []string) error {
+	return queueCommand(conn, flag.NewFlagSet("resume", flag.ExitOnError), args, false, (*redismq.Queue).Resume)
+}
+
+func runDelete(conn *connection, args []string) error {
+	return queueCommand(conn, flag.NewFlagSet("delete", flag.ExitOnError), args, true, (*redismq.Queue).Delete)
+}
+
+// filter collects the flags of commands that select failed packages
+type filter struct {
+	headers       headerFlags
+	errorContains string
+	olderThan     time.Duration
+	newerThan     time.Duration
+	payload       regexpFlag
+}
+
+func filterFlags(flags *flag.FlagSet) *filter {
+	f := &filter{headers: headerFlags{}}
+	flags.Var(f.headers, "header", "only packages with this header as name=value, can be repeated")
+	flags.StringVar(&f.errorContains, "error", "", "only packages whose error contains this text")
+	flags.DurationVar(&f.olderThan, "older-than", 0, "only packages put longer ago than this")
+	flags.DurationVar(&f.newerThan, "newer-than", 0, "only packages put more recently than this")
+	flags.Var(&f.payload, "payload", "only packages whose payload matches this regular expression")
+	return f
+}
+
+func (f *filter) empty() bool {
+	return len(f.headers) == 0 && f.errorContains == "" && f.olderThan == 0 && f.newerThan == 0 && f.payload.Regexp == nil
+}
+
+func (f *filter) build() *redismq.Filter {
+	filter := &redismq.Filter{
+		Headers:       f.headers,
+		ErrorContains: f.errorContains,
+		Payload:       f.payload.Regexp,
+	}
+	if f.olderThan > 0 {
+		filter.CreatedBefore = time.Now().Add(-f.olderThan)
+	}
+	if f.newerThan > 0 {
+		filter.CreatedAfter = time.Now().Add(-f.newerThan)
+	}
+	return filter
+}
+
+type headerFlags map[string]string
+
+func (headers headerFlags) String() string {
+	return fmt.Sprint(map[string]string(headers))
+}
+
+func (headers headerFlags) Set(value string) error {
+	parts := strings.SplitN(value, "=", 2)
+	if len(parts) != 2 {
+		return fmt.Errorf("header has to be name=value")
+	}
+	headers[parts[0]] = parts[1]
+	return nil
+}
+
+type regexpFlag struct {
+	*regexp.Regexp
+}
+
+func (pattern *regexpFlag) String() string {
+	if pattern.Regexp == nil {
+		return ""
+	}
+	return pattern.Regexp.String()
+}
+
+func (pattern *regexpFlag) Set(value string) error {
+	var err error
+	pattern.Regexp, err = regexp.Compile(value)
+	return err
+}
+
+// queueCommand runs an action on a queue and prints its lengths afterwards
+func queueCommand(conn *connection, flags *flag.FlagSet, args []string, destructive bool, action func(*redismq.Queue) error) error {
+	name := flags.Name()
+	args, err := parseArgs(flags, args, 1, 1)
+	if err != nil {
+		return err
+	}
+	queue, err := conn.selectQueue(args[0])
+	if err != nil {
+		return err
+	}
+	if destructive {
+		active, err := queue.HasActiveConsumers()
+		if err != nil {
+			return err
+		}
+		if active {
+			return fmt.Errorf("queue %s has active consumers", queue.Name)
+		}
+	}
+
+	inputBefore, failedBefore := queue.GetInputLength(), queue.GetFailedLength()
+	err = action(queue)
+	if err != nil {
+		return err
+	}
+	result := map[string]int64{
+		"InputBefore":  inputBefore,
+		"FailedBefore": failedBefore,
+	}
+	if name != "delete" {
+		result["Input"] = queue.GetInputLength()
+		result["Failed"] = queue.GetFailedLength()
+	}
+	return conn.print(result, "QUEUE\tINPUT\tFAILED", func(out io.Writer) {
+		fmt.Fprintf(out, "%s\t%d -> %d\t%d -> %d\n", queue.Name, inputBefore, result["Input"], failedBefore, result["Failed"])
+	})
+}
+
+func runReclaim(conn *connection, args []string) error {
+	args, err := parseArgs(flag.NewFlagSet("reclaim", flag.ExitOnError), args, 2, 2)
+	if err != nil {
+		return err
+	}
+	queue, err := conn.selectQueue(args[0])
+	if err != nil {
+		return err
+	}
+	reclaimed, err := queue.ReclaimConsumer(args[1])
+	if err != nil {
+		return err
+	}
+	return conn.print(map[string]int64{"Reclaimed": reclaimed}, "RECLAIMED", func(out io.Writer) {
+		fmt.Fprintf(out, "%d\n", reclaimed)
+	})
+}
+
+func runMigrateLayout(conn *connection, args []string) error {
+	args, err := parseArgs(flag.NewFlagSet("migrate-layout", flag.ExitOnError), args, 1, 1)
+	if err != nil {
+		return err
+	}
+	err = redismq.MigrateToClusterLayout(conn.client, args[0])
+	if err != nil {
+		return err
+	}
+	return conn.print(map[string]string{"Migrated": args[0]}, "MIGRATED", func(out io.Writer) {
+		fmt.Fprintf(out, "%s\n", args[0])
+	})
+}
+
+func runTail(conn *connection, args []string) error {
+	flags := flag.NewFlagSet("tail", flag.ExitOnError)
+	interval := flags.Duration("interval", time.Second, "poll interval")
+	args, err := parseArgs(flags, args, 1, 1)
+	if err != nil {
+		return err
+	}
+	queue, err := conn.selectQueue(args[0])
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer cancel()
+	encoder := json.NewEncoder(conn.out)
+	return queue.Tail(ctx, *interval, func(p *redismq.Package) {
+		if conn.json {
+			encoder.Encode(p)
+			return
+		}
+		printPackage(conn.out, p)
+	})
+}
+
+func runExport(conn *connection, args []string) error {
+	flags := flag.NewFlagSet("export", flag.ExitOnError)
+	move := flags.Bool("move", false, "remove exported packages, refused while consumers are active")
+	output := flags.String("o", "-", "file to write to, - for stdout")
+	args, err := parseArgs(flags, args, 1, 1)
+	if err != nil {
+		return err
+	}
+	queue, err := conn.selectQueue(args[0])
+	if err != nil {
+		return err
+	}
+
+	if *output == "-" {
+		_, err = queue.Export(conn.out, *move)
+		return err
+	}
+	file, err := os.Create(*output)
+	if err != nil {
+		return err
+	}
+	exported, err := queue.Export(file, *move)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("exported %d packages before failing: %s", exported, err)
+	}
+	return conn.print(map[string]int64{"Exported": exported}, "EXPORTED", func(out io.Writer) {
+		fmt.Fprintf(out, "%d\n", exported)
+	})
+}
+
+func runImport(conn *connection, args []string) error {
+	flags := flag.NewFlagSet("import", flag.ExitOnError)
+	requeueWorking := flags.Bool("requeue-working", false, "put working packages into input instead of restoring them as unacked")
+	input := flags.String("i", "-", "file to read from, - for stdin")
+	args, err := parseArgs(flags, args, 1, 1)
+	if err != nil {
+		return err
+	}
+
+	var reader io.Reader = os.Stdin
+	if *input != "-" {
+		file, err := os.Open(*input)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		reader = file
+	}
+	imported, err := conn.createQueue(args[0]).Import(reader, *requeueWorking)
+	if err != nil {
+		return fmt.Errorf("imported %d packages before failing: %s", imported, err)
+	}
+	return conn.print(map[string]int64{"Imported": imported}, "IMPORTED", func(out io.Writer) {
+		fmt.Fprintf(out, "%d\n", imported)
+	})
+}
+
+func printPackage(out io.Writer, p *redismq.Package) {
+	fmt.Fprintf(out, "%s\t%s\t%s\n", p.ID, p.CreatedAt.Format(time.RFC3339), p.Payload)
+}
+
+func readLines(in io.Reader) ([]string, error) {
+	var lines []string
+	scanner := bufio.NewScanner(in)
+	scanner.Buffer(make([]byte, 64*1024), 64<<20)
+	for scanner.Scan() {
+		lines = append(lines, scanner.Text())
+	}
+	return lines, scanner.Err()
+}
@@ -3,9 +3,9 @@ package redismq
 import (
 	"context"
 	"fmt"
+	"log"
+	"sync"
 	"time"
-
-	"gopkg.in/redis.v3"
 )
 
 // Consumer are used for reading from queues
@@ -15,80 +15,140 @@ type Consumer struct {
 
 	cancel         context.CancelFunc
 	contextCleared <-chan struct{}
+
+	// the partitions of partitioned queues owned by the consumer, see SetPartitions
+	partitionsMutex sync.Mutex
+	ownedPartitions []int64
+	nextPartition   int
+	rebalancedAt    time.Time
 }
 
 // Get returns a single package from the queue (blocking)
 func (consumer *Consumer) Get() (*Package, error) {
-	if consumer.HasUnacked() {
+	if !consumer.Queue.streams && consumer.HasUnacked() {
 		return nil, fmt.Errorf("unacked Packages found")
 	}
 	return consumer.unsafeGet()
 }
 
+// GetTimeout returns a single package from the queue waiting at most timeout
+// (returns nil, nil if no package arrived). Redis only supports whole seconds, shorter timeouts wait one second.
+func (consumer *Consumer) GetTimeout(timeout time.Duration) (*Package, error) {
+	if !consumer.Queue.streams && consumer.HasUnacked() {
+		return nil, fmt.Errorf("unacked Packages found")
+	}
+	if timeout < time.Second {
+		// a timeout of 0 would block forever
+		timeout = time.Second
+	}
+	return consumer.blockingGet(timeout)
+}
+
 // NoWaitGet returns a single package from the queue (returns nil, nil if no package in queue)
 func (consumer *Consumer) NoWaitGet() (*Package, error) {
-	if consumer.HasUnacked() {
+	if !consumer.Queue.streams && consumer.HasUnacked() {
 		return nil, fmt.Errorf("unacked Packages found")
 	}
-	answer := consumer.Queue.redisClient.RPopLPush(
-		queueInputKey(consumer.Queue.Name),
-		consumerWorkingQueueKey(consumer.Queue.Name, consumer.Name),
-	)
-	if answer.Val() == "" {
+	paused, err := consumer.Queue.IsPaused()
+	if err != nil || paused {
+		return nil, err
+	}
+	p, err := consumer.fetchOne(0)
+	if err == ErrNoValue {
 		return nil, nil
 	}
-	consumer.Queue.incrRate(
-		consumerWorkingRateKey(consumer.Queue.Name, consumer.Name),
-		1,
-	)
-	return consumer.parseRedisAnswer(answer)
+	return p, err
 }
 
-// MultiGet returns an array of packages from the queue
+// MultiGet returns an array of packages from the queue.
+// Consumers of partitioned queues get one package at a time to keep the order of their partitions.
 func (consumer *Consumer) MultiGet(length int) ([]*Package, error) {
-	var collection []*Package
-	if consumer.HasUnacked() {
+	if consumer.Queue.GetPartitions() > 0 {
+		return nil, errPartitionsUnsupported
+	}
+	if !consumer.Queue.streams && consumer.HasUnacked() {
 		return nil, fmt.Errorf("unacked Packages found")
 	}
-
-	// TODO maybe use transactions for rollback in case of errors?
-	reqs, err := consumer.Queue.redisClient.Pipelined(func(c *redis.Pipeline) error {
-		c.BRPopLPush(
-			queueInputKey(consumer.Queue.Name),
-			consumerWorkingQueueKey(consumer.Queue.Name, consumer.Name),
-			0,
-		)
-		for i := 1; i < length; i++ {
-			c.RPopLPush(
-				queueInputKey(consumer.Queue.Name),
-				consumerWorkingQueueKey(consumer.Queue.Name, consumer.Name),
-			)
+	var failingSince time.Time
+	for {
+		err := consumer.waitWhilePaused()
+		if consumer.retryAfter(err, &failingSince) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		collection, err := consumer.multiGet(length)
+		if consumer.retryAfter(err, &failingSince) {
+			continue
 		}
-		return nil
-	})
-	if err != nil && err != redis.Nil {
+		if err != nil || len(collection) > 0 {
+			return collection, err
+		}
+	}
+}
+
+// multiGet gets up to length packages within the limits of the queue
+func (consumer *Consumer) multiGet(length int) ([]*Package, error) {
+	slots, reserved, err := consumer.Queue.acquireSlots(int64(length))
+	if err != nil {
+		return nil, err
+	}
+	if slots == 0 {
+		// wait for other consumers to finish packages
+		time.Sleep(limitPollInterval)
+		return nil, nil
+	}
+	collection, err := consumer.multiFetch(int(slots))
+	if reserved {
+		consumer.Queue.holdSlots(slots, collection)
+	}
+	if err != nil {
 		return nil, err
 	}
+	consumer.Queue.waitForTokens(int64(len(collection)))
+	return collection, nil
+}
 
-	for _, answer := range reqs {
-		switch answer := answer.(type) {
-		case *redis.StringCmd:
-			if answer.Val() == "" {
-				continue
-			}
-			p, err := consumer.parseRedisAnswer(answer)
-			if err != nil {
-				return nil, err
-			}
+// multiFetch waits up to pausePollInterval for the first package, the others are moved at once
+func (consumer *Consumer) multiFetch(length int) ([]*Package, error) {
+	if consumer.Queue.streams {
+		collection, err := consumer.streamRead(int64(length), pausePollInterval, ">")
+		for _, p := range collection {
 			p.Collection = &collection
-			collection = append(collection, p)
-		default:
+		}
+		return collection, err
+	}
+	inputKey := consumer.Queue.keys.queueInputKey(consumer.Queue.Name)
+	workingKey := consumer.Queue.keys.consumerWorkingQueueKey(consumer.Queue.Name, consumer.Name)
+	first, err := consumer.Queue.backend.BRPopLPush(inputKey, workingKey, pausePollInterval)
+	if err == ErrNoValue {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	answers := []string{first}
+	if length > 1 {
+		rest, err := consumer.Queue.backend.MultiRPopLPush(inputKey, workingKey, int64(length-1))
+		if err != nil {
+			return nil, err
+		}
+		answers = append(answers, rest...)
+	}
+
+	var collection []*Package
+	for _, answer := range answers {
+		p, err := unmarshalPackage(answer, consumer.Queue, consumer)
+		if err != nil {
 			return nil, err
 		}
+		p.Collection = &collection
+		collection = append(collection, p)
 	}
 	consumer.Queue.incrRate(
-		consumerWorkingRateKey(consumer.Queue.Name, consumer.Name),
-		int64(length),
+		consumer.Queue.keys.consumerWorkingRateKey(consumer.Queue.Name, consumer.Name),
+		int64(len(collection)),
 	)
 
 	return collection, nil
@@ -96,14 +156,17 @@ func (consumer *Consumer) MultiGet(length int) ([]*Package, error) {
 
 // GetUnacked returns a single packages from the working queue of this consumer
 func (consumer *Consumer) GetUnacked() (*Package, error) {
+	if consumer.Queue.streams {
+		return consumer.streamGetUnacked()
+	}
 	if !consumer.HasUnacked() {
 		return nil, fmt.Errorf("no unacked Packages found")
 	}
-	answer := consumer.Queue.redisClient.LIndex(
-		consumerWorkingQueueKey(consumer.Queue.Name, consumer.Name),
+	answer, err := consumer.Queue.backend.LIndex(
+		consumer.Queue.keys.consumerWorkingQueueKey(consumer.Queue.Name, consumer.Name),
 		-1,
 	)
-	return consumer.parseRedisAnswer(answer)
+	return consumer.parseAnswer(answer, err)
 }
 
 // HasUnacked returns true if the consumers has unacked packages
@@ -116,25 +179,61 @@ func (consumer *Consumer) HasUnacked() bool {
 
 // GetUnackedLength returns the number of packages in the unacked queue
 func (consumer *Consumer) GetUnackedLength() int64 {
-	return consumer.Queue.redisClient.LLen(consumerWorkingQueueKey(consumer.Queue.Name, consumer.Name)).Val()
+	if consumer.Queue.streams {
+		return consumer.streamUnackedLength()
+	}
+	length, _ := consumer.Queue.backend.LLen(consumer.Queue.keys.consumerWorkingQueueKey(consumer.Queue.Name, consumer.Name))
+	return length
+}
+
+// PeekWorking returns up to limit unacked packages without removing them,
+// starting at offset with the package returned by GetUnacked. Peeked packages can't be acked.
+func (consumer *Consumer) PeekWorking(offset, limit int64) ([]*Package, error) {
+	if consumer.Queue.streams {
+		return nil, errStreamUnsupported
+	}
+	return consumer.Queue.peekPackages(consumer.Queue.keys.consumerWorkingQueueKey(consumer.Queue.Name, consumer.Name), offset, limit)
 }
 
 // GetFailed returns a single packages from the failed queue of this consumer
 func (consumer *Consumer) GetFailed() (*Package, error) {
-	answer := consumer.Queue.redisClient.RPopLPush(
-		queueFailedKey(consumer.Queue.Name),
-		consumerWorkingQueueKey(consumer.Queue.Name, consumer.Name),
+	if consumer.Queue.streams {
+		return nil, errStreamUnsupported
+	}
+	answer, err := consumer.Queue.backend.RPopLPush(
+		consumer.Queue.keys.queueFailedKey(consumer.Queue.Name),
+		consumer.Queue.keys.consumerWorkingQueueKey(consumer.Queue.Name, consumer.Name),
 	)
 	consumer.Queue.incrRate(
-		consumerWorkingRateKey(consumer.Queue.Name, consumer.Name),
+		consumer.Queue.keys.consumerWorkingRateKey(consumer.Queue.Name, consumer.Name),
 		1,
 	)
-	return consumer.parseRedisAnswer(answer)
+	return consumer.parseAnswer(answer, err)
 }
 
 // ResetWorking deletes! all messages in the working queue of this consumer
 func (consumer *Consumer) ResetWorking() error {
-	return consumer.Queue.redisClient.Del(consumerWorkingQueueKey(consumer.Queue.Name, consumer.Name)).Err()
+	if consumer.Queue.streams {
+		return consumer.streamResetWorking()
+	}
+	workingKey := consumer.Queue.keys.consumerWorkingQueueKey(consumer.Queue.Name, consumer.Name)
+	answers, err := consumer.Queue.backend.LRange(workingKey, 0, -1)
+	if err != nil {
+		return err
+	}
+	err = consumer.Queue.backend.Del(workingKey)
+	if err != nil {
+		return err
+	}
+	packages := make([]*Package, 0, len(answers))
+	for _, answer := range answers {
+		p, err := unmarshalPackage(answer, consumer.Queue, consumer)
+		if err == nil {
+			packages = append(packages, p)
+		}
+	}
+	consumer.Queue.releasePackageSlots(packages...)
+	return nil
 }
 
 // RequeueWorking requeues all packages from working to input
@@ -150,23 +249,55 @@ func (consumer *Consumer) RequeueWorking() error {
 }
 
 func (consumer *Consumer) ackPackage(p *Package) error {
-	return consumer.Queue.redisClient.RPop(consumerWorkingQueueKey(consumer.Queue.Name, consumer.Name)).Err()
+	if consumer.Queue.streams {
+		return consumer.streamAck(p)
+	}
+	_, err := consumer.Queue.backend.RPop(consumer.Queue.keys.consumerWorkingQueueKey(consumer.Queue.Name, consumer.Name))
+	return err
 }
 
 func (consumer *Consumer) requeuePackage(p *Package) error {
-	answer := consumer.Queue.redisClient.RPopLPush(
-		consumerWorkingQueueKey(consumer.Queue.Name, consumer.Name),
-		queueInputKey(consumer.Queue.Name),
+	if consumer.Queue.streams {
+		return consumer.streamReject(p, true)
+	}
+	if partitions := consumer.Queue.GetPartitions(); partitions > 0 {
+		// the package is fetched next to keep the order of its partition
+		err := consumer.Queue.backend.RPopRPush(
+			consumer.Queue.keys.consumerWorkingQueueKey(consumer.Queue.Name, consumer.Name),
+			consumer.Queue.keys.queuePartitionKey(consumer.Queue.Name, partitionOf(p, partitions)),
+		)
+		consumer.Queue.incrRate(consumer.Queue.keys.queueInputRateKey(consumer.Queue.Name), 1)
+		return err
+	}
+	_, err := consumer.Queue.backend.RPopLPush(
+		consumer.Queue.keys.consumerWorkingQueueKey(consumer.Queue.Name, consumer.Name),
+		consumer.Queue.keys.queueInputKey(consumer.Queue.Name),
 	)
-	consumer.Queue.incrRate(queueInputRateKey(consumer.Queue.Name), 1)
-	return answer.Err()
+	consumer.Queue.incrRate(consumer.Queue.keys.queueInputRateKey(consumer.Queue.Name), 1)
+	return err
 }
 
 func (consumer *Consumer) failPackage(p *Package) error {
-	return consumer.Queue.redisClient.RPopLPush(
-		consumerWorkingQueueKey(consumer.Queue.Name, consumer.Name),
-		queueFailedKey(consumer.Queue.Name),
-	).Err()
+	if consumer.Queue.streams {
+		return consumer.streamReject(p, false)
+	}
+	_, err := consumer.Queue.backend.RPopLPush(
+		consumer.Queue.keys.consumerWorkingQueueKey(consumer.Queue.Name, consumer.Name),
+		consumer.Queue.keys.queueFailedKey(consumer.Queue.Name),
+	)
+	return err
+}
+
+func (consumer *Consumer) failPackageWithError(p *Package) error {
+	if consumer.Queue.streams {
+		return consumer.streamReject(p, false)
+	}
+	// the package is replaced with the one carrying the error while moving it
+	return consumer.Queue.backend.RPopLPushValue(
+		consumer.Queue.keys.consumerWorkingQueueKey(consumer.Queue.Name, consumer.Name),
+		consumer.Queue.keys.queueFailedKey(consumer.Queue.Name),
+		p.getString(),
+	)
 }
 
 func (consumer *Consumer) startHeartbeat() {
@@ -181,11 +312,16 @@ func (consumer *Consumer) startHeartbeat() {
 	go func() {
 		firstRun := true
 		for {
-			consumer.Queue.redisClient.Set(
-				consumerHeartbeatKey(consumer.Queue.Name, consumer.Name),
+			consumer.Queue.backend.Set(
+				consumer.Queue.keys.consumerHeartbeatKey(consumer.Queue.Name, consumer.Name),
 				"ping",
 				time.Second,
 			)
+			consumer.Queue.reloadPartitions()
+			if consumer.Queue.GetPartitions() > 0 {
+				consumer.renewLeases()
+			}
+			consumer.Queue.loadLimits()
 			if firstRun {
 				// use close instead
 				close(firstWrite)
@@ -195,7 +331,7 @@ func (consumer *Consumer) startHeartbeat() {
 			case <-time.After(500 * time.Millisecond):
 			case <-ctx.Done():
 				// remove heart beat immediately
-				consumer.Queue.redisClient.Del(consumerHeartbeatKey(consumer.Queue.Name, consumer.Name))
+				consumer.Queue.backend.Del(consumer.Queue.keys.consumerHeartbeatKey(consumer.Queue.Name, consumer.Name))
 				close(waitForClear)
 				return
 			}
@@ -213,15 +349,18 @@ func (consumer *Consumer) Quit() {
 	consumer.cancel()
 	// wait until heart beat mark is removed
 	<-consumer.contextCleared
+	if consumer.Queue.GetPartitions() > 0 {
+		consumer.releaseLeases()
+	}
 
 	consumer.cancel = nil
 }
 
-func (consumer *Consumer) parseRedisAnswer(answer *redis.StringCmd) (*Package, error) {
-	if answer.Err() != nil {
-		return nil, answer.Err()
+func (consumer *Consumer) parseAnswer(answer string, err error) (*Package, error) {
+	if err != nil {
+		return nil, err
 	}
-	p, err := unmarshalPackage(answer.Val(), consumer.Queue, consumer)
+	p, err := unmarshalPackage(answer, consumer.Queue, consumer)
 	if err != nil {
 		return nil, err
 	}
@@ -229,14 +368,136 @@ func (consumer *Consumer) parseRedisAnswer(answer *redis.StringCmd) (*Package, e
 }
 
 func (consumer *Consumer) unsafeGet() (*Package, error) {
-	answer := consumer.Queue.redisClient.BRPopLPush(
-		queueInputKey(consumer.Queue.Name),
-		consumerWorkingQueueKey(consumer.Queue.Name, consumer.Name),
-		0,
-	)
+	return consumer.blockingGet(0)
+}
+
+// pausePollInterval is how often blocking gets check if their queue was paused or resumed
+const pausePollInterval = time.Second
+
+// blockingGet waits at most timeout for a package, 0 waits forever.
+// The queue is checked for a pause at least every pausePollInterval.
+// Connection errors, e.g. during a failover, are retried for up to failoverTimeout.
+func (consumer *Consumer) blockingGet(timeout time.Duration) (*Package, error) {
+	var deadline, failingSince time.Time
+	if timeout > 0 {
+		deadline = time.Now().Add(timeout)
+	}
+	for {
+		wait := pausePollInterval
+		if !deadline.IsZero() {
+			left := time.Until(deadline)
+			if left <= 0 {
+				return nil, nil
+			}
+			if left < wait {
+				wait = left
+			}
+		}
+
+		paused, err := consumer.Queue.IsPaused()
+		if consumer.retryAfter(err, &failingSince) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if paused {
+			time.Sleep(wait)
+			continue
+		}
+
+		p, err := consumer.fetchOne(wait)
+		if err == ErrNoValue {
+			failingSince = time.Time{}
+			continue
+		}
+		if consumer.retryAfter(err, &failingSince) {
+			continue
+		}
+		return p, err
+	}
+}
+
+// fetchOne waits up to wait for the next package within the limits of the queue, 0 doesn't wait.
+// It returns ErrNoValue if no package arrived.
+func (consumer *Consumer) fetchOne(wait time.Duration) (*Package, error) {
+	slots, reserved, err := consumer.Queue.acquireSlots(1)
+	if err != nil {
+		return nil, err
+	}
+	if slots == 0 {
+		// wait for other consumers to finish packages
+		if wait > limitPollInterval {
+			wait = limitPollInterval
+		}
+		time.Sleep(wait)
+		return nil, ErrNoValue
+	}
+	p, err := consumer.fetchNext(wait)
+	if err != nil {
+		if reserved {
+			consumer.Queue.releaseSlots(slots)
+		}
+		return nil, err
+	}
+	if reserved {
+		consumer.Queue.holdSlots(slots, []*Package{p})
+	}
+	consumer.Queue.waitForTokens(1)
+	return p, nil
+}
+
+// fetchNext waits up to wait for the next package, 0 doesn't wait. It returns ErrNoValue if none arrived.
+func (consumer *Consumer) fetchNext(wait time.Duration) (*Package, error) {
+	if consumer.Queue.streams {
+		return consumer.streamFetchOne(wait)
+	}
+	if consumer.Queue.GetPartitions() > 0 {
+		return consumer.partitionFetchOne(wait)
+	}
+	inputKey := consumer.Queue.keys.queueInputKey(consumer.Queue.Name)
+	workingKey := consumer.Queue.keys.consumerWorkingQueueKey(consumer.Queue.Name, consumer.Name)
+	var answer string
+	var err error
+	if wait > 0 {
+		answer, err = consumer.Queue.backend.BRPopLPush(inputKey, workingKey, wait)
+	} else {
+		answer, err = consumer.Queue.backend.RPopLPush(inputKey, workingKey)
+	}
+	if err != nil {
+		return nil, err
+	}
 	consumer.Queue.incrRate(
-		consumerWorkingRateKey(consumer.Queue.Name, consumer.Name),
+		consumer.Queue.keys.consumerWorkingRateKey(consumer.Queue.Name, consumer.Name),
 		1,
 	)
-	return consumer.parseRedisAnswer(answer)
+	return consumer.parseAnswer(answer, err)
+}
+
+// retryAfter waits and returns true if err is a connection error that persisted for less than failoverTimeout
+func (consumer *Consumer) retryAfter(err error, failingSince *time.Time) bool {
+	if !isRetryableError(err) {
+		*failingSince = time.Time{}
+		return false
+	}
+	if failingSince.IsZero() {
+		*failingSince = time.Now()
+	}
+	if time.Since(*failingSince) > failoverTimeout {
+		return false
+	}
+	log.Printf("REDISMQ CONSUMER %s OF %s RETRYING [%s]", consumer.Name, consumer.Queue.Name, err.Error())
+	time.Sleep(pausePollInterval)
+	return true
+}
+
+// waitWhilePaused returns as soon as the queue isn't paused
+func (consumer *Consumer) waitWhilePaused() error {
+	for {
+		paused, err := consumer.Queue.IsPaused()
+		if err != nil || !paused {
+			return err
+		}
+		time.Sleep(pausePollInterval)
+	}
 }
@@ -0,0 +1,146 @@
+package redismq
+
+import (
+	"fmt"
+	"net/http"
+)
+
+// dashboardHandler serves a single page that renders the stats API.
+// The page polls /stats and /stats/history relative to its own path.
+type dashboardHandler struct{}
+
+func (handler *dashboardHandler) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
+	writer.Header().Set("Content-Type", "text/html; charset=utf-8")
+	fmt.Fprint(writer, dashboardHTML)
+}
+
+// historyHandler serves the condensed history of the Observer as JSON
+type historyHandler struct {
+	*Observer
+}
+
+func (handler *historyHandler) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
+	writeJSON(writer, http.StatusOK, handler.Observer.History())
+}
+
+const dashboardHTML = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>redismq</title>
+<style>
+body { font-family: sans-serif; margin: 2em; color: #222; }
+h1 { font-size: 1.4em; }
+table { border-collapse: collapse; margin-bottom: 2em; width: 100%; }
+th, td { text-align: left; padding: 4px 10px; border-bottom: 1px solid #ddd; }
+th { background: #f4f4f4; }
+td.num { text-align: right; font-family: monospace; }
+.live { color: #2a2; }
+.dead { color: #c22; }
+.error { color: #c22; }
+.paused { color: #c80; font-size: 0.8em; }
+.consumers td { border: none; padding: 1px 10px; font-size: 0.9em; }
+svg { vertical-align: middle; }
+#status { color: #888; font-size: 0.9em; }
+</style>
+</head>
+<body>
+<h1>redismq</h1>
+<p id="status">loading&hellip;</p>
+<table>
+<thead><tr>
+<th>Queue</th><th>Input</th><th>Failed</th><th>Input rate/s</th><th>Work rate/s</th>
+<th>Input length</th><th>Rates (in/work)</th><th>Consumers</th>
+</tr></thead>
+<tbody id="queues"></tbody>
+</table>
+<script>
+var refreshInterval = 2000;
+
+function escapeHTML(text) {
+	return String(text).replace(/[&<>"']/g, function(c) {
+		return {"&": "&amp;", "<": "&lt;", ">": "&gt;", '"': "&quot;", "'": "&#39;"}[c];
+	});
+}
+
+function sparkline(series, colors) {
+	var width = 160, height = 30, max = 1, length = 0;
+	series.forEach(function(values) {
+		length = Math.max(length, values.length);
+		values.forEach(function(v) { max = Math.max(max, v); });
+	});
+	var svg = '<svg width="' + width + '" height="' + height + '">';
+	series.forEach(function(values, i) {
+		var points = values.map(function(v, j) {
+			var x = length > 1 ? j * width / (length - 1) : 0;
+			return x.toFixed(1) + "," + (height - 1 - v * (height - 2) / max).toFixed(1);
+		});
+		svg += '<polyline fill="none" stroke="' + colors[i] + '" stroke-width="1.5" points="' + points.join(" ") + '"/>';
+	});
+	return svg + "</svg>";
+}
+
+function consumerRows(stats) {
+	var names = Object.keys(stats || {}).sort();
+	if (names.length === 0) {
+		return "none";
+	}
+	return '<table class="consumers">' + names.map(function(name) {
+		var c = stats[name];
+		return "<tr><td class=\"" + (c.Active ? "live" : "dead") + "\">&#9679;</td>" +
+			"<td>" + escapeHTML(name) + "</td>" +
+			"<td class=\"num\">" + c.WorkingLength + " unacked</td>" +
+			"<td class=\"num\">" + c.WorkRateSecond + "/s</td></tr>";
+	}).join("") + "</table>";
+}
+
+function render(snapshot, history) {
+	var names = Object.keys(snapshot.Stats || {}).sort();
+	var rows = names.map(function(name) {
+		var q = snapshot.Stats[name];
+		var points = history.map(function(p) { return p.Queues[name]; }).filter(function(p) { return p; });
+		var lengths = points.map(function(p) { return p.InputLength; });
+		var inputRates = points.map(function(p) { return p.InputRate; });
+		var workRates = points.map(function(p) { return p.WorkRate; });
+		var error = q.Error ? '<div class="error">' + escapeHTML(q.Error) + "</div>" : "";
+		var paused = q.Paused ? ' <span class="paused">paused</span>' : "";
+		return "<tr><td>" + escapeHTML(name) + paused + error + "</td>" +
+			'<td class="num">' + q.InputLength + "</td>" +
+			'<td class="num">' + q.FailedLength + "</td>" +
+			'<td class="num">' + q.InputRateSecond + "</td>" +
+			'<td class="num">' + q.WorkRateSecond + "</td>" +
+			"<td>" + sparkline([lengths], ["#36c"]) + "</td>" +
+			"<td>" + sparkline([inputRates, workRates], ["#e80", "#2a2"]) + "</td>" +
+			"<td>" + consumerRows(q.ConsumerStats) + "</td></tr>";
+	});
+	document.getElementById("queues").innerHTML = rows.join("");
+	var status = "updated " + new Date(snapshot.CollectedAt).toLocaleTimeString();
+	if (snapshot.Error) {
+		status += " (stale: " + snapshot.Error + ")";
+	}
+	document.getElementById("status").textContent = status;
+}
+
+function refresh() {
+	var base = location.pathname.replace(/\/dashboard\/?$/, "");
+	Promise.all([
+		fetch(base + "/stats").then(function(r) { return r.json(); }),
+		fetch(base + "/stats/history").then(function(r) { return r.json(); })
+	]).then(function(results) {
+		if (results[0].Stats) {
+			render(results[0], results[1] || []);
+		} else {
+			document.getElementById("status").textContent = results[0].Error;
+		}
+	}).catch(function(err) {
+		document.getElementById("status").textContent = "failed to load stats: " + err;
+	}).then(function() {
+		setTimeout(refresh, refreshInterval);
+	});
+}
+
+refresh();
+</script>
+</body>
+</html>
+`
@@ -0,0 +1,210 @@
+package redismq
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+)
+
+// exportBatch is the number of packages read from or written to redis per call by Export and Import
+const exportBatch = 1000
+
+// names of the lists in export records
+const (
+	exportInput   = "input"
+	exportFailed  = "failed"
+	exportWorking = "working"
+)
+
+// exportRecord is one line of an export, Package holds the envelope as stored in redis
+type exportRecord struct {
+	List     string
+	Consumer string `json:",omitempty"`
+	Package  json.RawMessage
+}
+
+// Export writes the packages of the input, failed and working lists as JSON Lines,
+// one envelope per line in the order they would be fetched, and returns their number.
+// Lists are read in batches so memory stays bounded. Without move packages are left in place,
+// as the batches aren't read atomically the export is only consistent while the queue isn't used.
+// With move exported packages are removed from redis after they were written,
+// which is refused while consumers are active.
+func (queue *Queue) Export(writer io.Writer, move bool) (int64, error) {
+	if queue.streams {
+		return 0, errStreamUnsupported
+	}
+	if queue.GetPartitions() > 0 {
+		return 0, errPartitionsUnsupported
+	}
+	if move {
+		active, err := queue.HasActiveConsumers()
+		if err != nil {
+			return 0, err
+		}
+		if active {
+			return 0, fmt.Errorf("cannot move packages of queue with active consumers")
+		}
+	}
+	consumers, err := queue.getConsumers()
+	if err != nil {
+		return 0, err
+	}
+	sort.Strings(consumers)
+
+	lists := []*exportRecord{{List: exportInput}, {List: exportFailed}}
+	for _, consumer := range consumers {
+		lists = append(lists, &exportRecord{List: exportWorking, Consumer: consumer})
+	}
+
+	buffered := bufio.NewWriter(writer)
+	exported := int64(0)
+	for _, list := range lists {
+		n, err := queue.exportList(buffered, list, move)
+		exported += n
+		if err != nil {
+			return exported, err
+		}
+	}
+	return exported, buffered.Flush()
+}
+
+func (queue *Queue) exportList(buffered *bufio.Writer, record *exportRecord, move bool) (int64, error) {
+	key := queue.exportKey(record)
+	encoder := json.NewEncoder(buffered)
+	encoder.SetEscapeHTML(false)
+
+	exported := int64(0)
+	for {
+		// moved packages are gone so the next batch is always at the right end
+		offset := exported
+		if move {
+			offset = 0
+		}
+		answers, err := queue.backend.LRange(key, -(offset + exportBatch), -(offset + 1))
+		if err != nil {
+			return exported, err
+		}
+		for i := len(answers) - 1; i >= 0; i-- {
+			record.Package = json.RawMessage(answers[i])
+			err = encoder.Encode(record)
+			if err != nil {
+				return exported, err
+			}
+		}
+
+		if move && len(answers) > 0 {
+			// only remove packages that made it to the writer
+			err = buffered.Flush()
+			if err != nil {
+				return exported, err
+			}
+			err = queue.backend.LTrim(key, 0, -int64(len(answers))-1)
+			if err != nil {
+				return exported, err
+			}
+		}
+		exported += int64(len(answers))
+		if len(answers) < exportBatch {
+			return exported, nil
+		}
+	}
+}
+
+// Import puts the packages of an Export into the queue and returns their number.
+// Packages keep their order and are fetched after the ones already in the queue.
+// Packages of working lists are restored as unacked packages of their consumers so they can be
+// reclaimed, with requeueWorking they are put into input instead.
+func (queue *Queue) Import(reader io.Reader, requeueWorking bool) (int64, error) {
+	if queue.streams {
+		return 0, errStreamUnsupported
+	}
+	if queue.GetPartitions() > 0 {
+		return 0, errPartitionsUnsupported
+	}
+	decoder := json.NewDecoder(bufio.NewReader(reader))
+	imported := int64(0)
+	key := ""
+	batch := make([]string, 0, exportBatch)
+
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		err := queue.backend.LPush(key, batch...)
+		if err != nil {
+			return err
+		}
+		if key == queue.keys.queueInputKey(queue.Name) {
+			queue.incrRate(queue.keys.queueInputRateKey(queue.Name), int64(len(batch)))
+		}
+		imported += int64(len(batch))
+		batch = batch[:0]
+		return nil
+	}
+
+	for {
+		record := &exportRecord{}
+		err := decoder.Decode(record)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return imported, fmt.Errorf("record %d: %s", imported+int64(len(batch))+1, err.Error())
+		}
+		if len(record.Package) == 0 {
+			return imported, fmt.Errorf("record %d has no package", imported+int64(len(batch))+1)
+		}
+		if requeueWorking && record.List == exportWorking {
+			record.List = exportInput
+		}
+
+		recordKey := queue.exportKey(record)
+		if recordKey == "" {
+			return imported, fmt.Errorf("record %d has unknown list %q", imported+int64(len(batch))+1, record.List)
+		}
+		if recordKey != key || len(batch) == exportBatch {
+			err = flush()
+			if err != nil {
+				return imported, err
+			}
+		}
+		if recordKey != key {
+			err = queue.prepareImport(record)
+			if err != nil {
+				return imported, err
+			}
+			key = recordKey
+		}
+		batch = append(batch, string(record.Package))
+	}
+	return imported, flush()
+}
+
+// prepareImport registers the consumer of working lists unless it is active
+func (queue *Queue) prepareImport(record *exportRecord) error {
+	if record.List != exportWorking {
+		return nil
+	}
+	if record.Consumer == "" {
+		return fmt.Errorf("working package without consumer")
+	}
+	if queue.isActiveConsumer(record.Consumer) {
+		return fmt.Errorf("consumer %s is active", record.Consumer)
+	}
+	_, err := queue.backend.SAdd(queue.keys.queueWorkersKey(queue.Name), record.Consumer)
+	return err
+}
+
+func (queue *Queue) exportKey(record *exportRecord) string {
+	switch record.List {
+	case exportInput:
+		return queue.keys.queueInputKey(queue.Name)
+	case exportFailed:
+		return queue.keys.queueFailedKey(queue.Name)
+	case exportWorking:
+		return queue.keys.consumerWorkingQueueKey(queue.Name, record.Consumer)
+	}
+	return ""
+}
@@ -0,0 +1,123 @@
+package redismq
+
+import (
+	"regexp"
+	"strings"
+	"time"
+)
+
+// filterBatch is the number of failed packages checked per redis call
+const filterBatch = 1000
+
+// Filter selects failed packages for RequeueFailedMatching and ResetFailedMatching.
+// A package has to match all conditions that are set, an empty Filter matches all packages.
+type Filter struct {
+	// Headers have to be set on the package with these values
+	Headers map[string]string
+	// ErrorContains has to be part of the Error of the package
+	ErrorContains string
+	// CreatedAfter and CreatedBefore limit when the package was put
+	CreatedAfter  time.Time
+	CreatedBefore time.Time
+	// Payload has to match the payload of the package
+	Payload *regexp.Regexp
+}
+
+// Match returns true if the package matches all conditions of the filter
+func (filter *Filter) Match(p *Package) bool {
+	for name, value := range filter.Headers {
+		if header, ok := p.Headers[name]; !ok || header != value {
+			return false
+		}
+	}
+	if filter.ErrorContains != "" && !strings.Contains(p.Error, filter.ErrorContains) {
+		return false
+	}
+	if !filter.CreatedAfter.IsZero() && !p.CreatedAt.After(filter.CreatedAfter) {
+		return false
+	}
+	if !filter.CreatedBefore.IsZero() && !p.CreatedAt.Before(filter.CreatedBefore) {
+		return false
+	}
+	if filter.Payload != nil && !filter.Payload.MatchString(p.Payload) {
+		return false
+	}
+	return true
+}
+
+// RequeueFailedMatching moves the failed packages matching the filter back to the input queue
+// and returns their number
+func (queue *Queue) RequeueFailedMatching(filter *Filter) (int64, error) {
+	if queue.streams {
+		return 0, errStreamUnsupported
+	}
+	if queue.GetPartitions() > 0 {
+		return 0, errPartitionsUnsupported
+	}
+	return queue.filterFailed(filter, filterRequeue)
+}
+
+// ResetFailedMatching deletes the failed packages matching the filter and returns their number
+func (queue *Queue) ResetFailedMatching(filter *Filter) (int64, error) {
+	return queue.filterFailed(filter, filterDelete)
+}
+
+// actions of Backend.RotateChecked
+const (
+	filterKeep    = "k"
+	filterRequeue = "r"
+	filterDelete  = "d"
+)
+
+// filterFailed walks through the failed queue once in batches. Kept packages are rotated to
+// the left end, so after all packages present at the start were checked their order is restored.
+// Every batch is applied atomically, packages failed in the meantime aren't checked.
+func (queue *Queue) filterFailed(filter *Filter, action string) (int64, error) {
+	if filter == nil {
+		filter = &Filter{}
+	}
+	key := queue.keys.queueFailedKey(queue.Name)
+	remaining, err := queue.backend.LLen(key)
+	if err != nil {
+		return 0, err
+	}
+
+	matched := int64(0)
+	for remaining > 0 {
+		size := remaining
+		if size > filterBatch {
+			size = filterBatch
+		}
+		answers, err := queue.backend.LRange(key, -size, -1)
+		if err != nil {
+			return matched, err
+		}
+		if len(answers) == 0 {
+			break
+		}
+
+		actions := make([]string, 0, len(answers))
+		values := make([]string, 0, len(answers))
+		for i := len(answers) - 1; i >= 0; i-- {
+			decision := filterKeep
+			p, err := unmarshalPackage(answers[i], queue, nil)
+			// packages that can't be parsed never match
+			if err == nil && filter.Match(p) {
+				decision = action
+			}
+			actions = append(actions, decision)
+			values = append(values, answers[i])
+		}
+
+		processed, batchMatched, err := queue.backend.RotateChecked(key, queue.keys.queueInputKey(queue.Name), actions, values)
+		if err != nil {
+			return matched, err
+		}
+		if action == filterRequeue && batchMatched > 0 {
+			queue.incrRate(queue.keys.queueInputRateKey(queue.Name), batchMatched)
+		}
+		matched += batchMatched
+		remaining -= processed
+	}
+	return matched, nil
+}
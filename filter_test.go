@@ -0,0 +1,65 @@
+package redismq
+
+import (
+	"fmt"
+	"regexp"
+	"time"
+
+	. "github.com/matttproud/gocheck"
+)
+
+// should require all set conditions to match
+func (suite *UnitSuite) TestFilterMatch(c *C) {
+	now := time.Now()
+	p := &Package{
+		Payload:   "customer 42",
+		CreatedAt: now,
+		Headers:   map[string]string{"customer": "42"},
+		Error:     "connection timeout",
+	}
+	c.Check((&Filter{}).Match(p), Equals, true)
+	c.Check((&Filter{Headers: map[string]string{"customer": "42"}}).Match(p), Equals, true)
+	c.Check((&Filter{Headers: map[string]string{"customer": "43"}}).Match(p), Equals, false)
+	c.Check((&Filter{Headers: map[string]string{"region": ""}}).Match(p), Equals, false)
+	c.Check((&Filter{ErrorContains: "timeout"}).Match(p), Equals, true)
+	c.Check((&Filter{ErrorContains: "refused"}).Match(p), Equals, false)
+	c.Check((&Filter{CreatedAfter: now.Add(-time.Minute), CreatedBefore: now.Add(time.Minute)}).Match(p), Equals, true)
+	c.Check((&Filter{CreatedBefore: now.Add(-time.Minute)}).Match(p), Equals, false)
+	c.Check((&Filter{Payload: regexp.MustCompile(`^customer \d+$`)}).Match(p), Equals, true)
+	c.Check((&Filter{Payload: regexp.MustCompile(`^customer \d+$`), ErrorContains: "refused"}).Match(p), Equals, false)
+}
+
+// should requeue matching failed packages and keep the order of the others
+func (suite *TestSuite) TestRequeueFailedMatching(c *C) {
+	for i := 0; i < 6; i++ {
+		c.Check(suite.queue.PutWithHeaders(fmt.Sprintf("%d", i), map[string]string{"customer": fmt.Sprintf("%d", i%2)}), IsNil)
+		p, err := suite.consumer.Get()
+		c.Assert(err, IsNil)
+		c.Check(p.FailWithError(fmt.Errorf("error %d", i)), IsNil)
+	}
+
+	failed, err := suite.queue.PeekFailed(0, 1)
+	c.Assert(err, IsNil)
+	c.Check(failed[0].Error, Equals, "error 0")
+	c.Check(failed[0].Headers["customer"], Equals, "0")
+
+	requeued, err := suite.queue.RequeueFailedMatching(&Filter{Headers: map[string]string{"customer": "1"}})
+	c.Check(err, IsNil)
+	c.Check(requeued, Equals, int64(3))
+	c.Check(suite.queue.GetInputLength(), Equals, int64(3))
+
+	deleted, err := suite.queue.ResetFailedMatching(&Filter{ErrorContains: "error 2"})
+	c.Check(err, IsNil)
+	c.Check(deleted, Equals, int64(1))
+
+	failed, err = suite.queue.PeekFailed(0, 10)
+	c.Assert(err, IsNil)
+	c.Assert(failed, HasLen, 2)
+	c.Check(failed[0].Payload, Equals, "0")
+	c.Check(failed[1].Payload, Equals, "4")
+	input, err := suite.queue.PeekInput(0, 10)
+	c.Assert(err, IsNil)
+	c.Assert(input, HasLen, 3)
+	c.Check(input[0].Payload, Equals, "1")
+	c.Check(input[2].Payload, Equals, "5")
+}
@@ -0,0 +1,351 @@
+package redismq
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// gatewayDefaultWait and gatewayMaxWait limit long polling for packages
+	gatewayDefaultWait = 30 * time.Second
+	gatewayMaxWait     = 60 * time.Second
+	// gatewayConsumerIdle is the time after which unused consumers stop their heartbeat
+	gatewayConsumerIdle = time.Minute
+	// gatewayMaxBody limits the size of put requests
+	gatewayMaxBody = 64 << 20
+)
+
+// Gateway lets services that aren't written in go produce and consume packages over HTTP.
+// It keeps the semantics of Queue and Consumer: a consumer has to Ack, Requeue or Fail its
+// package before it gets the next one. Consumers are created on first use and keep their
+// heartbeat as long as they are polled.
+//
+//	POST   /queues/<queue>/packages                                  {"Payload": "..."} or {"Payloads": ["...", "..."]}
+//	GET    /queues/<queue>/consumers/<consumer>/next?wait=30s        200 with the package or 204 after wait
+//	GET    /queues/<queue>/consumers/<consumer>/unacked
+//	POST   /queues/<queue>/consumers/<consumer>/packages/<id>/ack
+//	POST   /queues/<queue>/consumers/<consumer>/packages/<id>/requeue
+//	POST   /queues/<queue>/consumers/<consumer>/packages/<id>/fail
+//	DELETE /queues/<queue>/consumers/<consumer>
+type Gateway struct {
+	backend    Backend
+	ownsClient bool
+
+	mutex     sync.Mutex
+	queues    map[string]*Queue
+	consumers map[string]*gatewayConsumer
+	stop      chan struct{}
+}
+
+type gatewayConsumer struct {
+	sync.Mutex
+	*Consumer
+	lastUsed time.Time
+}
+
+type putRequest struct {
+	Payload  *string
+	Payloads []string
+}
+
+// NewGateway returns a Gateway that can be mounted into any http.ServeMux using http.StripPrefix
+func NewGateway(redisHost, redisPort, redisPassword string, redisDb int64) *Gateway {
+	gateway := NewGatewayWithClient(newRedisClient(redisHost, redisPort, redisPassword, redisDb))
+	gateway.ownsClient = true
+	return gateway
+}
+
+// NewGatewayWithClient works like NewGateway but all queues share the given client, which isn't closed by Close()
+func NewGatewayWithClient(redisClient RedisClient) *Gateway {
+	return NewGatewayWithBackend(NewRedisBackend(redisClient))
+}
+
+// NewGatewayWithBackend works like NewGateway but all queues are stored in the given backend,
+// which isn't closed by Close()
+func NewGatewayWithBackend(backend Backend) *Gateway {
+	gateway := &Gateway{
+		backend:   backend,
+		queues:    make(map[string]*Queue),
+		consumers: make(map[string]*gatewayConsumer),
+		stop:      make(chan struct{}),
+	}
+	go gateway.quitIdleConsumers()
+	return gateway
+}
+
+// Close stops the heartbeats of all consumers of the Gateway and closes its own client.
+// It waits for running long polls, requests to consumers fail afterwards.
+func (gateway *Gateway) Close() {
+	gateway.mutex.Lock()
+	select {
+	case <-gateway.stop:
+		gateway.mutex.Unlock()
+		return
+	default:
+		close(gateway.stop)
+	}
+	consumers := make([]*gatewayConsumer, 0, len(gateway.consumers))
+	for key, consumer := range gateway.consumers {
+		consumers = append(consumers, consumer)
+		delete(gateway.consumers, key)
+	}
+	gateway.mutex.Unlock()
+
+	// long polls hold the lock of their consumer until they return
+	var wg sync.WaitGroup
+	for _, consumer := range consumers {
+		wg.Add(1)
+		go func(consumer *gatewayConsumer) {
+			defer wg.Done()
+			consumer.Lock()
+			consumer.Quit()
+			consumer.Unlock()
+		}(consumer)
+	}
+	wg.Wait()
+	if gateway.ownsClient {
+		gateway.backend.Close()
+	}
+}
+
+func (gateway *Gateway) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
+	parts := strings.Split(strings.Trim(request.URL.Path, "/"), "/")
+	if len(parts) < 3 || parts[0] != "queues" {
+		writeError(writer, http.StatusNotFound, fmt.Errorf("not found"))
+		return
+	}
+	queueName := parts[1]
+
+	switch {
+	case len(parts) == 3 && parts[2] == "packages" && request.Method == "POST":
+		gateway.put(writer, request, queueName)
+	case len(parts) == 4 && parts[2] == "consumers" && request.Method == "DELETE":
+		gateway.quit(writer, queueName, parts[3])
+	case len(parts) == 5 && parts[2] == "consumers" && parts[4] == "next" && request.Method == "GET":
+		gateway.next(writer, request, queueName, parts[3])
+	case len(parts) == 5 && parts[2] == "consumers" && parts[4] == "unacked" && request.Method == "GET":
+		gateway.unacked(writer, queueName, parts[3])
+	case len(parts) == 7 && parts[2] == "consumers" && parts[4] == "packages" && request.Method == "POST":
+		gateway.settle(writer, queueName, parts[3], parts[5], parts[6])
+	default:
+		writeError(writer, http.StatusNotFound, fmt.Errorf("not found"))
+	}
+}
+
+func (gateway *Gateway) put(writer http.ResponseWriter, request *http.Request, queueName string) {
+	var body putRequest
+	err := json.NewDecoder(http.MaxBytesReader(writer, request.Body, gatewayMaxBody)).Decode(&body)
+	if err != nil {
+		writeError(writer, http.StatusBadRequest, err)
+		return
+	}
+	payloads := body.Payloads
+	if body.Payload != nil {
+		payloads = append([]string{*body.Payload}, payloads...)
+	}
+	if len(payloads) == 0 {
+		writeError(writer, http.StatusBadRequest, fmt.Errorf("no payload given"))
+		return
+	}
+
+	packages, err := gateway.queue(queueName).putPackages(payloads)
+	if err != nil {
+		writeError(writer, http.StatusServiceUnavailable, err)
+		return
+	}
+	writeJSON(writer, http.StatusCreated, packages)
+}
+
+func (gateway *Gateway) next(writer http.ResponseWriter, request *http.Request, queueName, consumerName string) {
+	wait := gatewayDefaultWait
+	if value := request.URL.Query().Get("wait"); value != "" {
+		var err error
+		wait, err = time.ParseDuration(value)
+		if err != nil || wait < 0 {
+			writeError(writer, http.StatusBadRequest, fmt.Errorf("invalid wait %q", value))
+			return
+		}
+	}
+	if wait > gatewayMaxWait {
+		wait = gatewayMaxWait
+	}
+
+	consumer, err := gateway.consumer(queueName, consumerName)
+	if err != nil {
+		writeError(writer, http.StatusConflict, err)
+		return
+	}
+	consumer.Lock()
+	defer consumer.Unlock()
+
+	if consumer.HasUnacked() {
+		writeError(writer, http.StatusConflict, fmt.Errorf("unacked Packages found"))
+		return
+	}
+	var p *Package
+	if wait == 0 {
+		p, err = consumer.NoWaitGet()
+	} else {
+		p, err = consumer.GetTimeout(wait)
+	}
+	if err != nil {
+		writeError(writer, http.StatusServiceUnavailable, err)
+		return
+	}
+	if p == nil {
+		writer.WriteHeader(http.StatusNoContent)
+		return
+	}
+	writeJSON(writer, http.StatusOK, p)
+}
+
+func (gateway *Gateway) unacked(writer http.ResponseWriter, queueName, consumerName string) {
+	consumer, err := gateway.consumer(queueName, consumerName)
+	if err != nil {
+		writeError(writer, http.StatusConflict, err)
+		return
+	}
+	consumer.Lock()
+	defer consumer.Unlock()
+
+	if !consumer.HasUnacked() {
+		writeError(writer, http.StatusNotFound, fmt.Errorf("no unacked Packages found"))
+		return
+	}
+	p, err := consumer.GetUnacked()
+	if err != nil {
+		writeError(writer, http.StatusServiceUnavailable, err)
+		return
+	}
+	writeJSON(writer, http.StatusOK, p)
+}
+
+// settle acks, requeues or fails the unacked package of a consumer if it has the given id
+func (gateway *Gateway) settle(writer http.ResponseWriter, queueName, consumerName, id, action string) {
+	consumer, err := gateway.consumer(queueName, consumerName)
+	if err != nil {
+		writeError(writer, http.StatusConflict, err)
+		return
+	}
+	consumer.Lock()
+	defer consumer.Unlock()
+
+	if !consumer.HasUnacked() {
+		writeError(writer, http.StatusNotFound, fmt.Errorf("no unacked Packages found"))
+		return
+	}
+	p, err := consumer.GetUnacked()
+	if err != nil {
+		writeError(writer, http.StatusServiceUnavailable, err)
+		return
+	}
+	if p.ID != id {
+		writeError(writer, http.StatusNotFound, fmt.Errorf("package %s is not the unacked package", id))
+		return
+	}
+
+	switch action {
+	case "ack":
+		err = p.Ack()
+	case "requeue":
+		err = p.Requeue()
+	case "fail":
+		err = p.Fail()
+	default:
+		writeError(writer, http.StatusNotFound, fmt.Errorf("unknown action %s", action))
+		return
+	}
+	if err != nil {
+		writeError(writer, http.StatusServiceUnavailable, err)
+		return
+	}
+	writeJSON(writer, http.StatusOK, p)
+}
+
+func (gateway *Gateway) quit(writer http.ResponseWriter, queueName, consumerName string) {
+	gateway.mutex.Lock()
+	consumer, ok := gateway.consumers[queueName+"/"+consumerName]
+	delete(gateway.consumers, queueName+"/"+consumerName)
+	gateway.mutex.Unlock()
+
+	if !ok {
+		writeError(writer, http.StatusNotFound, fmt.Errorf("consumer %s is not connected", consumerName))
+		return
+	}
+	consumer.Lock()
+	consumer.Quit()
+	consumer.Unlock()
+	writer.WriteHeader(http.StatusNoContent)
+}
+
+// queue returns a cached Queue, queues are created on first use like with CreateQueue
+func (gateway *Gateway) queue(name string) *Queue {
+	gateway.mutex.Lock()
+	defer gateway.mutex.Unlock()
+	return gateway.cachedQueue(name)
+}
+
+func (gateway *Gateway) cachedQueue(name string) *Queue {
+	queue, ok := gateway.queues[name]
+	if !ok {
+		queue = CreateQueueWithBackend(gateway.backend, name)
+		gateway.queues[name] = queue
+	}
+	return queue
+}
+
+// consumer returns the consumer of this Gateway or adds it to the queue
+// which fails if a consumer with this name is active elsewhere or the Gateway is closed
+func (gateway *Gateway) consumer(queueName, consumerName string) (*gatewayConsumer, error) {
+	gateway.mutex.Lock()
+	defer gateway.mutex.Unlock()
+	select {
+	case <-gateway.stop:
+		return nil, fmt.Errorf("gateway is closed")
+	default:
+	}
+
+	key := queueName + "/" + consumerName
+	consumer, ok := gateway.consumers[key]
+	if !ok {
+		c, err := gateway.cachedQueue(queueName).AddConsumer(consumerName)
+		if err != nil {
+			return nil, err
+		}
+		consumer = &gatewayConsumer{Consumer: c}
+		gateway.consumers[key] = consumer
+	}
+	consumer.lastUsed = time.Now()
+	return consumer, nil
+}
+
+func (gateway *Gateway) quitIdleConsumers() {
+	ticker := time.NewTicker(gatewayConsumerIdle / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-gateway.stop:
+			return
+		case <-ticker.C:
+		}
+
+		gateway.mutex.Lock()
+		for key, consumer := range gateway.consumers {
+			if time.Since(consumer.lastUsed) < gatewayConsumerIdle {
+				continue
+			}
+			delete(gateway.consumers, key)
+			// a long poll might still be running
+			go func(consumer *gatewayConsumer) {
+				consumer.Lock()
+				consumer.Quit()
+				consumer.Unlock()
+			}(consumer)
+		}
+		gateway.mutex.Unlock()
+	}
+}
@@ -0,0 +1,87 @@
+package redismq
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"time"
+
+	. "github.com/matttproud/gocheck"
+)
+
+func gatewayRequest(gateway *Gateway, method, path, body string) *httptest.ResponseRecorder {
+	recorder := httptest.NewRecorder()
+	gateway.ServeHTTP(recorder, httptest.NewRequest(method, path, strings.NewReader(body)))
+	return recorder
+}
+
+// should put, get and ack packages over HTTP
+func (suite *TestSuite) TestGatewayPutGetAndAck(c *C) {
+	gateway := NewGateway(redisHost, redisPort, redisPassword, redisDB)
+	defer gateway.Close()
+
+	recorder := gatewayRequest(gateway, "POST", "/queues/gatewayqueue/packages", `{"Payload": "first", "Payloads": ["second", "third"]}`)
+	c.Assert(recorder.Code, Equals, http.StatusCreated)
+	var put []*Package
+	c.Assert(json.Unmarshal(recorder.Body.Bytes(), &put), IsNil)
+	c.Assert(put, HasLen, 3)
+
+	for _, expected := range put {
+		recorder = gatewayRequest(gateway, "GET", "/queues/gatewayqueue/consumers/http/next?wait=1s", "")
+		c.Assert(recorder.Code, Equals, http.StatusOK)
+		var p Package
+		c.Assert(json.Unmarshal(recorder.Body.Bytes(), &p), IsNil)
+		c.Check(p.ID, Equals, expected.ID)
+		c.Check(p.Payload, Equals, expected.Payload)
+
+		c.Check(gatewayRequest(gateway, "GET", "/queues/gatewayqueue/consumers/http/next", "").Code, Equals, http.StatusConflict)
+		c.Check(gatewayRequest(gateway, "POST", "/queues/gatewayqueue/consumers/http/packages/"+p.ID+"/ack", "").Code, Equals, http.StatusOK)
+	}
+
+	c.Check(gatewayRequest(gateway, "GET", "/queues/gatewayqueue/consumers/http/next?wait=1s", "").Code, Equals, http.StatusNoContent)
+}
+
+// should only settle the unacked package of the consumer
+func (suite *TestSuite) TestGatewayFailByID(c *C) {
+	gateway := NewGateway(redisHost, redisPort, redisPassword, redisDB)
+	defer gateway.Close()
+
+	c.Check(gatewayRequest(gateway, "POST", "/queues/teststuff/packages", `{"Payload": "testpayload"}`).Code, Equals, http.StatusCreated)
+	recorder := gatewayRequest(gateway, "GET", "/queues/teststuff/consumers/http/next?wait=0s", "")
+	c.Assert(recorder.Code, Equals, http.StatusOK)
+	var p Package
+	c.Assert(json.Unmarshal(recorder.Body.Bytes(), &p), IsNil)
+
+	c.Check(gatewayRequest(gateway, "POST", "/queues/teststuff/consumers/http/packages/wrong/fail", "").Code, Equals, http.StatusNotFound)
+	c.Check(gatewayRequest(gateway, "POST", "/queues/teststuff/consumers/http/packages/"+p.ID+"/fail", "").Code, Equals, http.StatusOK)
+	c.Check(suite.queue.GetFailedLength(), Equals, int64(1))
+}
+
+// should not take over consumers that are active elsewhere
+func (suite *TestSuite) TestGatewayActiveConsumer(c *C) {
+	gateway := NewGateway(redisHost, redisPort, redisPassword, redisDB)
+	defer gateway.Close()
+	c.Check(gatewayRequest(gateway, "GET", "/queues/teststuff/consumers/testconsumer/next?wait=0s", "").Code, Equals, http.StatusConflict)
+}
+
+// should wait for running long polls before stopping the consumers
+func (suite *UnitSuite) TestGatewayCloseWaitsForPolls(c *C) {
+	backend := NewMemoryBackend()
+	gateway := NewGatewayWithBackend(backend)
+	c.Check(gatewayRequest(gateway, "GET", "/queues/gatewayclose/consumers/http/next?wait=0s", "").Code, Equals, http.StatusNoContent)
+
+	polled := make(chan int, 1)
+	go func() {
+		polled <- gatewayRequest(gateway, "GET", "/queues/gatewayclose/consumers/http/next?wait=1s", "").Code
+	}()
+	time.Sleep(100 * time.Millisecond)
+	start := time.Now()
+	gateway.Close()
+	c.Check(time.Since(start) > 500*time.Millisecond, Equals, true)
+	c.Check(<-polled, Equals, http.StatusNoContent)
+
+	queue := CreateQueueWithBackend(backend, "gatewayclose")
+	c.Check(queue.isActiveConsumer("http"), Equals, false)
+	c.Check(gatewayRequest(gateway, "GET", "/queues/gatewayclose/consumers/http/next?wait=0s", "").Code, Equals, http.StatusConflict)
+}
@@ -0,0 +1,129 @@
+package redismq
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+)
+
+// errGroupsBounded is returned by puts of bounded queues into queues with groups
+var errGroupsBounded = errors.New("bounds not supported by queues with groups")
+
+// AddGroup registers a consumer group of the queue. Every package put afterwards is delivered
+// once to every group, consumers added to the same group with AddGroupConsumer compete for them.
+// Producers of other Queues pick up new groups within a second.
+// Once a queue has groups packages are only put into the input queues of its groups,
+// consumers added with AddConsumer only get the packages put before. Queues with groups
+// can't be bounded with SetMaxLength.
+func (queue *Queue) AddGroup(name string) error {
+	if queue.streams {
+		return errStreamUnsupported
+	}
+	bounded, err := queue.isBounded()
+	if err != nil {
+		return err
+	}
+	if bounded {
+		return errGroupsBounded
+	}
+	if queue.GetPartitions() > 0 {
+		return errPartitionsUnsupported
+	}
+	if queue.keys.group != "" {
+		return fmt.Errorf("cannot add group to group %s", queue.keys.group)
+	}
+	if name == "" {
+		return fmt.Errorf("group name must not be empty")
+	}
+	_, err = queue.backend.SAdd(queue.keys.queueGroupsKey(queue.Name), name)
+	queue.forgetLayout()
+	return err
+}
+
+// RemoveGroup deletes a group with all its packages, it fails while consumers of the group are active
+func (queue *Queue) RemoveGroup(name string) error {
+	group := queue.group(name)
+	consumers, err := group.getConsumers()
+	if err != nil {
+		return err
+	}
+	for _, consumer := range consumers {
+		if group.isActiveConsumer(consumer) {
+			return fmt.Errorf("cannot remove group with active consumers")
+		}
+	}
+	err = queue.backend.SRem(queue.keys.queueGroupsKey(queue.Name), name)
+	if err != nil {
+		return err
+	}
+	queue.forgetLayout()
+	keys := []string{
+		group.keys.queueInputKey(queue.Name),
+		group.keys.queueFailedKey(queue.Name),
+		group.keys.queueWorkersKey(queue.Name),
+	}
+	for _, consumer := range consumers {
+		keys = append(keys, group.keys.consumerWorkingQueueKey(queue.Name, consumer))
+	}
+	return queue.backend.Del(keys...)
+}
+
+// GetGroups returns the sorted names of the groups of the queue
+func (queue *Queue) GetGroups() ([]string, error) {
+	groups, err := queue.backend.SMembers(queue.keys.queueGroupsKey(queue.Name))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(groups)
+	return groups, nil
+}
+
+// AddGroupConsumer works like AddConsumer for a consumer of the group. Its Queue reads from
+// and is reset, requeued and inspected like the input, failed and working queues of the group.
+func (queue *Queue) AddGroupConsumer(group, name string) (*Consumer, error) {
+	isMember, err := queue.backend.SIsMember(queue.keys.queueGroupsKey(queue.Name), group)
+	if err != nil {
+		return nil, err
+	}
+	if !isMember {
+		return nil, fmt.Errorf("group %s of queue %s doesn't exist", group, queue.Name)
+	}
+	return queue.group(group).AddConsumer(name)
+}
+
+// group returns the queue of a group, it shares the backend, limits and stats writer of queue
+func (queue *Queue) group(name string) *Queue {
+	return &Queue{
+		Name:          queue.Name,
+		backend:       queue.backend,
+		keys:          queue.keys.forGroup(name),
+		limits:        queue.limits,
+		rateStatsChan: queue.rateStatsChan,
+	}
+}
+
+// pushGroups pushes the values into the input queues of all groups
+func (queue *Queue) pushGroups(groups, values []string) error {
+	err := queue.backend.LPushEach(groups, values)
+	if err != nil {
+		return err
+	}
+	queue.incrRate(queue.keys.queueInputRateKey(queue.Name), int64(len(values)))
+	return nil
+}
+
+// groupInputKeys returns the input keys of all groups of the queue, none for queues of a group
+func (queue *Queue) groupInputKeys() ([]string, error) {
+	if queue.keys.group != "" {
+		return nil, nil
+	}
+	groups, err := queue.backend.SMembers(queue.keys.queueGroupsKey(queue.Name))
+	if err != nil {
+		return nil, err
+	}
+	keys := make([]string, len(groups))
+	for i, group := range groups {
+		keys[i] = queue.keys.forGroup(group).queueInputKey(queue.Name)
+	}
+	return keys, nil
+}
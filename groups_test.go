@@ -0,0 +1,103 @@
+package redismq
+
+import (
+	. "github.com/matttproud/gocheck"
+)
+
+func (suite *UnitSuite) TestGroupKeys(c *C) {
+	keys := keyScheme{}.forGroup("billing")
+	c.Check(keys.queueInputKey("clicks"), Equals, "redismq::clicks::group::billing")
+	c.Check(keys.queueWorkersKey("clicks"), Equals, "redismq::clicks::group::billing::workers")
+	c.Check(keys.queuePausedKey("clicks"), Equals, "redismq::clicks::paused")
+	clustered := keyScheme{cluster: true}.forGroup("billing")
+	c.Check(clustered.consumerWorkingQueueKey("clicks", "worker"), Equals, "redismq::{clicks}::group::billing::working::worker")
+}
+
+// every group should get every package once, consumers of a group compete for them
+func (suite *UnitSuite) TestGroups(c *C) {
+	backend := NewMemoryBackend()
+	queue := CreateQueueWithBackend(backend, "grouped")
+	c.Check(queue.AddGroup("billing"), IsNil)
+	c.Check(queue.AddGroup("analytics"), IsNil)
+	groups, err := queue.GetGroups()
+	c.Assert(err, IsNil)
+	c.Check(groups, DeepEquals, []string{"analytics", "billing"})
+	_, err = queue.AddGroupConsumer("unknown", "worker")
+	c.Check(err, Not(IsNil))
+
+	first, err := queue.AddGroupConsumer("billing", "first")
+	c.Assert(err, IsNil)
+	defer first.Quit()
+	second, err := queue.AddGroupConsumer("billing", "second")
+	c.Assert(err, IsNil)
+	defer second.Quit()
+	analytics, err := queue.AddGroupConsumer("analytics", "first")
+	c.Assert(err, IsNil)
+	defer analytics.Quit()
+
+	c.Check(queue.MultiPut("0", "1", "2"), IsNil)
+	c.Check(queue.GetInputLength(), Equals, int64(0))
+	p, err := first.Get()
+	c.Assert(err, IsNil)
+	c.Check(p.Payload, Equals, "0")
+	c.Check(p.Ack(), IsNil)
+	p, err = second.Get()
+	c.Assert(err, IsNil)
+	c.Check(p.Payload, Equals, "1")
+	c.Check(p.Fail(), IsNil)
+	c.Check(second.Queue.GetFailedLength(), Equals, int64(1))
+	c.Check(queue.GetFailedLength(), Equals, int64(0))
+
+	packages, err := analytics.MultiGet(5)
+	c.Assert(err, IsNil)
+	c.Assert(packages, HasLen, 3)
+	c.Check(packages[2].Payload, Equals, "2")
+	c.Check(packages[1].MultiAck(), IsNil)
+
+	observer := NewObserverWithBackend(backend)
+	c.Check(observer.UpdateQueueStats("grouped"), IsNil)
+	stat := observer.Snapshot().Stats["grouped"]
+	c.Assert(stat.Groups, HasLen, 2)
+	c.Check(stat.Groups["billing"].Lag, Equals, int64(1))
+	c.Check(stat.Groups["billing"].FailedLength, Equals, int64(1))
+	c.Check(stat.Groups["analytics"].Lag, Equals, int64(0))
+	c.Check(stat.Groups["analytics"].ConsumerStats["first"].WorkingLength, Equals, int64(1))
+	c.Check(stat.Groups["analytics"].ConsumerStats["first"].Active, Equals, true)
+
+	c.Check(queue.RemoveGroup("analytics"), Not(IsNil))
+	analytics.Quit()
+	c.Check(queue.RemoveGroup("analytics"), IsNil)
+	c.Check(queue.Put("3"), IsNil)
+	c.Check(first.Queue.GetInputLength(), Equals, int64(2))
+	exists, _ := backend.Exists(analytics.Queue.keys.consumerWorkingQueueKey("grouped", "first"))
+	c.Check(exists, Equals, false)
+
+	c.Check(queue.SetMaxLength(10, OverflowReject), Equals, errGroupsBounded)
+	bounded := CreateQueueWithBackend(backend, "boundedgroups")
+	c.Check(bounded.SetMaxLength(10, OverflowReject), IsNil)
+	c.Check(bounded.AddGroup("audit"), Equals, errGroupsBounded)
+	c.Check(first.Queue.GetInputLength(), Equals, int64(2))
+}
+
+// group fan out should be atomic in redis
+func (suite *TestSuite) TestGroups(c *C) {
+	c.Check(suite.queue.AddGroup("billing"), IsNil)
+	c.Check(suite.queue.AddGroup("analytics"), IsNil)
+	c.Check(suite.queue.MultiPut("0", "1"), IsNil)
+	c.Check(suite.redisClient.LLen("redismq::teststuff::group::billing").Val(), Equals, int64(2))
+	c.Check(suite.redisClient.LLen("redismq::teststuff::group::analytics").Val(), Equals, int64(2))
+
+	consumer, err := suite.queue.AddGroupConsumer("billing", "testconsumer")
+	c.Assert(err, IsNil)
+	p, err := consumer.Get()
+	c.Assert(err, IsNil)
+	c.Check(p.Payload, Equals, "0")
+	c.Check(p.Requeue(), IsNil)
+	c.Check(consumer.Queue.GetInputLength(), Equals, int64(2))
+
+	c.Check(suite.queue.Delete(), Not(IsNil))
+	consumer.Quit()
+	suite.consumer.Quit()
+	c.Check(suite.queue.Delete(), IsNil)
+	c.Check(suite.redisClient.Exists("redismq::teststuff::group::analytics").Val(), Equals, false)
+}
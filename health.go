@@ -0,0 +1,174 @@
+package redismq
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"time"
+)
+
+// names of the checks evaluated for the conditions of a Rule
+const (
+	CheckInputLength   = "input-length"
+	CheckFailedGrowing = "failed-growing"
+	CheckNoConsumers   = "no-consumers"
+	CheckPackageAge    = "package-age"
+)
+
+// Rule describes when a queue is considered unhealthy.
+// Only conditions with a non zero value are checked.
+type Rule struct {
+	// Queue is the name of the queue the rule applies to, empty for all queues
+	Queue string
+	// MaxInputLength fails if the input queue holds more packages
+	MaxInputLength int64
+	// FailedGrowingFor fails if the failed queue grew within this period
+	FailedGrowingFor time.Duration
+	// RequireConsumers fails if the input queue holds packages but no consumer is active
+	RequireConsumers bool
+	// MaxPackageAge fails if the next package in the input queue is older
+	MaxPackageAge time.Duration
+}
+
+// Check is the result of one condition of a Rule for one queue
+type Check struct {
+	Name    string
+	Queue   string
+	Failing bool
+	Reason  string `json:",omitempty"`
+	// rule is the index of the rule that produced the check
+	rule int
+}
+
+// SetRules replaces the rules that are evaluated after every complete refresh
+func (observer *Observer) SetRules(rules []Rule) {
+	observer.snapshotMutex.Lock()
+	defer observer.snapshotMutex.Unlock()
+	observer.rules = append([]Rule(nil), rules...)
+}
+
+// FailingChecks returns the checks of the snapshot that are failing
+func (snapshot *Snapshot) FailingChecks() []*Check {
+	var failing []*Check
+	for _, check := range snapshot.Checks {
+		if check.Failing {
+			failing = append(failing, check)
+		}
+	}
+	return failing
+}
+
+// evaluateRules checks all rules against the snapshot, history has to contain the snapshot already
+func evaluateRules(rules []Rule, snapshot *Snapshot, history []*HistoryPoint) []*Check {
+	queues := make([]string, 0, len(snapshot.Stats))
+	for queue := range snapshot.Stats {
+		queues = append(queues, queue)
+	}
+	sort.Strings(queues)
+
+	var checks []*Check
+	for i, rule := range rules {
+		for _, queue := range queues {
+			stat := snapshot.Stats[queue]
+			// incomplete stats can't be judged
+			if (rule.Queue != "" && rule.Queue != queue) || stat.Error != "" {
+				continue
+			}
+			for _, check := range rule.evaluate(queue, stat, snapshot.CollectedAt, history) {
+				check.rule = i
+				checks = append(checks, check)
+			}
+		}
+	}
+	return checks
+}
+
+func (rule *Rule) evaluate(queue string, stat *QueueStat, now time.Time, history []*HistoryPoint) []*Check {
+	var checks []*Check
+	check := func(name string, failing bool, reason string, args ...interface{}) {
+		c := &Check{Name: name, Queue: queue, Failing: failing}
+		if failing {
+			c.Reason = fmt.Sprintf(reason, args...)
+		}
+		checks = append(checks, c)
+	}
+
+	if rule.MaxInputLength > 0 {
+		check(CheckInputLength, stat.InputLength > rule.MaxInputLength,
+			"input queue holds %d packages, more than %d", stat.InputLength, rule.MaxInputLength)
+	}
+
+	if rule.FailedGrowingFor > 0 {
+		// find the latest point that lies at least the period back
+		var past *QueuePoint
+		for _, point := range history {
+			if point.CollectedAt.After(now.Add(-rule.FailedGrowingFor)) {
+				break
+			}
+			past = point.Queues[queue]
+		}
+		growing := past != nil && stat.FailedLength > past.FailedLength
+		var from int64
+		if past != nil {
+			from = past.FailedLength
+		}
+		check(CheckFailedGrowing, growing,
+			"failed queue grew from %d to %d packages within %s", from, stat.FailedLength, rule.FailedGrowingFor)
+	}
+
+	if rule.RequireConsumers {
+		active := 0
+		for _, consumer := range stat.ConsumerStats {
+			if consumer.Active {
+				active++
+			}
+		}
+		check(CheckNoConsumers, stat.InputLength > 0 && active == 0,
+			"input queue holds %d packages but no consumer is active", stat.InputLength)
+	}
+
+	if rule.MaxPackageAge > 0 {
+		age := time.Duration(stat.OldestPackageAge) * time.Second
+		check(CheckPackageAge, age > rule.MaxPackageAge,
+			"next package in input queue is %s old, older than %s", age, rule.MaxPackageAge)
+	}
+
+	return checks
+}
+
+// healthHandler responds with 200 as long as redis is reachable
+type healthHandler struct {
+	*Observer
+}
+
+func (handler *healthHandler) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
+	err := handler.Observer.backend.Ping()
+	if err != nil {
+		writeError(writer, http.StatusServiceUnavailable, err)
+		return
+	}
+	writeJSON(writer, http.StatusOK, map[string]string{"Status": "ok"})
+}
+
+// readyHandler responds with 200 if the latest refresh succeeded and no check of the rules is failing
+type readyHandler struct {
+	*Observer
+}
+
+func (handler *readyHandler) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
+	snapshot := handler.Observer.Snapshot()
+	switch {
+	case snapshot.CollectedAt.IsZero() && snapshot.Error == "":
+		writeError(writer, http.StatusServiceUnavailable, fmt.Errorf("no stats collected yet"))
+	case snapshot.Error != "":
+		writeError(writer, http.StatusServiceUnavailable, errors.New(snapshot.Error))
+	default:
+		failing := snapshot.FailingChecks()
+		if len(failing) > 0 {
+			writeJSON(writer, http.StatusServiceUnavailable, map[string]interface{}{"Status": "failing", "Checks": failing})
+			return
+		}
+		writeJSON(writer, http.StatusOK, map[string]string{"Status": "ok"})
+	}
+}
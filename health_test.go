@@ -0,0 +1,96 @@
+package redismq
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"time"
+
+	. "github.com/matttproud/gocheck"
+)
+
+func ruleSnapshot(stat *QueueStat) *Snapshot {
+	if stat.ConsumerStats == nil {
+		stat.ConsumerStats = make(map[string]*ConsumerStat)
+	}
+	return &Snapshot{Stats: map[string]*QueueStat{"clicks": stat}, CollectedAt: time.Now()}
+}
+
+// should only fail conditions that are exceeded
+func (suite *UnitSuite) TestRuleInputLengthAndAge(c *C) {
+	rules := []Rule{{MaxInputLength: 10, MaxPackageAge: time.Minute}}
+	checks := evaluateRules(rules, ruleSnapshot(&QueueStat{InputLength: 11, OldestPackageAge: 30}), nil)
+	c.Assert(checks, HasLen, 2)
+	c.Check(checks[0].Name, Equals, CheckInputLength)
+	c.Check(checks[0].Failing, Equals, true)
+	c.Check(checks[0].Reason, Equals, "input queue holds 11 packages, more than 10")
+	c.Check(checks[1].Name, Equals, CheckPackageAge)
+	c.Check(checks[1].Failing, Equals, false)
+}
+
+// should only apply rules to their queue
+func (suite *UnitSuite) TestRuleQueue(c *C) {
+	rules := []Rule{{Queue: "other", MaxInputLength: 10}}
+	c.Check(evaluateRules(rules, ruleSnapshot(&QueueStat{InputLength: 11}), nil), HasLen, 0)
+}
+
+// should fail if input is waiting without active consumers
+func (suite *UnitSuite) TestRuleRequireConsumers(c *C) {
+	rules := []Rule{{RequireConsumers: true}}
+	stat := &QueueStat{InputLength: 1, ConsumerStats: map[string]*ConsumerStat{"dead": {Active: false}}}
+	checks := evaluateRules(rules, ruleSnapshot(stat), nil)
+	c.Assert(checks, HasLen, 1)
+	c.Check(checks[0].Failing, Equals, true)
+
+	stat.ConsumerStats["alive"] = &ConsumerStat{Active: true}
+	c.Check(evaluateRules(rules, ruleSnapshot(stat), nil)[0].Failing, Equals, false)
+}
+
+// should fail if the failed queue grew within the period
+func (suite *UnitSuite) TestRuleFailedGrowing(c *C) {
+	rules := []Rule{{FailedGrowingFor: time.Minute}}
+	snapshot := ruleSnapshot(&QueueStat{FailedLength: 5})
+	history := []*HistoryPoint{
+		{CollectedAt: snapshot.CollectedAt.Add(-2 * time.Minute), Queues: map[string]*QueuePoint{"clicks": {FailedLength: 1}}},
+		{CollectedAt: snapshot.CollectedAt.Add(-time.Minute), Queues: map[string]*QueuePoint{"clicks": {FailedLength: 3}}},
+		{CollectedAt: snapshot.CollectedAt, Queues: map[string]*QueuePoint{"clicks": {FailedLength: 5}}},
+	}
+	checks := evaluateRules(rules, snapshot, history)
+	c.Assert(checks, HasLen, 1)
+	c.Check(checks[0].Failing, Equals, true)
+	c.Check(checks[0].Reason, Equals, "failed queue grew from 3 to 5 packages within 1m0s")
+
+	// not enough history yet
+	c.Check(evaluateRules(rules, snapshot, history[2:])[0].Failing, Equals, false)
+}
+
+// should report redis reachability
+func (suite *TestSuite) TestHealthHandler(c *C) {
+	recorder := httptest.NewRecorder()
+	handler := &healthHandler{Observer: NewObserver(redisHost, redisPort, redisPassword, redisDB)}
+	handler.ServeHTTP(recorder, httptest.NewRequest("GET", "/healthz", nil))
+	c.Check(recorder.Code, Equals, http.StatusOK)
+}
+
+// should report failing checks as not ready
+func (suite *TestSuite) TestReadyHandler(c *C) {
+	observer := NewObserver(redisHost, redisPort, redisPassword, redisDB)
+	observer.SetRules([]Rule{{Queue: "teststuff", MaxInputLength: 1}})
+	handler := &readyHandler{Observer: observer}
+
+	c.Assert(observer.UpdateAllStats(), IsNil)
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest("GET", "/ready", nil))
+	c.Check(recorder.Code, Equals, http.StatusOK)
+
+	c.Check(suite.queue.MultiPut("first", "second"), IsNil)
+	c.Assert(observer.UpdateAllStats(), IsNil)
+	recorder = httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest("GET", "/ready", nil))
+	c.Check(recorder.Code, Equals, http.StatusServiceUnavailable)
+
+	var body struct{ Checks []*Check }
+	c.Assert(json.Unmarshal(recorder.Body.Bytes(), &body), IsNil)
+	c.Assert(body.Checks, HasLen, 1)
+	c.Check(body.Checks[0].Name, Equals, CheckInputLength)
+}
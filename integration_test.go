@@ -1,8 +1,12 @@
 package redismq
 
 import (
+	"bytes"
+	"context"
+	"fmt"
 	"math/rand"
 	"runtime"
+	"strings"
 	"testing"
 	"time"
 
@@ -18,12 +22,16 @@ type TestSuite struct {
 	redisClient *redis.Client
 }
 
+// UnitSuite holds tests that don't need a running redis
+type UnitSuite struct{}
+
 var (
 	redisHost     = "localhost"
 	redisPort     = "6379"
 	redisPassword = ""
 	redisDB       = int64(9)
 	_             = Suite(&TestSuite{})
+	_             = Suite(&UnitSuite{})
 )
 
 func (suite *TestSuite) SetUpSuite(c *C) {
@@ -74,6 +82,16 @@ func (suite *TestSuite) TestQueuingPackages(c *C) {
 	c.Check(suite.queue.GetInputLength(), Equals, int64(100))
 }
 
+// should put multiple packages in order
+func (suite *TestSuite) TestMultiPut(c *C) {
+	c.Check(suite.queue.MultiPut("first", "second"), Equals, nil)
+	c.Check(suite.queue.GetInputLength(), Equals, int64(2))
+	p, err := suite.consumer.Get()
+	c.Assert(err, Equals, nil)
+	c.Check(p.Payload, Equals, "first")
+	c.Check(p.ID, Not(Equals), "")
+}
+
 // shouldn't get 2nd package for consumer
 func (suite *TestSuite) TestSecondGet(c *C) {
 	c.Check(suite.queue.Put("testpayload"), Equals, nil)
@@ -420,6 +438,28 @@ func (suite *TestSuite) TestBufferedFlush(c *C) {
 	c.Check(len(q.Buffer), Equals, 0)
 }
 
+// should report packages put after tailing started without removing them
+func (suite *TestSuite) TestTail(c *C) {
+	c.Check(suite.queue.Put("old"), Equals, nil)
+	ctx, cancel := context.WithCancel(context.Background())
+	tailed := make(chan string, 10)
+	done := make(chan error, 1)
+	go func() {
+		done <- suite.queue.Tail(ctx, 50*time.Millisecond, func(p *Package) {
+			tailed <- p.Payload
+		})
+	}()
+
+	time.Sleep(100 * time.Millisecond)
+	c.Check(suite.queue.MultiPut("first", "second"), Equals, nil)
+	c.Check(<-tailed, Equals, "first")
+	c.Check(<-tailed, Equals, "second")
+	cancel()
+	c.Check(<-done, IsNil)
+	c.Check(len(tailed), Equals, 0)
+	c.Check(suite.queue.GetInputLength(), Equals, int64(3))
+}
+
 // TODO write stats watcher
 // should get numbers of consumers
 
@@ -440,3 +480,192 @@ func randomString(l int) string {
 func randInt(min int, max int) int {
 	return min + rand.Intn(max-min)
 }
+
+// should copy input, failed and working packages in order without removing them
+func (suite *TestSuite) TestExportImport(c *C) {
+	c.Check(suite.queue.MultiPut("unacked", "failed", "first", "second"), Equals, nil)
+	other, err := suite.queue.AddConsumer("otherconsumer")
+	c.Assert(err, IsNil)
+	p, err := other.Get()
+	c.Assert(err, IsNil)
+	c.Check(p.Payload, Equals, "unacked")
+	other.Quit()
+	p, err = suite.consumer.Get()
+	c.Assert(err, IsNil)
+	c.Check(p.Payload, Equals, "failed")
+	c.Check(p.Fail(), IsNil)
+
+	var buffer bytes.Buffer
+	exported, err := suite.queue.Export(&buffer, false)
+	c.Check(err, IsNil)
+	c.Check(exported, Equals, int64(4))
+	c.Check(suite.queue.GetInputLength(), Equals, int64(2))
+
+	copied := CreateQueue(redisHost, redisPort, redisPassword, redisDB, "teststuff_copy")
+	c.Check(copied.Put("existing"), IsNil)
+	imported, err := copied.Import(&buffer, false)
+	c.Check(err, IsNil)
+	c.Check(imported, Equals, int64(4))
+	c.Check(copied.GetFailedLength(), Equals, int64(1))
+
+	consumer, err := copied.AddConsumer("otherconsumer")
+	c.Assert(err, IsNil)
+	c.Check(consumer.HasUnacked(), Equals, true)
+	p, err = consumer.GetUnacked()
+	c.Assert(err, IsNil)
+	c.Check(p.Payload, Equals, "unacked")
+	c.Check(p.Ack(), IsNil)
+	for _, payload := range []string{"existing", "first", "second"} {
+		p, err = consumer.Get()
+		c.Assert(err, IsNil)
+		c.Check(p.Payload, Equals, payload)
+		c.Check(p.Ack(), IsNil)
+	}
+	consumer.Quit()
+}
+
+// should remove exported packages and refuse to move while consumers are active
+func (suite *TestSuite) TestExportMove(c *C) {
+	for i := 0; i < exportBatch+10; i++ {
+		c.Check(suite.queue.Put(fmt.Sprintf("%d", i)), IsNil)
+	}
+	var buffer bytes.Buffer
+	_, err := suite.queue.Export(&buffer, true)
+	c.Check(err, Not(IsNil))
+	suite.consumer.Quit()
+
+	exported, err := suite.queue.Export(&buffer, true)
+	c.Check(err, IsNil)
+	c.Check(exported, Equals, int64(exportBatch+10))
+	c.Check(suite.queue.GetInputLength(), Equals, int64(0))
+
+	imported, err := suite.queue.Import(&buffer, false)
+	c.Check(err, IsNil)
+	c.Check(imported, Equals, exported)
+	peeked, err := suite.queue.PeekInput(exportBatch, 2)
+	c.Assert(err, IsNil)
+	c.Check(peeked[0].Payload, Equals, fmt.Sprintf("%d", exportBatch))
+	c.Check(peeked[1].Payload, Equals, fmt.Sprintf("%d", exportBatch+1))
+}
+
+// should refuse records of unknown lists
+func (suite *TestSuite) TestImportUnknownList(c *C) {
+	_, err := suite.queue.Import(strings.NewReader(`{"List":"other","Package":{"Payload":"x"}}`), false)
+	c.Check(err, Not(IsNil))
+}
+
+// should peek unacked packages in order and refuse to settle peeked packages
+func (suite *TestSuite) TestPeekWorking(c *C) {
+	c.Check(suite.queue.MultiPut("first", "second", "third"), IsNil)
+	_, err := suite.consumer.MultiGet(3)
+	c.Assert(err, IsNil)
+
+	peeked, err := suite.consumer.PeekWorking(1, 10)
+	c.Assert(err, IsNil)
+	c.Assert(peeked, HasLen, 2)
+	c.Check(peeked[0].Payload, Equals, "second")
+	c.Check(peeked[1].Payload, Equals, "third")
+	c.Check(peeked[0].Ack(), Not(IsNil))
+	c.Check(peeked[0].Requeue(), Not(IsNil))
+	c.Check(peeked[0].Fail(), Not(IsNil))
+	c.Check(suite.consumer.GetUnackedLength(), Equals, int64(3))
+
+	_, err = suite.queue.PeekInput(-1, 10)
+	c.Check(err, Not(IsNil))
+}
+
+// should accept puts but deliver nothing while paused
+func (suite *TestSuite) TestPauseResume(c *C) {
+	c.Check(suite.queue.Pause(), IsNil)
+	paused, err := suite.queue.IsPaused()
+	c.Check(err, IsNil)
+	c.Check(paused, Equals, true)
+	c.Check(suite.queue.Put("testpayload"), IsNil)
+	c.Check(suite.queue.GetInputLength(), Equals, int64(1))
+
+	p, err := suite.consumer.NoWaitGet()
+	c.Check(err, IsNil)
+	c.Check(p, IsNil)
+	p, err = suite.consumer.GetTimeout(time.Second)
+	c.Check(err, IsNil)
+	c.Check(p, IsNil)
+
+	go func() {
+		time.Sleep(500 * time.Millisecond)
+		suite.queue.Resume()
+	}()
+	p, err = suite.consumer.Get()
+	c.Assert(err, IsNil)
+	c.Check(p.Payload, Equals, "testpayload")
+	c.Check(p.Ack(), IsNil)
+
+	c.Check(suite.queue.Pause(), IsNil)
+	c.Check(suite.queue.MultiPut("first", "second"), IsNil)
+	go func() {
+		time.Sleep(500 * time.Millisecond)
+		suite.queue.Resume()
+	}()
+	packages, err := suite.consumer.MultiGet(2)
+	c.Assert(err, IsNil)
+	c.Check(packages, HasLen, 2)
+}
+
+// should share one client between queues and observers without closing it
+func (suite *TestSuite) TestSharedClient(c *C) {
+	client := redis.NewClient(&redis.Options{
+		Addr:     redisHost + ":" + redisPort,
+		Password: redisPassword,
+		DB:       redisDB,
+	})
+	defer client.Close()
+
+	queue := CreateQueueWithClient(client, "testshared")
+	c.Check(queue.Put("testpayload"), IsNil)
+	selected, err := SelectBufferedQueueWithClient(client, "testshared", 10)
+	c.Assert(err, IsNil)
+	c.Check(selected.GetInputLength(), Equals, int64(1))
+	_, err = SelectQueueWithClient(client, "missing")
+	c.Check(err, Not(IsNil))
+
+	c.Check(queue.Delete(), IsNil)
+	observer := NewObserverWithClient(client)
+	c.Check(observer.UpdateAllStats(), IsNil)
+	_, ok := observer.Snapshot().Stats["testshared"]
+	c.Check(ok, Equals, false)
+}
+
+func (suite *UnitSuite) TestNamespaceKeys(c *C) {
+	keys := keysFor(UseNamespace(&redis.Client{}, "staging"))
+	c.Check(keys.masterQueueKey(), Equals, "staging::queues")
+	c.Check(keys.queueWorkersKey("clicks"), Equals, "staging::clicks::workers")
+	c.Check(keys.queueFailedKey("clicks"), Equals, "staging::clicks::failed")
+	keys = keysFor(UseNamespace(UseClusterLayout(&redis.Client{}), "staging"))
+	c.Check(keys.queueWorkersKey("clicks"), Equals, "staging::{clicks}::workers")
+	c.Check(keysFor(&redis.Client{}).masterQueueKey(), Equals, "redismq::queues")
+}
+
+// queues in different namespaces should not see each other
+func (suite *TestSuite) TestNamespace(c *C) {
+	staging := CreateQueueWithClient(UseNamespace(suite.redisClient, "staging"), "teststuff")
+	c.Check(staging.Put("staged"), IsNil)
+	c.Check(staging.GetInputLength(), Equals, int64(1))
+	c.Check(suite.queue.GetInputLength(), Equals, int64(0))
+
+	consumer, err := staging.AddConsumer("testconsumer")
+	c.Assert(err, IsNil)
+	p, err := consumer.Get()
+	c.Assert(err, IsNil)
+	c.Check(p.Payload, Equals, "staged")
+	c.Check(p.Ack(), IsNil)
+	consumer.Quit()
+
+	_, err = SelectQueueWithClient(UseNamespace(suite.redisClient, "staging"), "missing")
+	c.Check(err, Not(IsNil))
+	observer := NewObserverWithClient(UseNamespace(suite.redisClient, "staging"))
+	queues, err := observer.GetAllQueues()
+	c.Assert(err, IsNil)
+	c.Check(queues, DeepEquals, []string{"teststuff"})
+	c.Check(suite.redisClient.SIsMember("staging::queues", "teststuff").Val(), Equals, true)
+	c.Check(staging.Delete(), IsNil)
+	c.Check(suite.redisClient.SIsMember("redismq::queues", "teststuff").Val(), Equals, true)
+}
@@ -1,48 +1,175 @@
 package redismq
 
-func masterQueueKey() string {
-	return "redismq::queues"
+import (
+	"strconv"
+
+	"gopkg.in/redis.v3"
+)
+
+// defaultNamespace prefixes all keys unless UseNamespace is used
+const defaultNamespace = "redismq"
+
+// keyScheme generates the redis keys of queues. The cluster layout wraps the queue name
+// in a hash tag so that all keys of a queue are stored in the same slot of a redis cluster.
+// With a group the keys of the group's input, failed and working queues are generated.
+type keyScheme struct {
+	cluster   bool
+	namespace string
+	group     string
+}
+
+// namespacedClient is a client whose queues live in their own namespace
+type namespacedClient struct {
+	RedisClient
+	namespace string
+}
+
+// UseNamespace returns the client for use with the *WithClient constructors so that queues,
+// observers and gateways only see the keys under namespace instead of "redismq",
+// e.g. to let several environments share a redis database.
+func UseNamespace(client RedisClient, namespace string) RedisClient {
+	return &namespacedClient{RedisClient: client, namespace: namespace}
+}
+
+// keysFor returns the key layout used with the client. The cluster layout puts the queue name
+// in a hash tag, so all keys of a queue land in one slot and scripts can use them together.
+func keysFor(client RedisClient) keyScheme {
+	switch client := client.(type) {
+	case *namespacedClient:
+		keys := keysFor(client.RedisClient)
+		keys.namespace = client.namespace
+		return keys
+	case *redis.ClusterClient, *clusterLayoutClient:
+		return keyScheme{cluster: true}
+	}
+	return keyScheme{}
 }
 
-func queueWorkersKey(queue string) string {
+func (keys keyScheme) prefix() string {
+	if keys.namespace == "" {
+		return defaultNamespace
+	}
+	return keys.namespace
+}
+
+func (keys keyScheme) masterQueueKey() string {
+	return keys.prefix() + "::queues"
+}
+
+// forGroup returns the keys of the group of a queue
+func (keys keyScheme) forGroup(group string) keyScheme {
+	keys.group = group
+	return keys
+}
+
+func (keys keyScheme) queueWorkersKey(queue string) string {
+	return keys.queueInputKey(queue) + "::workers"
+}
+
+// legacyWorkersKey is where versions without namespaces kept the consumers of a queue, see migrateLegacyWorkers
+func legacyWorkersKey(queue string) string {
 	return queue + "::workers"
 }
 
-func queueInputKey(queue string) string {
-	return "redismq::" + queue
+// queueKey is the input key of the queue, keys shared by all groups of the queue start with it
+func (keys keyScheme) queueKey(queue string) string {
+	if keys.cluster {
+		return keys.prefix() + "::{" + queue + "}"
+	}
+	return keys.prefix() + "::" + queue
+}
+
+func (keys keyScheme) queueInputKey(queue string) string {
+	if keys.group != "" {
+		return keys.queueKey(queue) + "::group::" + keys.group
+	}
+	return keys.queueKey(queue)
+}
+
+func (keys keyScheme) queueGroupsKey(queue string) string {
+	return keys.queueKey(queue) + "::groups"
+}
+
+func (keys keyScheme) queuePartitionsKey(queue string) string {
+	return keys.queueKey(queue) + "::partitions"
 }
 
-func queueFailedKey(queue string) string {
-	return "redismq::" + queue + "::failed"
+func (keys keyScheme) queuePartitionKey(queue string, partition int64) string {
+	return keys.queuePartitionsKey(queue) + "::" + strconv.FormatInt(partition, 10)
 }
 
-func queueInputRateKey(queue string) string {
-	return queueInputKey(queue) + "::rate"
+func (keys keyScheme) queuePartitionOwnerKey(queue string, partition int64) string {
+	return keys.queuePartitionKey(queue, partition) + "::owner"
 }
 
-func queueInputSizeKey(queue string) string {
-	return queueInputKey(queue) + "::size"
+func (keys keyScheme) queueRateLimitKey(queue string) string {
+	return keys.queueKey(queue) + "::ratelimit"
 }
 
-func queueFailedSizeKey(queue string) string {
-	return queueFailedKey(queue) + "::size"
+func (keys keyScheme) queueTokensKey(queue string) string {
+	return keys.queueRateLimitKey(queue) + "::tokens"
 }
 
-func queueHeartbeatKey(queue string) string {
-	return queueInputKey(queue) + "::buffered::heartbeat"
+func (keys keyScheme) queueInFlightKey(queue string) string {
+	return keys.queueKey(queue) + "::inflight"
 }
 
-func queueWorkingPrefix(queue string) string {
-	return "redismq::" + queue + "::working"
+func (keys keyScheme) queueInFlightPackagesKey(queue string) string {
+	return keys.queueInFlightKey(queue) + "::packages"
 }
 
-func consumerWorkingQueueKey(queue, consumer string) string {
-	return queueWorkingPrefix(queue) + "::" + consumer
+func (keys keyScheme) queueInFlightLimitKey(queue string) string {
+	return keys.queueInFlightKey(queue) + "::limit"
 }
-func consumerWorkingRateKey(queue, consumer string) string {
-	return consumerWorkingQueueKey(queue, consumer) + "::rate"
+
+func (keys keyScheme) queueMaxLengthKey(queue string) string {
+	return keys.queueKey(queue) + "::maxlength"
+}
+
+func (keys keyScheme) queueStreamKey(queue string) string {
+	return keys.queueKey(queue) + "::stream"
+}
+
+func (keys keyScheme) queueFailedKey(queue string) string {
+	return keys.queueInputKey(queue) + "::failed"
+}
+
+func (keys keyScheme) queueInputRateKey(queue string) string {
+	return keys.queueInputKey(queue) + "::rate"
+}
+
+func (keys keyScheme) queueInputSizeKey(queue string) string {
+	return keys.queueInputKey(queue) + "::size"
+}
+
+func (keys keyScheme) queueFailedSizeKey(queue string) string {
+	return keys.queueFailedKey(queue) + "::size"
+}
+
+func (keys keyScheme) queuePausedKey(queue string) string {
+	return keys.queueKey(queue) + "::paused"
+}
+
+func (keys keyScheme) queueDroppedKey(queue string) string {
+	return keys.queueKey(queue) + "::dropped"
+}
+
+func (keys keyScheme) queueHeartbeatKey(queue string) string {
+	return keys.queueInputKey(queue) + "::buffered::heartbeat"
+}
+
+func (keys keyScheme) queueWorkingPrefix(queue string) string {
+	return keys.queueInputKey(queue) + "::working"
+}
+
+func (keys keyScheme) consumerWorkingQueueKey(queue, consumer string) string {
+	return keys.queueWorkingPrefix(queue) + "::" + consumer
+}
+
+func (keys keyScheme) consumerWorkingRateKey(queue, consumer string) string {
+	return keys.consumerWorkingQueueKey(queue, consumer) + "::rate"
 }
 
-func consumerHeartbeatKey(queue, consumer string) string {
-	return consumerWorkingQueueKey(queue, consumer) + "::heartbeat"
+func (keys keyScheme) consumerHeartbeatKey(queue, consumer string) string {
+	return keys.consumerWorkingQueueKey(queue, consumer) + "::heartbeat"
 }
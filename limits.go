@@ -0,0 +1,278 @@
+package redismq
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// limitPollInterval is how often consumers check for free in-flight slots
+const limitPollInterval = 100 * time.Millisecond
+
+// limits are shared by all producers and consumers of a queue, they are reloaded with every
+// heartbeat and with the layout of puts so changes made by other processes apply within a second
+type limits struct {
+	mutex          sync.Mutex
+	rate           float64
+	burst          int64
+	maxInFlight    int64
+	maxLength      int64
+	overflowPolicy OverflowPolicy
+}
+
+// SetRateLimit limits the packages handed out by Get, MultiGet and their variants to perSecond
+// across all consumers of the queue in all processes, allowing bursts of up to burst packages.
+// Consumers fetch packages first and wait for the limit afterwards, so idle consumers don't use it up.
+// The limit is stored in redis, 0 removes it.
+func (queue *Queue) SetRateLimit(perSecond float64, burst int64) error {
+	if perSecond < 0 {
+		return fmt.Errorf("rate limit must not be negative")
+	}
+	if perSecond == 0 {
+		err := queue.backend.Del(queue.keys.queueRateLimitKey(queue.Name), queue.keys.queueTokensKey(queue.Name))
+		if err != nil {
+			return err
+		}
+		return queue.loadLimits()
+	}
+	if burst < 1 {
+		burst = 1
+	}
+	err := queue.backend.Set(queue.keys.queueRateLimitKey(queue.Name), formatRateLimit(perSecond, burst), 0)
+	if err != nil {
+		return err
+	}
+	return queue.loadLimits()
+}
+
+// SetMaxInFlight limits the unacked packages of all consumers of the queue to max, consumers wait
+// for acks, requeues and fails of other consumers before getting more packages. Packages already
+// unacked when the limit is set don't count. The limit and the packages holding slots are stored
+// in redis, so slots are freed however the package is settled, reset or reclaimed. 0 removes the limit.
+func (queue *Queue) SetMaxInFlight(max int64) error {
+	if max < 0 {
+		return fmt.Errorf("in-flight limit must not be negative")
+	}
+	if max == 0 {
+		err := queue.backend.Del(
+			queue.keys.queueInFlightLimitKey(queue.Name),
+			queue.keys.queueInFlightKey(queue.Name),
+			queue.keys.queueInFlightPackagesKey(queue.Name),
+		)
+		if err != nil {
+			return err
+		}
+		return queue.loadLimits()
+	}
+	err := queue.backend.Set(queue.keys.queueInFlightLimitKey(queue.Name), strconv.FormatInt(max, 10), 0)
+	if err != nil {
+		return err
+	}
+	return queue.loadLimits()
+}
+
+// GetInFlight returns the number of packages counted against the in-flight limit
+func (queue *Queue) GetInFlight() int64 {
+	inFlight, _ := queue.backend.Get(queue.keys.queueInFlightKey(queue.Name))
+	count, _ := strconv.ParseInt(inFlight, 10, 64)
+	return count
+}
+
+// loadLimits reads the limits of the queue from redis
+func (queue *Queue) loadLimits() error {
+	values, err := queue.backend.MGet(
+		queue.keys.queueRateLimitKey(queue.Name),
+		queue.keys.queueInFlightLimitKey(queue.Name),
+		queue.keys.queueMaxLengthKey(queue.Name),
+	)
+	if err != nil {
+		return err
+	}
+	rate, burst, maxInFlight := 0.0, int64(0), int64(0)
+	maxLength, policy := int64(0), OverflowReject
+	if value, ok := values[0].(string); ok {
+		rate, burst, err = parseRateLimit(value)
+		if err != nil {
+			return err
+		}
+	}
+	if value, ok := values[1].(string); ok {
+		maxInFlight, err = strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return err
+		}
+	}
+	if value, ok := values[2].(string); ok {
+		maxLength, policy, err = parseMaxLength(value)
+		if err != nil {
+			return err
+		}
+	}
+	queue.limits.mutex.Lock()
+	queue.limits.rate, queue.limits.burst, queue.limits.maxInFlight = rate, burst, maxInFlight
+	queue.limits.maxLength, queue.limits.overflowPolicy = maxLength, policy
+	queue.limits.mutex.Unlock()
+	return nil
+}
+
+func (queue *Queue) currentLimits() (rate float64, burst, maxInFlight int64) {
+	queue.limits.mutex.Lock()
+	defer queue.limits.mutex.Unlock()
+	return queue.limits.rate, queue.limits.burst, queue.limits.maxInFlight
+}
+
+// currentMaxLength returns the bound of the input queue and its policy, 0 without bound
+func (queue *Queue) currentMaxLength() (int64, OverflowPolicy) {
+	queue.limits.mutex.Lock()
+	defer queue.limits.mutex.Unlock()
+	return queue.limits.maxLength, queue.limits.overflowPolicy
+}
+
+// acquireSlots reserves up to count in-flight packages and returns their number, all of them without limit.
+// reserved is false without limit, the packages don't hold slots then.
+func (queue *Queue) acquireSlots(count int64) (slots int64, reserved bool, err error) {
+	_, _, maxInFlight := queue.currentLimits()
+	if maxInFlight <= 0 {
+		return count, false, nil
+	}
+	slots, err = queue.backend.AcquireSlots(queue.keys.queueInFlightKey(queue.Name), maxInFlight, count)
+	return slots, true, err
+}
+
+// releaseSlots frees reserved slots that no fetched package took
+func (queue *Queue) releaseSlots(count int64) {
+	if count <= 0 {
+		return
+	}
+	err := queue.backend.ReleaseSlots(queue.keys.queueInFlightKey(queue.Name), count)
+	if err != nil {
+		log.Printf("REDISMQ FAILED TO RELEASE IN-FLIGHT PACKAGES OF %s [%s]", queue.Name, err.Error())
+	}
+}
+
+// holdSlots records the fetched packages as holders of the reserved slots and frees the slots
+// that weren't taken. Packages without ID can't hold a slot.
+func (queue *Queue) holdSlots(slots int64, packages []*Package) {
+	ids := make([]string, 0, len(packages))
+	for _, p := range packages {
+		if p.ID != "" {
+			ids = append(ids, p.ID)
+		}
+	}
+	if len(ids) > 0 {
+		_, err := queue.backend.SAdd(queue.keys.queueInFlightPackagesKey(queue.Name), ids...)
+		if err != nil {
+			// the packages can't free their slots later, they are freed right away
+			log.Printf("REDISMQ FAILED TO HOLD IN-FLIGHT PACKAGES OF %s [%s]", queue.Name, err.Error())
+			ids = nil
+		}
+	}
+	queue.releaseSlots(slots - int64(len(ids)))
+}
+
+// releasePackageSlots frees the slots held by the packages after they were acked, requeued,
+// failed, reset or reclaimed. Packages that don't hold a slot are ignored.
+func (queue *Queue) releasePackageSlots(packages ...*Package) {
+	_, _, maxInFlight := queue.currentLimits()
+	if maxInFlight <= 0 || len(packages) == 0 {
+		return
+	}
+	ids := make([]string, 0, len(packages))
+	for _, p := range packages {
+		if p.ID != "" {
+			ids = append(ids, p.ID)
+		}
+	}
+	err := queue.backend.ReleaseHeldSlots(
+		queue.keys.queueInFlightKey(queue.Name),
+		queue.keys.queueInFlightPackagesKey(queue.Name),
+		ids...,
+	)
+	if err != nil {
+		log.Printf("REDISMQ FAILED TO RELEASE IN-FLIGHT PACKAGES OF %s [%s]", queue.Name, err.Error())
+	}
+}
+
+// waitForTokens takes count packages from the rate limit and waits until they are within it.
+// Errors are logged and don't hold back fetched packages.
+func (queue *Queue) waitForTokens(count int64) {
+	rate, burst, _ := queue.currentLimits()
+	if rate <= 0 || count <= 0 {
+		return
+	}
+	wait, err := queue.backend.ReserveTokens(queue.keys.queueTokensKey(queue.Name), rate, burst, count)
+	if err != nil {
+		log.Printf("REDISMQ FAILED TO RATE LIMIT %s [%s]", queue.Name, err.Error())
+		return
+	}
+	time.Sleep(wait)
+}
+
+func formatRateLimit(rate float64, burst int64) string {
+	return strconv.FormatFloat(rate, 'f', -1, 64) + " " + strconv.FormatInt(burst, 10)
+}
+
+func parseRateLimit(value string) (rate float64, burst int64, err error) {
+	fields := strings.Fields(value)
+	if len(fields) != 2 {
+		return 0, 0, fmt.Errorf("invalid rate limit %q", value)
+	}
+	rate, err = strconv.ParseFloat(fields[0], 64)
+	if err != nil {
+		return 0, 0, err
+	}
+	burst, err = strconv.ParseInt(fields[1], 10, 64)
+	return rate, burst, err
+}
+
+// tokenBucket is the state of a rate limit, it is stored as tokens and the update time
+// in unix milliseconds separated by a space
+type tokenBucket struct {
+	tokens  float64
+	updated int64
+}
+
+func parseTokenBucket(value string) (*tokenBucket, error) {
+	fields := strings.Fields(value)
+	if len(fields) != 2 {
+		return nil, fmt.Errorf("invalid token bucket %q", value)
+	}
+	tokens, err := strconv.ParseFloat(fields[0], 64)
+	if err != nil {
+		return nil, err
+	}
+	updated, err := strconv.ParseInt(fields[1], 10, 64)
+	if err != nil {
+		return nil, err
+	}
+	return &tokenBucket{tokens: tokens, updated: updated}, nil
+}
+
+func (bucket *tokenBucket) String() string {
+	return strconv.FormatFloat(bucket.tokens, 'f', -1, 64) + " " + strconv.FormatInt(bucket.updated, 10)
+}
+
+// refill adds the tokens earned since the last update at now in unix milliseconds
+func (bucket *tokenBucket) refill(rate float64, burst, now int64) {
+	if now > bucket.updated {
+		bucket.tokens = math.Min(float64(burst), bucket.tokens+float64(now-bucket.updated)*rate/1000)
+	}
+	bucket.updated = now
+}
+
+// ttl is how long the bucket is kept, it is full again afterwards anyway
+func (bucket *tokenBucket) ttl(rate float64, burst int64) time.Duration {
+	return time.Duration((float64(burst)-bucket.tokens)/rate*float64(time.Second)) + time.Second
+}
+
+// wait returns how long to wait until the tokens taken are within the limit
+func (bucket *tokenBucket) wait(rate float64) time.Duration {
+	if bucket.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-bucket.tokens / rate * float64(time.Second))
+}
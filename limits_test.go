@@ -0,0 +1,199 @@
+package redismq
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	. "github.com/matttproud/gocheck"
+)
+
+func (suite *UnitSuite) TestTokenBucket(c *C) {
+	bucket, err := parseTokenBucket("-1.5 1000")
+	c.Assert(err, IsNil)
+	c.Check(bucket.wait(10), Equals, 150*time.Millisecond)
+	bucket.refill(10, 3, 1100)
+	c.Check(bucket.tokens, Equals, -0.5)
+	bucket.refill(10, 3, 2000)
+	c.Check(bucket.tokens, Equals, 3.0)
+	c.Check(bucket.String(), Equals, "3 2000")
+	_, err = parseTokenBucket("3")
+	c.Check(err, Not(IsNil))
+}
+
+// consumers should only get packages while fewer than the limit are unacked
+func (suite *UnitSuite) TestMaxInFlight(c *C) {
+	backend := NewMemoryBackend()
+	queue := CreateQueueWithBackend(backend, "inflight")
+	c.Check(queue.SetMaxInFlight(2), IsNil)
+	first, err := queue.AddConsumer("first")
+	c.Assert(err, IsNil)
+	defer first.Quit()
+	second, err := SelectQueueWithBackend(backend, "inflight")
+	c.Assert(err, IsNil)
+	other, err := second.AddConsumer("second")
+	c.Assert(err, IsNil)
+	defer other.Quit()
+	c.Check(queue.MultiPut("0", "1", "2", "3"), IsNil)
+
+	packages, err := first.MultiGet(5)
+	c.Assert(err, IsNil)
+	c.Assert(packages, HasLen, 2)
+	c.Check(queue.GetInFlight(), Equals, int64(2))
+	p, err := other.NoWaitGet()
+	c.Check(err, IsNil)
+	c.Check(p, IsNil)
+
+	c.Check(packages[0].MultiAck(), IsNil)
+	p, err = other.NoWaitGet()
+	c.Assert(err, IsNil)
+	c.Assert(p, NotNil)
+	c.Check(p.Payload, Equals, "2")
+	c.Check(p.Fail(), IsNil)
+
+	observer := NewObserverWithBackend(backend)
+	c.Check(observer.UpdateQueueStats("inflight"), IsNil)
+	stat := observer.Snapshot().Stats["inflight"]
+	c.Check(stat.MaxInFlight, Equals, int64(2))
+	c.Check(stat.InFlight, Equals, int64(1))
+
+	c.Check(first.ResetWorking(), IsNil)
+	c.Check(queue.GetInFlight(), Equals, int64(0))
+	c.Check(queue.SetMaxInFlight(0), IsNil)
+	packages, err = other.MultiGet(5)
+	c.Assert(err, IsNil)
+	c.Check(packages, HasLen, 1)
+}
+
+// packages beyond the burst should be handed out at the rate limit
+func (suite *UnitSuite) TestRateLimit(c *C) {
+	backend := NewMemoryBackend()
+	queue := CreateQueueWithBackend(backend, "limited")
+	c.Check(queue.SetRateLimit(-1, 0), Not(IsNil))
+	c.Check(queue.SetRateLimit(50, 2), IsNil)
+	consumer, err := queue.AddConsumer("limitedconsumer")
+	c.Assert(err, IsNil)
+	defer consumer.Quit()
+	c.Check(queue.MultiPut("0", "1", "2", "3"), IsNil)
+
+	start := time.Now()
+	packages, err := consumer.MultiGet(2)
+	c.Assert(err, IsNil)
+	c.Check(packages[1].MultiAck(), IsNil)
+	c.Check(time.Since(start) < 20*time.Millisecond, Equals, true)
+	packages, err = consumer.MultiGet(2)
+	c.Assert(err, IsNil)
+	c.Check(packages[1].MultiAck(), IsNil)
+	c.Check(time.Since(start) >= 35*time.Millisecond, Equals, true)
+
+	observer := NewObserverWithBackend(backend)
+	c.Check(observer.UpdateQueueStats("limited"), IsNil)
+	stat := observer.Snapshot().Stats["limited"]
+	c.Check(stat.RateLimit, Equals, 50.0)
+	c.Check(stat.RateBurst, Equals, int64(2))
+	c.Check(stat.RateTokens < 1, Equals, true)
+}
+
+// the limits should work the same with the scripts in redis
+func (suite *TestSuite) TestLimits(c *C) {
+	c.Check(suite.queue.SetMaxInFlight(1), IsNil)
+	c.Check(suite.queue.SetRateLimit(20, 1), IsNil)
+	c.Check(suite.queue.MultiPut("0", "1"), IsNil)
+	start := time.Now()
+	p, err := suite.consumer.Get()
+	c.Assert(err, IsNil)
+	c.Check(suite.queue.GetInFlight(), Equals, int64(1))
+	other, err := suite.queue.AddConsumer("otherconsumer")
+	c.Assert(err, IsNil)
+	defer other.Quit()
+	p2, err := other.NoWaitGet()
+	c.Check(err, IsNil)
+	c.Check(p2, IsNil)
+	c.Check(p.Ack(), IsNil)
+	c.Check(suite.queue.GetInFlight(), Equals, int64(0))
+	p, err = suite.consumer.Get()
+	c.Assert(err, IsNil)
+	c.Check(p.Payload, Equals, "1")
+	c.Check(time.Since(start) >= 45*time.Millisecond, Equals, true)
+}
+
+// packages fetched without the in-flight limit should not free slots of other packages
+func (suite *UnitSuite) TestMaxInFlightUnlimitedPackages(c *C) {
+	backend := NewMemoryBackend()
+	queue := CreateQueueWithBackend(backend, "lateinflight")
+	first, err := queue.AddConsumer("first")
+	c.Assert(err, IsNil)
+	defer first.Quit()
+	second, err := queue.AddConsumer("second")
+	c.Assert(err, IsNil)
+	defer second.Quit()
+	c.Check(queue.MultiPut("0", "1"), IsNil)
+
+	unlimited, err := first.MultiGet(1)
+	c.Assert(err, IsNil)
+	c.Assert(unlimited, HasLen, 1)
+	c.Check(queue.SetMaxInFlight(2), IsNil)
+	limited, err := second.NoWaitGet()
+	c.Assert(err, IsNil)
+	c.Assert(limited, NotNil)
+	c.Check(queue.GetInFlight(), Equals, int64(1))
+
+	c.Check(unlimited[0].MultiAck(), IsNil)
+	c.Check(queue.GetInFlight(), Equals, int64(1))
+	c.Check(limited.Ack(), IsNil)
+	c.Check(queue.GetInFlight(), Equals, int64(0))
+}
+
+// packages settled through the gateway should free their in-flight slots
+func (suite *UnitSuite) TestMaxInFlightGateway(c *C) {
+	backend := NewMemoryBackend()
+	queue := CreateQueueWithBackend(backend, "gatewayinflight")
+	c.Check(queue.SetMaxInFlight(1), IsNil)
+	c.Check(queue.MultiPut("0", "1", "2"), IsNil)
+	gateway := NewGatewayWithBackend(backend)
+	defer gateway.Close()
+
+	for _, action := range []string{"ack", "requeue", "fail"} {
+		recorder := gatewayRequest(gateway, "GET", "/queues/gatewayinflight/consumers/http/next", "")
+		c.Assert(recorder.Code, Equals, http.StatusOK)
+		var p Package
+		c.Assert(json.Unmarshal(recorder.Body.Bytes(), &p), IsNil)
+		c.Check(queue.GetInFlight(), Equals, int64(1))
+		recorder = gatewayRequest(gateway, "POST", "/queues/gatewayinflight/consumers/http/packages/"+p.ID+"/"+action, "")
+		c.Check(recorder.Code, Equals, http.StatusOK)
+		c.Check(queue.GetInFlight(), Equals, int64(0))
+	}
+}
+
+// reclaimed and reset packages of dead consumers should free their in-flight slots
+func (suite *UnitSuite) TestMaxInFlightReclaim(c *C) {
+	backend := NewMemoryBackend()
+	queue := CreateQueueWithBackend(backend, "reclaiminflight")
+	c.Check(queue.SetMaxInFlight(3), IsNil)
+	c.Check(queue.MultiPut("0", "1", "2"), IsNil)
+	dead, err := queue.AddConsumer("dead")
+	c.Assert(err, IsNil)
+	packages, err := dead.MultiGet(2)
+	c.Assert(err, IsNil)
+	c.Assert(packages, HasLen, 2)
+	dead.Quit()
+	crashed, err := queue.AddConsumer("crashed")
+	c.Assert(err, IsNil)
+	_, err = crashed.Get()
+	c.Assert(err, IsNil)
+	crashed.Quit()
+	c.Check(queue.GetInFlight(), Equals, int64(3))
+
+	reclaimed, err := queue.ReclaimConsumer("dead")
+	c.Assert(err, IsNil)
+	c.Check(reclaimed, Equals, int64(2))
+	c.Check(queue.GetInFlight(), Equals, int64(1))
+
+	restarted, err := queue.AddConsumer("crashed")
+	c.Assert(err, IsNil)
+	defer restarted.Quit()
+	c.Check(restarted.ResetWorking(), IsNil)
+	c.Check(queue.GetInFlight(), Equals, int64(0))
+	c.Check(restarted.ResetWorking(), IsNil)
+	c.Check(queue.GetInFlight(), Equals, int64(0))
+}
@@ -0,0 +1,529 @@
+package redismq
+
+import (
+	"strconv"
+	"sync"
+	"time"
+)
+
+// memorySweepInterval is how often expired values are removed from a MemoryBackend
+const memorySweepInterval = time.Minute
+
+// MemoryBackend keeps queues in the memory of the process with the same delivery semantics
+// as redis, e.g. for fast tests without a redis or for embedded use. Its queues are only shared
+// by the queues, consumers and observers using the same MemoryBackend and are lost on exit.
+type MemoryBackend struct {
+	mutex     sync.Mutex
+	lists     map[string][]string
+	sets      map[string]map[string]struct{}
+	values    map[string]*memoryValue
+	lastSweep time.Time
+	// pushed is closed and replaced whenever values are pushed to wake up blocking pops
+	pushed chan struct{}
+}
+
+type memoryValue struct {
+	value     string
+	expiresAt time.Time
+}
+
+// NewMemoryBackend returns an empty MemoryBackend
+func NewMemoryBackend() *MemoryBackend {
+	return &MemoryBackend{
+		lists:     make(map[string][]string),
+		sets:      make(map[string]map[string]struct{}),
+		values:    make(map[string]*memoryValue),
+		lastSweep: time.Now(),
+		pushed:    make(chan struct{}),
+	}
+}
+
+// lists are stored with the rightmost value first, so pushes append and pops reslice in place
+
+func (backend *MemoryBackend) lPush(key string, values ...string) {
+	if len(values) == 0 {
+		return
+	}
+	backend.lists[key] = append(backend.lists[key], values...)
+	close(backend.pushed)
+	backend.pushed = make(chan struct{})
+}
+
+func (backend *MemoryBackend) rPop(key string) (string, bool) {
+	list := backend.lists[key]
+	if len(list) == 0 {
+		return "", false
+	}
+	value := list[0]
+	backend.setList(key, list[1:])
+	return value, true
+}
+
+// setList stores the list, empty lists are removed like in redis
+func (backend *MemoryBackend) setList(key string, list []string) {
+	if len(list) == 0 {
+		delete(backend.lists, key)
+		return
+	}
+	backend.lists[key] = list
+}
+
+func (backend *MemoryBackend) rPopLPush(source, destination string) (string, error) {
+	value, ok := backend.rPop(source)
+	if !ok {
+		return "", ErrNoValue
+	}
+	backend.lPush(destination, value)
+	return value, nil
+}
+
+// span converts redis list indexes to a slice range, ok is false for empty ranges
+func span(start, stop, length int64) (from, to int64, ok bool) {
+	if start < 0 {
+		start += length
+	}
+	if stop < 0 {
+		stop += length
+	}
+	if start < 0 {
+		start = 0
+	}
+	if stop >= length {
+		stop = length - 1
+	}
+	if start > stop {
+		return 0, 0, false
+	}
+	return start, stop + 1, true
+}
+
+func (backend *MemoryBackend) LPush(key string, values ...string) error {
+	backend.mutex.Lock()
+	defer backend.mutex.Unlock()
+	backend.lPush(key, values...)
+	return nil
+}
+
+func (backend *MemoryBackend) RPop(key string) (string, error) {
+	backend.mutex.Lock()
+	defer backend.mutex.Unlock()
+	value, ok := backend.rPop(key)
+	if !ok {
+		return "", ErrNoValue
+	}
+	return value, nil
+}
+
+func (backend *MemoryBackend) RPopLPush(source, destination string) (string, error) {
+	backend.mutex.Lock()
+	defer backend.mutex.Unlock()
+	return backend.rPopLPush(source, destination)
+}
+
+func (backend *MemoryBackend) BRPopLPush(source, destination string, timeout time.Duration) (string, error) {
+	var deadline <-chan time.Time
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		deadline = timer.C
+	}
+	for {
+		backend.mutex.Lock()
+		value, err := backend.rPopLPush(source, destination)
+		pushed := backend.pushed
+		backend.mutex.Unlock()
+		if err == nil {
+			return value, nil
+		}
+		select {
+		case <-pushed:
+		case <-deadline:
+			return "", ErrNoValue
+		}
+	}
+}
+
+func (backend *MemoryBackend) RPopRPush(source, destination string) error {
+	backend.mutex.Lock()
+	defer backend.mutex.Unlock()
+	value, ok := backend.rPop(source)
+	if !ok {
+		return nil
+	}
+	backend.lists[destination] = append([]string{value}, backend.lists[destination]...)
+	close(backend.pushed)
+	backend.pushed = make(chan struct{})
+	return nil
+}
+
+func (backend *MemoryBackend) MultiRPopLPush(source, destination string, count int64) ([]string, error) {
+	backend.mutex.Lock()
+	defer backend.mutex.Unlock()
+	answers := make([]string, 0, count)
+	for int64(len(answers)) < count {
+		value, err := backend.rPopLPush(source, destination)
+		if err != nil {
+			break
+		}
+		answers = append(answers, value)
+	}
+	return answers, nil
+}
+
+func (backend *MemoryBackend) RPopLPushValue(source, destination, value string) error {
+	backend.mutex.Lock()
+	defer backend.mutex.Unlock()
+	if _, ok := backend.rPop(source); ok {
+		backend.lPush(destination, value)
+	}
+	return nil
+}
+
+func (backend *MemoryBackend) LPushBounded(key, droppedKey string, max int64, mode string, values []string) (int64, error) {
+	backend.mutex.Lock()
+	defer backend.mutex.Unlock()
+	length := int64(len(backend.lists[key]))
+	count := int64(len(values))
+	if mode != pushDrop && length+count > max {
+		if mode == pushAll || length >= max {
+			return 0, nil
+		}
+		count = max - length
+	}
+	backend.lPush(key, values[:count]...)
+	if mode == pushDrop && length+count > max {
+		list := backend.lists[key]
+		backend.lists[key] = list[int64(len(list))-max:]
+		backend.incrBy(droppedKey, length+count-max, 0)
+	}
+	return count, nil
+}
+
+func (backend *MemoryBackend) LPushEach(keys []string, values []string) error {
+	backend.mutex.Lock()
+	defer backend.mutex.Unlock()
+	for _, key := range keys {
+		backend.lPush(key, values...)
+	}
+	return nil
+}
+
+func (backend *MemoryBackend) RotateChecked(key, destination string, actions, values []string) (processed, matched int64, err error) {
+	backend.mutex.Lock()
+	defer backend.mutex.Unlock()
+	for i, value := range values {
+		list := backend.lists[key]
+		if len(list) == 0 || list[0] != value {
+			break
+		}
+		backend.rPop(key)
+		switch actions[i] {
+		case filterRequeue:
+			backend.lPush(destination, value)
+		case filterKeep:
+			backend.lPush(key, value)
+		}
+		if actions[i] != filterKeep {
+			matched++
+		}
+		processed++
+	}
+	return processed, matched, nil
+}
+
+func (backend *MemoryBackend) LLen(key string) (int64, error) {
+	backend.mutex.Lock()
+	defer backend.mutex.Unlock()
+	return int64(len(backend.lists[key])), nil
+}
+
+func (backend *MemoryBackend) LRange(key string, start, stop int64) ([]string, error) {
+	backend.mutex.Lock()
+	defer backend.mutex.Unlock()
+	list := backend.lists[key]
+	from, to, ok := span(start, stop, int64(len(list)))
+	if !ok {
+		return []string{}, nil
+	}
+	answers := make([]string, 0, to-from)
+	for i := from; i < to; i++ {
+		answers = append(answers, list[int64(len(list))-1-i])
+	}
+	return answers, nil
+}
+
+func (backend *MemoryBackend) LIndex(key string, index int64) (string, error) {
+	backend.mutex.Lock()
+	defer backend.mutex.Unlock()
+	list := backend.lists[key]
+	from, _, ok := span(index, index, int64(len(list)))
+	if !ok {
+		return "", ErrNoValue
+	}
+	return list[int64(len(list))-1-from], nil
+}
+
+func (backend *MemoryBackend) LTrim(key string, start, stop int64) error {
+	backend.mutex.Lock()
+	defer backend.mutex.Unlock()
+	list := backend.lists[key]
+	from, to, ok := span(start, stop, int64(len(list)))
+	if !ok {
+		delete(backend.lists, key)
+		return nil
+	}
+	length := int64(len(list))
+	backend.setList(key, list[length-to:length-from])
+	return nil
+}
+
+func (backend *MemoryBackend) SAdd(key string, members ...string) (int64, error) {
+	backend.mutex.Lock()
+	defer backend.mutex.Unlock()
+	set := backend.sets[key]
+	if set == nil {
+		set = make(map[string]struct{})
+		backend.sets[key] = set
+	}
+	added := int64(0)
+	for _, member := range members {
+		if _, ok := set[member]; !ok {
+			set[member] = struct{}{}
+			added++
+		}
+	}
+	return added, nil
+}
+
+func (backend *MemoryBackend) SRem(key string, members ...string) error {
+	backend.mutex.Lock()
+	defer backend.mutex.Unlock()
+	set := backend.sets[key]
+	for _, member := range members {
+		delete(set, member)
+	}
+	if len(set) == 0 {
+		delete(backend.sets, key)
+	}
+	return nil
+}
+
+func (backend *MemoryBackend) SMembers(key string) ([]string, error) {
+	backend.mutex.Lock()
+	defer backend.mutex.Unlock()
+	members := make([]string, 0, len(backend.sets[key]))
+	for member := range backend.sets[key] {
+		members = append(members, member)
+	}
+	return members, nil
+}
+
+func (backend *MemoryBackend) SIsMember(key, member string) (bool, error) {
+	backend.mutex.Lock()
+	defer backend.mutex.Unlock()
+	_, ok := backend.sets[key][member]
+	return ok, nil
+}
+
+// get returns the value unless it expired
+func (backend *MemoryBackend) get(key string) (*memoryValue, bool) {
+	value, ok := backend.values[key]
+	if !ok {
+		return nil, false
+	}
+	if !value.expiresAt.IsZero() && !time.Now().Before(value.expiresAt) {
+		delete(backend.values, key)
+		return nil, false
+	}
+	return value, true
+}
+
+// sweep removes expired values, e.g. stats that are never read again
+func (backend *MemoryBackend) sweep() {
+	now := time.Now()
+	if now.Sub(backend.lastSweep) < memorySweepInterval {
+		return
+	}
+	backend.lastSweep = now
+	for key := range backend.values {
+		backend.get(key)
+	}
+}
+
+func (backend *MemoryBackend) Get(key string) (string, error) {
+	backend.mutex.Lock()
+	defer backend.mutex.Unlock()
+	value, ok := backend.get(key)
+	if !ok {
+		return "", ErrNoValue
+	}
+	return value.value, nil
+}
+
+func (backend *MemoryBackend) MGet(keys ...string) ([]interface{}, error) {
+	backend.mutex.Lock()
+	defer backend.mutex.Unlock()
+	values := make([]interface{}, len(keys))
+	for i, key := range keys {
+		if value, ok := backend.get(key); ok {
+			values[i] = value.value
+		}
+	}
+	return values, nil
+}
+
+func (backend *MemoryBackend) Set(key, value string, expiration time.Duration) error {
+	backend.mutex.Lock()
+	defer backend.mutex.Unlock()
+	backend.sweep()
+	stored := &memoryValue{value: value}
+	if expiration > 0 {
+		stored.expiresAt = time.Now().Add(expiration)
+	}
+	backend.values[key] = stored
+	return nil
+}
+
+func (backend *MemoryBackend) incrBy(key string, value int64, expiration time.Duration) error {
+	stored, ok := backend.get(key)
+	if !ok {
+		stored = &memoryValue{value: "0"}
+		backend.values[key] = stored
+	}
+	counter, err := strconv.ParseInt(stored.value, 10, 64)
+	if err != nil {
+		return err
+	}
+	stored.value = strconv.FormatInt(counter+value, 10)
+	if expiration > 0 {
+		stored.expiresAt = time.Now().Add(expiration)
+	}
+	return nil
+}
+
+func (backend *MemoryBackend) IncrBy(key string, value int64, expiration time.Duration) error {
+	backend.mutex.Lock()
+	defer backend.mutex.Unlock()
+	backend.sweep()
+	return backend.incrBy(key, value, expiration)
+}
+
+func (backend *MemoryBackend) Exists(key string) (bool, error) {
+	backend.mutex.Lock()
+	defer backend.mutex.Unlock()
+	_, isValue := backend.get(key)
+	return isValue || len(backend.lists[key]) > 0 || len(backend.sets[key]) > 0, nil
+}
+
+func (backend *MemoryBackend) AcquireSlots(key string, max, count int64) (int64, error) {
+	backend.mutex.Lock()
+	defer backend.mutex.Unlock()
+	inFlight := int64(0)
+	if value, ok := backend.get(key); ok {
+		inFlight, _ = strconv.ParseInt(value.value, 10, 64)
+	}
+	if inFlight+count > max {
+		count = max - inFlight
+	}
+	if count <= 0 {
+		return 0, nil
+	}
+	return count, backend.incrBy(key, count, 0)
+}
+
+func (backend *MemoryBackend) ReleaseSlots(key string, count int64) error {
+	backend.mutex.Lock()
+	defer backend.mutex.Unlock()
+	value, ok := backend.get(key)
+	if !ok {
+		return nil
+	}
+	inFlight, _ := strconv.ParseInt(value.value, 10, 64)
+	if count > inFlight {
+		count = inFlight
+	}
+	return backend.incrBy(key, -count, 0)
+}
+
+func (backend *MemoryBackend) ReleaseHeldSlots(key, holders string, ids ...string) error {
+	backend.mutex.Lock()
+	defer backend.mutex.Unlock()
+	set := backend.sets[holders]
+	count := int64(0)
+	for _, id := range ids {
+		if _, ok := set[id]; ok {
+			delete(set, id)
+			count++
+		}
+	}
+	if len(set) == 0 {
+		delete(backend.sets, holders)
+	}
+	value, ok := backend.get(key)
+	if !ok {
+		return nil
+	}
+	inFlight, _ := strconv.ParseInt(value.value, 10, 64)
+	if count > inFlight {
+		count = inFlight
+	}
+	return backend.incrBy(key, -count, 0)
+}
+
+func (backend *MemoryBackend) ReserveTokens(key string, rate float64, burst, count int64) (time.Duration, error) {
+	backend.mutex.Lock()
+	defer backend.mutex.Unlock()
+	backend.sweep()
+	now := time.Now().UnixNano() / int64(time.Millisecond)
+	bucket := &tokenBucket{tokens: float64(burst), updated: now}
+	if value, ok := backend.get(key); ok {
+		stored, err := parseTokenBucket(value.value)
+		if err != nil {
+			return 0, err
+		}
+		bucket = stored
+	}
+	bucket.refill(rate, burst, now)
+	bucket.tokens -= float64(count)
+	backend.values[key] = &memoryValue{value: bucket.String(), expiresAt: time.Now().Add(bucket.ttl(rate, burst))}
+	return bucket.wait(rate), nil
+}
+
+func (backend *MemoryBackend) AcquireLease(key, owner string, ttl time.Duration) (bool, error) {
+	backend.mutex.Lock()
+	defer backend.mutex.Unlock()
+	backend.sweep()
+	if lease, ok := backend.get(key); ok && lease.value != owner {
+		return false, nil
+	}
+	backend.values[key] = &memoryValue{value: owner, expiresAt: time.Now().Add(ttl)}
+	return true, nil
+}
+
+func (backend *MemoryBackend) ReleaseLease(key, owner string) error {
+	backend.mutex.Lock()
+	defer backend.mutex.Unlock()
+	if lease, ok := backend.get(key); ok && lease.value == owner {
+		delete(backend.values, key)
+	}
+	return nil
+}
+
+func (backend *MemoryBackend) Del(keys ...string) error {
+	backend.mutex.Lock()
+	defer backend.mutex.Unlock()
+	for _, key := range keys {
+		delete(backend.lists, key)
+		delete(backend.sets, key)
+		delete(backend.values, key)
+	}
+	return nil
+}
+
+func (backend *MemoryBackend) Ping() error {
+	return nil
+}
+
+func (backend *MemoryBackend) Close() error {
+	return nil
+}
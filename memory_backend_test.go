@@ -0,0 +1,131 @@
+package redismq
+
+import (
+	"fmt"
+	"time"
+
+	. "github.com/matttproud/gocheck"
+)
+
+func (suite *UnitSuite) TestMemoryBackendLists(c *C) {
+	backend := NewMemoryBackend()
+	c.Check(backend.LPush("list", "a", "b", "c", "d"), IsNil)
+	answers, err := backend.LRange("list", -3, -2)
+	c.Assert(err, IsNil)
+	c.Check(answers, DeepEquals, []string{"c", "b"})
+	answers, err = backend.LRange("list", 5, 10)
+	c.Assert(err, IsNil)
+	c.Check(answers, HasLen, 0)
+
+	last, err := backend.LIndex("list", -1)
+	c.Check(err, IsNil)
+	c.Check(last, Equals, "a")
+	_, err = backend.LIndex("list", 4)
+	c.Check(err, Equals, ErrNoValue)
+
+	c.Check(backend.LTrim("list", 0, -2), IsNil)
+	answers, _ = backend.LRange("list", 0, -1)
+	c.Check(answers, DeepEquals, []string{"d", "c", "b"})
+
+	moved, err := backend.MultiRPopLPush("list", "other", 5)
+	c.Assert(err, IsNil)
+	c.Check(moved, DeepEquals, []string{"b", "c", "d"})
+	exists, _ := backend.Exists("list")
+	c.Check(exists, Equals, false)
+	_, err = backend.RPop("list")
+	c.Check(err, Equals, ErrNoValue)
+}
+
+func (suite *UnitSuite) TestMemoryBackendBlockingPop(c *C) {
+	backend := NewMemoryBackend()
+	start := time.Now()
+	_, err := backend.BRPopLPush("input", "working", 50*time.Millisecond)
+	c.Check(err, Equals, ErrNoValue)
+	c.Check(time.Since(start) >= 50*time.Millisecond, Equals, true)
+
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		backend.LPush("input", "late")
+	}()
+	value, err := backend.BRPopLPush("input", "working", time.Second)
+	c.Assert(err, IsNil)
+	c.Check(value, Equals, "late")
+	length, _ := backend.LLen("working")
+	c.Check(length, Equals, int64(1))
+}
+
+func (suite *UnitSuite) TestMemoryBackendExpiry(c *C) {
+	backend := NewMemoryBackend()
+	c.Check(backend.Set("heartbeat", "ping", 20*time.Millisecond), IsNil)
+	c.Check(backend.IncrBy("counter", 2, 0), IsNil)
+	c.Check(backend.IncrBy("counter", 3, 20*time.Millisecond), IsNil)
+	values, err := backend.MGet("heartbeat", "counter", "missing")
+	c.Assert(err, IsNil)
+	c.Check(values, DeepEquals, []interface{}{"ping", "5", nil})
+
+	time.Sleep(30 * time.Millisecond)
+	_, err = backend.Get("heartbeat")
+	c.Check(err, Equals, ErrNoValue)
+	_, err = backend.Get("counter")
+	c.Check(err, Equals, ErrNoValue)
+}
+
+// queues in a memory backend should deliver like queues in redis
+func (suite *UnitSuite) TestMemoryBackendQueue(c *C) {
+	backend := NewMemoryBackend()
+	queue := CreateQueueWithBackend(backend, "memory")
+	consumer, err := queue.AddConsumer("memoryconsumer")
+	c.Assert(err, IsNil)
+	defer consumer.Quit()
+	c.Check(queue.isActiveConsumer("memoryconsumer"), Equals, true)
+
+	for i := 0; i < 3; i++ {
+		c.Check(queue.Put(fmt.Sprintf("%d", i)), IsNil)
+	}
+	p, err := consumer.Get()
+	c.Assert(err, IsNil)
+	c.Check(p.Payload, Equals, "0")
+	c.Check(p.Fail(), IsNil)
+	c.Check(queue.GetFailedLength(), Equals, int64(1))
+
+	packages, err := consumer.MultiGet(5)
+	c.Assert(err, IsNil)
+	c.Assert(packages, HasLen, 2)
+	c.Check(packages[1].Payload, Equals, "2")
+	c.Check(packages[1].MultiAck(), IsNil)
+	p, err = consumer.NoWaitGet()
+	c.Check(err, IsNil)
+	c.Check(p, IsNil)
+
+	c.Check(queue.RequeueFailed(), IsNil)
+	p, err = consumer.Get()
+	c.Assert(err, IsNil)
+	c.Check(p.Payload, Equals, "0")
+	c.Check(p.Ack(), IsNil)
+
+	selected, err := SelectQueueWithBackend(backend, "memory")
+	c.Assert(err, IsNil)
+	c.Check(selected.GetInputLength(), Equals, int64(0))
+	_, err = SelectQueueWithBackend(NewMemoryBackend(), "memory")
+	c.Check(err, Not(IsNil))
+}
+
+func (suite *UnitSuite) TestMemoryBackendBounded(c *C) {
+	backend := NewMemoryBackend()
+	queue := CreateQueueWithBackend(backend, "memorybounded")
+	c.Assert(queue.SetMaxLength(2, OverflowDropOldest), IsNil)
+	c.Check(queue.MultiPut("0", "1", "2"), IsNil)
+	packages, err := queue.PeekInput(0, 5)
+	c.Assert(err, IsNil)
+	c.Assert(packages, HasLen, 2)
+	c.Check(packages[0].Payload, Equals, "1")
+
+	c.Assert(queue.SetMaxLength(2, OverflowReject), IsNil)
+	c.Check(queue.Put("3"), Equals, ErrQueueFull)
+
+	observer := NewObserverWithBackend(backend)
+	c.Check(observer.UpdateQueueStats("memorybounded"), IsNil)
+	stat := observer.Snapshot().Stats["memorybounded"]
+	c.Check(stat.InputLength, Equals, int64(2))
+	c.Check(stat.Dropped, Equals, int64(1))
+}
@@ -0,0 +1,187 @@
+package redismq
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+)
+
+// alertBuffer is the number of alerts queued per notifier before new ones are dropped
+const alertBuffer = 256
+
+// Alert is sent to notifiers when a check starts failing or recovers
+type Alert struct {
+	Check
+	// Resolved is true if the check recovered after an alert was sent for it
+	Resolved bool
+	Time     time.Time
+}
+
+// Notifier is informed about checks of the Observer's rules that trip or recover
+type Notifier interface {
+	Notify(alert *Alert) error
+}
+
+// WebhookNotifier posts every Alert as JSON to an URL
+type WebhookNotifier struct {
+	URL     string
+	Headers map[string]string
+	Client  *http.Client
+}
+
+// NewWebhookNotifier returns a WebhookNotifier with a client that times out after ten seconds
+func NewWebhookNotifier(url string) *WebhookNotifier {
+	return &WebhookNotifier{
+		URL:    url,
+		Client: &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+// Notify posts the alert and fails on responses other than 2xx
+func (notifier *WebhookNotifier) Notify(alert *Alert) error {
+	body, err := json.Marshal(alert)
+	if err != nil {
+		return err
+	}
+	request, err := http.NewRequest("POST", notifier.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type", "application/json")
+	for name, value := range notifier.Headers {
+		request.Header.Set(name, value)
+	}
+
+	client := notifier.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	response, err := client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	if response.StatusCode < 200 || response.StatusCode >= 300 {
+		return fmt.Errorf("webhook responded with %s", response.Status)
+	}
+	return nil
+}
+
+// alerter turns the checks of consecutive snapshots into alerts for one notifier.
+// A check only alerts when it trips, further trips of the same check within the cooldown are dropped.
+// Recoveries are only sent for checks that alerted before.
+type alerter struct {
+	notifier Notifier
+	cooldown time.Duration
+	states   map[string]*alertState
+	alerts   chan *Alert
+}
+
+type alertState struct {
+	queue      string
+	alerted    bool
+	lastAlert  time.Time
+	lastFailed *Check
+}
+
+func newAlerter(notifier Notifier, cooldown time.Duration) *alerter {
+	a := &alerter{
+		notifier: notifier,
+		cooldown: cooldown,
+		states:   make(map[string]*alertState),
+		alerts:   make(chan *Alert, alertBuffer),
+	}
+	go a.dispatch()
+	return a
+}
+
+// AddNotifier sends alerts for the checks of all rules to the notifier.
+// The same check alerts again at the earliest after cooldown.
+func (observer *Observer) AddNotifier(notifier Notifier, cooldown time.Duration) {
+	observer.snapshotMutex.Lock()
+	defer observer.snapshotMutex.Unlock()
+	observer.alerters = append(observer.alerters, newAlerter(notifier, cooldown))
+}
+
+// StopNotifiers removes all notifiers of the Observer and ends their background sending
+// once the alerts queued before are sent
+func (observer *Observer) StopNotifiers() {
+	observer.snapshotMutex.Lock()
+	defer observer.snapshotMutex.Unlock()
+	for _, alerter := range observer.alerters {
+		alerter.stop()
+	}
+	observer.alerters = nil
+}
+
+// update compares the checks of the snapshot with the previous ones and queues the resulting alerts
+func (a *alerter) update(snapshot *Snapshot) {
+	now := snapshot.CollectedAt
+	seen := make(map[string]bool, len(snapshot.Checks))
+	for _, check := range snapshot.Checks {
+		// checks are told apart by their rule, rules may check the same queue for the same condition
+		key := fmt.Sprintf("%d::%s::%s", check.rule, check.Queue, check.Name)
+		seen[key] = true
+		state, ok := a.states[key]
+		if !ok {
+			state = &alertState{queue: check.Queue}
+			a.states[key] = state
+		}
+
+		switch {
+		case check.Failing && !state.alerted && (state.lastAlert.IsZero() || now.Sub(state.lastAlert) >= a.cooldown):
+			state.alerted = true
+			state.lastAlert = now
+			state.lastFailed = check
+			a.send(&Alert{Check: *check, Time: now})
+		case check.Failing:
+			state.lastFailed = check
+		case state.alerted:
+			state.alerted = false
+			a.send(&Alert{Check: *check, Resolved: true, Time: now})
+		}
+	}
+
+	// checks of deleted queues or removed rules can't fail anymore,
+	// those of queues whose stats couldn't be fetched are kept until they are judged again
+	for key, state := range a.states {
+		if seen[key] {
+			continue
+		}
+		if stat, ok := snapshot.Stats[state.queue]; ok && stat.Error != "" {
+			continue
+		}
+		if state.alerted {
+			resolved := *state.lastFailed
+			resolved.Failing = false
+			resolved.Reason = ""
+			a.send(&Alert{Check: resolved, Resolved: true, Time: now})
+		}
+		delete(a.states, key)
+	}
+}
+
+func (a *alerter) send(alert *Alert) {
+	select {
+	case a.alerts <- alert:
+	default:
+		log.Printf("REDISMQ DROPPED ALERT %s FOR %s", alert.Name, alert.Queue)
+	}
+}
+
+// stop ends dispatch after the queued alerts, update must not be called afterwards
+func (a *alerter) stop() {
+	close(a.alerts)
+}
+
+func (a *alerter) dispatch() {
+	for alert := range a.alerts {
+		err := a.notifier.Notify(alert)
+		if err != nil {
+			log.Printf("REDISMQ FAILED TO SEND ALERT %s FOR %s [%s]", alert.Name, alert.Queue, err.Error())
+		}
+	}
+}
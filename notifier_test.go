@@ -0,0 +1,174 @@
+package redismq
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"time"
+
+	. "github.com/matttproud/gocheck"
+)
+
+type recordingNotifier struct {
+	alerts chan *Alert
+}
+
+func (notifier *recordingNotifier) Notify(alert *Alert) error {
+	notifier.alerts <- alert
+	return nil
+}
+
+func newRecordingAlerter(cooldown time.Duration) (*alerter, chan *Alert) {
+	notifier := &recordingNotifier{alerts: make(chan *Alert, 10)}
+	return newAlerter(notifier, cooldown), notifier.alerts
+}
+
+func receiveAlert(c *C, alerts chan *Alert) *Alert {
+	select {
+	case alert := <-alerts:
+		return alert
+	case <-time.After(time.Second):
+		c.Fatal("no alert received")
+		return nil
+	}
+}
+
+// should alert once when a check trips and once when it recovers
+func (suite *UnitSuite) TestAlerterDeduplicates(c *C) {
+	a, alerts := newRecordingAlerter(0)
+	now := time.Now()
+	failing := &Check{Name: CheckInputLength, Queue: "clicks", Failing: true, Reason: "too long"}
+
+	a.update(&Snapshot{Checks: []*Check{failing}, CollectedAt: now})
+	a.update(&Snapshot{Checks: []*Check{failing}, CollectedAt: now.Add(time.Second)})
+	a.update(&Snapshot{Checks: []*Check{{Name: CheckInputLength, Queue: "clicks"}}, CollectedAt: now.Add(2 * time.Second)})
+
+	alert := receiveAlert(c, alerts)
+	c.Check(alert.Resolved, Equals, false)
+	c.Check(alert.Reason, Equals, "too long")
+	c.Check(receiveAlert(c, alerts).Resolved, Equals, true)
+	c.Check(alerts, HasLen, 0)
+}
+
+// should not alert flapping checks again within the cooldown
+func (suite *UnitSuite) TestAlerterCooldown(c *C) {
+	a, alerts := newRecordingAlerter(time.Minute)
+	now := time.Now()
+	failing := []*Check{{Name: CheckNoConsumers, Queue: "clicks", Failing: true}}
+	passing := []*Check{{Name: CheckNoConsumers, Queue: "clicks"}}
+
+	a.update(&Snapshot{Checks: failing, CollectedAt: now})
+	a.update(&Snapshot{Checks: passing, CollectedAt: now.Add(time.Second)})
+	a.update(&Snapshot{Checks: failing, CollectedAt: now.Add(2 * time.Second)})
+	a.update(&Snapshot{Checks: failing, CollectedAt: now.Add(2 * time.Minute)})
+
+	c.Check(receiveAlert(c, alerts).Resolved, Equals, false)
+	c.Check(receiveAlert(c, alerts).Resolved, Equals, true)
+	alert := receiveAlert(c, alerts)
+	c.Check(alert.Resolved, Equals, false)
+	c.Check(alert.Time, Equals, now.Add(2*time.Minute))
+}
+
+// should resolve alerts of checks that disappeared
+func (suite *UnitSuite) TestAlerterResolvesRemovedChecks(c *C) {
+	a, alerts := newRecordingAlerter(0)
+	a.update(&Snapshot{Checks: []*Check{{Name: CheckPackageAge, Queue: "deleted", Failing: true}}, CollectedAt: time.Now()})
+	a.update(&Snapshot{CollectedAt: time.Now()})
+
+	c.Check(receiveAlert(c, alerts).Resolved, Equals, false)
+	alert := receiveAlert(c, alerts)
+	c.Check(alert.Resolved, Equals, true)
+	c.Check(alert.Queue, Equals, "deleted")
+}
+
+// should keep the alerts of queues whose stats couldn't be fetched
+func (suite *UnitSuite) TestAlerterKeepsQueuesWithErrors(c *C) {
+	a, alerts := newRecordingAlerter(time.Minute)
+	now := time.Now()
+	failing := []*Check{{Name: CheckInputLength, Queue: "clicks", Failing: true}}
+	broken := map[string]*QueueStat{"clicks": {Error: "timeout"}}
+	a.update(&Snapshot{Checks: failing, CollectedAt: now})
+	a.update(&Snapshot{Stats: broken, CollectedAt: now.Add(time.Second)})
+	a.update(&Snapshot{Checks: failing, CollectedAt: now.Add(2 * time.Second)})
+
+	c.Check(receiveAlert(c, alerts).Resolved, Equals, false)
+	time.Sleep(10 * time.Millisecond)
+	c.Check(alerts, HasLen, 0)
+}
+
+// should tell apart checks of different rules for the same queue
+func (suite *UnitSuite) TestAlerterSeparatesRules(c *C) {
+	a, alerts := newRecordingAlerter(0)
+	snapshot := &Snapshot{
+		Stats:       map[string]*QueueStat{"clicks": {InputLength: 5}},
+		CollectedAt: time.Now(),
+	}
+	snapshot.Checks = evaluateRules([]Rule{{MaxInputLength: 10}, {Queue: "clicks", MaxInputLength: 2}}, snapshot, nil)
+	a.update(snapshot)
+	a.update(snapshot)
+
+	alert := receiveAlert(c, alerts)
+	c.Check(alert.Resolved, Equals, false)
+	c.Check(alert.Reason, Matches, ".*more than 2")
+	time.Sleep(10 * time.Millisecond)
+	c.Check(alerts, HasLen, 0)
+}
+
+// should stop sending alerts once the notifiers are stopped
+func (suite *UnitSuite) TestObserverStopNotifiers(c *C) {
+	notifier := &recordingNotifier{alerts: make(chan *Alert, 10)}
+	observer := NewObserverWithBackend(NewMemoryBackend())
+	observer.AddNotifier(notifier, 0)
+	alerter := observer.alerters[0]
+	observer.StopNotifiers()
+	c.Check(observer.alerters, HasLen, 0)
+	_, open := <-alerter.alerts
+	c.Check(open, Equals, false)
+	c.Check(observer.UpdateAllStats(), IsNil)
+}
+
+// should post alerts to the webhook
+func (suite *UnitSuite) TestWebhookNotifier(c *C) {
+	received := make(chan *Alert, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		var alert Alert
+		c.Check(request.Header.Get("X-Token"), Equals, "secret")
+		c.Check(json.NewDecoder(request.Body).Decode(&alert), IsNil)
+		received <- &alert
+	}))
+	defer server.Close()
+
+	notifier := NewWebhookNotifier(server.URL)
+	notifier.Headers = map[string]string{"X-Token": "secret"}
+	c.Assert(notifier.Notify(&Alert{Check: Check{Name: CheckInputLength, Queue: "clicks", Failing: true}}), IsNil)
+	alert := <-received
+	c.Check(alert.Name, Equals, CheckInputLength)
+	c.Check(alert.Queue, Equals, "clicks")
+}
+
+// should fail on error responses of the webhook
+func (suite *UnitSuite) TestWebhookNotifierError(c *C) {
+	server := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		writer.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer server.Close()
+	c.Check(NewWebhookNotifier(server.URL).Notify(&Alert{}), ErrorMatches, "webhook responded with 500.*")
+}
+
+// should alert when the rules of the observer trip
+func (suite *TestSuite) TestObserverNotifier(c *C) {
+	notifier := &recordingNotifier{alerts: make(chan *Alert, 10)}
+	observer := NewObserver(redisHost, redisPort, redisPassword, redisDB)
+	observer.SetRules([]Rule{{Queue: "teststuff", MaxInputLength: 1}})
+	observer.AddNotifier(notifier, time.Minute)
+
+	c.Check(suite.queue.MultiPut("first", "second"), IsNil)
+	c.Assert(observer.UpdateAllStats(), IsNil)
+	alert := receiveAlert(c, notifier.alerts)
+	c.Check(alert.Name, Equals, CheckInputLength)
+	c.Check(alert.Queue, Equals, "teststuff")
+
+	c.Check(suite.queue.ResetInput(), IsNil)
+	c.Assert(observer.UpdateAllStats(), IsNil)
+	c.Check(receiveAlert(c, notifier.alerts).Resolved, Equals, true)
+}
@@ -1,26 +1,97 @@
 package redismq
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
-	"log"
+	"sort"
 	"strconv"
+	"strings"
+	"sync"
 	"time"
-
-	"gopkg.in/redis.v3"
 )
 
 // Observer is a very simple implementation of an statistics observer
 // far more complex things could be implemented with the way stats are written
 // for now it allows basic access
-// to throughput rates and queue size averaged over seconds, minutes and hours
+// to throughput rates and queue size averaged over seconds, minutes and hours.
+// Collected stats are published as immutable snapshots which are safe for concurrent reads.
 type Observer struct {
-	redisClient   *redis.Client `json:"-"`
-	redisHost     string        `json:"-"`
-	redisPort     string        `json:"-"`
-	redisPassword string        `json:"-"`
-	redisDb       int64         `json:"-"`
-	Stats         map[string]*QueueStat
+	backend Backend
+	keys    keyScheme
+
+	// Stats holds the stats of the latest Snapshot.
+	// Deprecated: it is replaced while the Observer refreshes in the background, use Snapshot.
+	Stats map[string]*QueueStat
+
+	snapshotMutex sync.RWMutex
+	snapshot      *Snapshot
+	history       []*HistoryPoint
+	rules         []Rule
+	alerters      []*alerter
+	updateMutex   sync.Mutex
+
+	refreshMutex sync.Mutex
+	stopRefresh  chan struct{}
+	refreshDone  chan struct{}
+
+	subscribersMutex sync.Mutex
+	subscribers      map[chan *Event]struct{}
+}
+
+// types of events pushed to subscribers of an Observer
+const (
+	EventSnapshot       = "snapshot"
+	EventConsumerJoined = "consumer-joined"
+	EventConsumerDied   = "consumer-died"
+	EventFailedChanged  = "failed-changed"
+)
+
+// subscriberBuffer is the number of events buffered per subscriber.
+// Events for subscribers that don't keep up are dropped.
+const subscriberBuffer = 64
+
+// Event is pushed to all subscribers of an Observer after every complete refresh.
+// Every refresh results in one EventSnapshot followed by the changes since the previous refresh.
+type Event struct {
+	Type     string
+	Queue    string    `json:",omitempty"`
+	Consumer string    `json:",omitempty"`
+	Snapshot *Snapshot `json:",omitempty"`
+
+	// FailedLength and PreviousFailedLength are set for EventFailedChanged
+	FailedLength         int64 `json:",omitempty"`
+	PreviousFailedLength int64 `json:",omitempty"`
+}
+
+// Snapshot holds the stats of all queues at one point in time.
+// Snapshots are never modified after they are published and must not be modified by callers.
+type Snapshot struct {
+	Stats       map[string]*QueueStat
+	CollectedAt time.Time
+
+	// Error is set if the list of queues could not be fetched for this snapshot
+	Error string `json:",omitempty"`
+
+	// Checks holds the results of all rules of the Observer for this snapshot
+	Checks []*Check `json:",omitempty"`
+}
+
+// historySize is the number of refreshes kept in the history of an Observer
+const historySize = 300
+
+// HistoryPoint is a condensed view of one complete refresh used to show recent trends
+type HistoryPoint struct {
+	CollectedAt time.Time
+	Queues      map[string]*QueuePoint
+}
+
+// QueuePoint holds the main figures of a queue at one point in time
+type QueuePoint struct {
+	InputLength  int64
+	FailedLength int64
+	InputRate    int64
+	WorkRate     int64
 }
 
 // QueueStat collects data about a queue
@@ -41,6 +112,53 @@ type QueueStat struct {
 	WorkRateMinute int64
 	WorkRateHour   int64
 
+	// current lengths of the input and failed queue
+	InputLength  int64
+	FailedLength int64
+	// OldestPackageAge is the age in seconds of the oldest package that would be fetched next
+	// from the input queue, its partitions or its stream
+	OldestPackageAge int64
+	// Paused is true while consumers don't get packages from the queue
+	Paused bool
+	// Dropped is the number of packages deleted from a bounded queue with OverflowDropOldest
+	Dropped int64
+
+	ConsumerStats map[string]*ConsumerStat
+	// Groups holds the stats of the consumer groups of the queue
+	Groups map[string]*GroupStat `json:",omitempty"`
+	// Partitions holds the stats of the partitions of partitioned queues, InputLength includes them
+	Partitions []*PartitionStat `json:",omitempty"`
+
+	// RateLimit and RateBurst are set by SetRateLimit, RateTokens is the number of packages
+	// that can be fetched right away, it is negative while consumers wait for the limit
+	RateLimit  float64 `json:",omitempty"`
+	RateBurst  int64   `json:",omitempty"`
+	RateTokens float64 `json:",omitempty"`
+	// MaxInFlight is set by SetMaxInFlight, InFlight is the number of packages counted against it
+	MaxInFlight int64 `json:",omitempty"`
+	InFlight    int64 `json:",omitempty"`
+
+	// Error is set if the stats of this queue could not be (fully) fetched
+	Error string `json:",omitempty"`
+}
+
+// PartitionStat collects data about a partition of a queue
+type PartitionStat struct {
+	Length int64
+	// Owner is the consumer owning the partition, empty while it isn't owned
+	Owner string
+}
+
+// GroupStat collects data about a consumer group of a queue
+type GroupStat struct {
+	// Lag is the number of packages the group hasn't fetched yet
+	Lag          int64
+	FailedLength int64
+
+	WorkRateSecond int64
+	WorkRateMinute int64
+	WorkRateHour   int64
+
 	ConsumerStats map[string]*ConsumerStat
 }
 
@@ -49,78 +167,535 @@ type ConsumerStat struct {
 	WorkRateSecond int64
 	WorkRateMinute int64
 	WorkRateHour   int64
+
+	// Active is true as long as the consumer's heartbeat is alive
+	Active        bool
+	WorkingLength int64
 }
 
 // NewObserver returns an Oberserver to monitor different statistics from redis
 func NewObserver(redisHost, redisPort, redisPassword string, redisDb int64) *Observer {
-	q := &Observer{
-		redisHost:     redisHost,
-		redisPort:     redisPort,
-		redisPassword: redisPassword,
-		redisDb:       redisDb,
-		Stats:         make(map[string]*QueueStat),
+	return NewObserverWithClient(newRedisClient(redisHost, redisPort, redisPassword, redisDb))
+}
+
+// NewObserverWithClient works like NewObserver but uses the given client, see CreateQueueWithClient
+func NewObserverWithClient(redisClient RedisClient) *Observer {
+	return NewObserverWithBackend(NewRedisBackend(redisClient))
+}
+
+// NewObserverWithBackend works like NewObserver but uses the given backend, see CreateQueueWithBackend
+func NewObserverWithBackend(backend Backend) *Observer {
+	return &Observer{
+		backend:     backend,
+		keys:        keysForBackend(backend),
+		Stats:       make(map[string]*QueueStat),
+		snapshot:    &Snapshot{Stats: make(map[string]*QueueStat)},
+		subscribers: make(map[chan *Event]struct{}),
+	}
+}
+
+// Snapshot returns the latest published stats without doing any redis work
+func (observer *Observer) Snapshot() *Snapshot {
+	observer.snapshotMutex.RLock()
+	defer observer.snapshotMutex.RUnlock()
+	return observer.snapshot
+}
+
+// History returns the condensed stats of the latest refreshes, oldest first
+func (observer *Observer) History() []*HistoryPoint {
+	observer.snapshotMutex.RLock()
+	defer observer.snapshotMutex.RUnlock()
+	history := make([]*HistoryPoint, len(observer.history))
+	copy(history, observer.history)
+	return history
+}
+
+// Subscribe returns a channel receiving the events of all following refreshes.
+// The returned function ends the subscription and has to be called once the channel isn't read anymore.
+func (observer *Observer) Subscribe() (<-chan *Event, func()) {
+	events := make(chan *Event, subscriberBuffer)
+	observer.subscribersMutex.Lock()
+	observer.subscribers[events] = struct{}{}
+	observer.subscribersMutex.Unlock()
+
+	var once sync.Once
+	return events, func() {
+		once.Do(func() {
+			observer.subscribersMutex.Lock()
+			delete(observer.subscribers, events)
+			observer.subscribersMutex.Unlock()
+		})
+	}
+}
+
+func (observer *Observer) broadcast(events []*Event) {
+	observer.subscribersMutex.Lock()
+	defer observer.subscribersMutex.Unlock()
+	for subscriber := range observer.subscribers {
+		for _, event := range events {
+			select {
+			case subscriber <- event:
+			default:
+			}
+		}
+	}
+}
+
+func (observer *Observer) publish(snapshot *Snapshot) {
+	observer.snapshotMutex.Lock()
+	previous := observer.snapshot
+	if snapshot.Error != "" {
+		observer.snapshot = snapshot
+		observer.snapshotMutex.Unlock()
+		return
+	}
+	observer.record(snapshot)
+	snapshot.Checks = evaluateRules(observer.rules, snapshot, observer.history)
+	for _, alerter := range observer.alerters {
+		alerter.update(snapshot)
+	}
+	observer.snapshot = snapshot
+	observer.Stats = snapshot.Stats
+	observer.snapshotMutex.Unlock()
+
+	observer.broadcast(snapshotEvents(previous, snapshot))
+}
+
+// snapshotEvents returns the events describing the changes between two snapshots
+func snapshotEvents(previous, current *Snapshot) []*Event {
+	events := []*Event{{Type: EventSnapshot, Snapshot: current}}
+	// without a previous refresh everything would be a change
+	if previous.CollectedAt.IsZero() {
+		return events
+	}
+
+	for queue, stat := range current.Stats {
+		last, ok := previous.Stats[queue]
+		if !ok {
+			last = &QueueStat{ConsumerStats: make(map[string]*ConsumerStat)}
+		}
+		// queues with errors are incomplete and can't be compared
+		if stat.Error != "" || last.Error != "" {
+			continue
+		}
+
+		if stat.FailedLength != last.FailedLength {
+			events = append(events, &Event{
+				Type:                 EventFailedChanged,
+				Queue:                queue,
+				FailedLength:         stat.FailedLength,
+				PreviousFailedLength: last.FailedLength,
+			})
+		}
+		for consumer, consumerStat := range stat.ConsumerStats {
+			lastConsumer, ok := last.ConsumerStats[consumer]
+			wasActive := ok && lastConsumer.Active
+			if consumerStat.Active && !wasActive {
+				events = append(events, &Event{Type: EventConsumerJoined, Queue: queue, Consumer: consumer})
+			}
+			if !consumerStat.Active && wasActive {
+				events = append(events, &Event{Type: EventConsumerDied, Queue: queue, Consumer: consumer})
+			}
+		}
+		for consumer, lastConsumer := range last.ConsumerStats {
+			if _, ok := stat.ConsumerStats[consumer]; !ok && lastConsumer.Active {
+				events = append(events, &Event{Type: EventConsumerDied, Queue: queue, Consumer: consumer})
+			}
+		}
+	}
+	return events
+}
+
+// record adds the snapshot to the history, the snapshot lock has to be held
+func (observer *Observer) record(snapshot *Snapshot) {
+	point := &HistoryPoint{CollectedAt: snapshot.CollectedAt, Queues: make(map[string]*QueuePoint, len(snapshot.Stats))}
+	for name, stat := range snapshot.Stats {
+		point.Queues[name] = &QueuePoint{
+			InputLength:  stat.InputLength,
+			FailedLength: stat.FailedLength,
+			InputRate:    stat.InputRateSecond,
+			WorkRate:     stat.WorkRateSecond,
+		}
+	}
+	observer.history = append(observer.history, point)
+	if len(observer.history) > historySize {
+		observer.history = observer.history[len(observer.history)-historySize:]
+	}
+}
+
+// Start refreshes the stats of all queues in the background every interval.
+// Each refresh has to finish within the interval. Calling Start on a running Observer restarts it.
+func (observer *Observer) Start(interval time.Duration) {
+	observer.Stop()
+
+	observer.refreshMutex.Lock()
+	defer observer.refreshMutex.Unlock()
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	observer.stopRefresh = stop
+	observer.refreshDone = done
+
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			ctx, cancel := context.WithTimeout(context.Background(), interval)
+			// errors are part of the published snapshot
+			observer.UpdateAllStatsContext(ctx)
+			cancel()
+
+			select {
+			case <-ticker.C:
+			case <-stop:
+				return
+			}
+		}
+	}()
+}
+
+// Stop ends the background refresh and waits for it to finish
+func (observer *Observer) Stop() {
+	observer.refreshMutex.Lock()
+	defer observer.refreshMutex.Unlock()
+	if observer.stopRefresh == nil {
+		return
+	}
+	close(observer.stopRefresh)
+	<-observer.refreshDone
+	observer.stopRefresh = nil
+	observer.refreshDone = nil
+}
+
+// StatsError is returned by UpdateAllStats if the stats of some queues could not be fetched.
+// The stats of all other queues are updated nonetheless.
+type StatsError struct {
+	Errors map[string]error
+}
+
+func (statsError *StatsError) Error() string {
+	queues := make([]string, 0, len(statsError.Errors))
+	for queue := range statsError.Errors {
+		queues = append(queues, queue)
+	}
+	sort.Strings(queues)
+
+	messages := make([]string, 0, len(queues))
+	for _, queue := range queues {
+		messages = append(messages, fmt.Sprintf("%s: %s", queue, statsError.Errors[queue]))
 	}
-	q.redisClient = redis.NewClient(&redis.Options{
-		Addr:     redisHost + ":" + redisPort,
-		Password: redisPassword,
-		DB:       redisDb,
-	})
-	return q
+	return "failed to fetch stats for queues [" + strings.Join(messages, ", ") + "]"
 }
 
 // UpdateAllStats fetches stats for all queues and all their consumers
-func (observer *Observer) UpdateAllStats() {
+func (observer *Observer) UpdateAllStats() error {
+	return observer.UpdateAllStatsContext(context.Background())
+}
+
+// UpdateAllStatsContext fetches stats for all queues concurrently and publishes them as a new Snapshot.
+// Queues that didn't finish before the context is done are reported with an error.
+// If only some queues failed a *StatsError is returned and all successfully fetched stats are kept.
+func (observer *Observer) UpdateAllStatsContext(ctx context.Context) error {
 	queues, err := observer.GetAllQueues()
 	if err != nil {
-		log.Fatalf("ERROR FETCHING QUEUES %s", err.Error())
+		// keep the last known stats around but mark them as stale
+		last := observer.Snapshot()
+		observer.publish(&Snapshot{Stats: last.Stats, CollectedAt: last.CollectedAt, Error: err.Error()})
+		return err
 	}
 
+	type result struct {
+		queue string
+		stat  *QueueStat
+		err   error
+	}
+	// buffered so that late results don't block after the deadline
+	results := make(chan *result, len(queues))
 	for _, queue := range queues {
-		observer.UpdateQueueStats(queue)
+		go func(queue string) {
+			stat, err := observer.fetchQueueStats(queue)
+			results <- &result{queue: queue, stat: stat, err: err}
+		}(queue)
+	}
+
+	stats := make(map[string]*QueueStat, len(queues))
+	errors := make(map[string]error)
+	for len(stats) < len(queues) {
+		select {
+		case res := <-results:
+			if res.err != nil {
+				res.stat.Error = res.err.Error()
+				errors[res.queue] = res.err
+			}
+			stats[res.queue] = res.stat
+		case <-ctx.Done():
+			for _, queue := range queues {
+				if _, ok := stats[queue]; ok {
+					continue
+				}
+				stats[queue] = &QueueStat{
+					ConsumerStats: make(map[string]*ConsumerStat),
+					Error:         ctx.Err().Error(),
+				}
+				errors[queue] = ctx.Err()
+			}
+		}
 	}
+
+	observer.publish(&Snapshot{Stats: stats, CollectedAt: time.Now()})
+	if len(errors) > 0 {
+		return &StatsError{Errors: errors}
+	}
+	return nil
 }
 
 // GetAllQueues returns a list of all registed queues
 func (observer *Observer) GetAllQueues() (queues []string, err error) {
-	return observer.redisClient.SMembers(masterQueueKey()).Result()
+	return observer.backend.SMembers(observer.keys.masterQueueKey())
 }
 
 func (observer *Observer) getConsumers(queue string) (consumers []string, err error) {
-	return observer.redisClient.SMembers(queueWorkersKey(queue)).Result()
+	return observer.backend.SMembers(observer.keys.queueWorkersKey(queue))
+}
+
+// fetchOldestPackageAge returns the age of the oldest package that would be fetched next
+// from the input list, the partitions of partitioned queues or the stream of stream queues
+func (observer *Observer) fetchOldestPackageAge(queue string, streams bool, partitions int) (int64, error) {
+	var nexts []string
+	if streams {
+		next, err := streamNext(observer.backend, observer.keys, queue)
+		if err != nil && err != ErrNoValue {
+			return 0, err
+		}
+		if err == nil {
+			nexts = append(nexts, next)
+		}
+	}
+	keys := []string{observer.keys.queueInputKey(queue)}
+	for partition := 0; partition < partitions; partition++ {
+		keys = append(keys, observer.keys.queuePartitionKey(queue, int64(partition)))
+	}
+	for _, key := range keys {
+		answer, err := observer.backend.LIndex(key, -1)
+		if err == ErrNoValue {
+			continue
+		}
+		if err != nil {
+			return 0, err
+		}
+		nexts = append(nexts, answer)
+	}
+
+	var oldest time.Time
+	for _, next := range nexts {
+		p, err := unmarshalPackage(next, nil, nil)
+		if err != nil {
+			return 0, err
+		}
+		if oldest.IsZero() || p.CreatedAt.Before(oldest) {
+			oldest = p.CreatedAt
+		}
+	}
+	if oldest.IsZero() {
+		return 0, nil
+	}
+	return int64(time.Since(oldest) / time.Second), nil
+}
+
+func (observer *Observer) isActiveConsumer(keys keyScheme, queue, consumer string) (bool, error) {
+	val, err := observer.backend.Get(keys.consumerHeartbeatKey(queue, consumer))
+	if err == ErrNoValue {
+		return false, nil
+	}
+	return val == "ping", err
+}
+
+// fetchLimitStats sets the stats of the limits of the queue
+func (observer *Observer) fetchLimitStats(queue string, queueStats *QueueStat) error {
+	values, err := observer.backend.MGet(
+		observer.keys.queueRateLimitKey(queue),
+		observer.keys.queueTokensKey(queue),
+		observer.keys.queueInFlightLimitKey(queue),
+		observer.keys.queueInFlightKey(queue),
+	)
+	if err != nil {
+		return err
+	}
+	if value, ok := values[0].(string); ok {
+		queueStats.RateLimit, queueStats.RateBurst, err = parseRateLimit(value)
+		if err != nil {
+			return err
+		}
+		queueStats.RateTokens = float64(queueStats.RateBurst)
+		if value, ok := values[1].(string); ok {
+			bucket, err := parseTokenBucket(value)
+			if err != nil {
+				return err
+			}
+			bucket.refill(queueStats.RateLimit, queueStats.RateBurst, time.Now().UnixNano()/int64(time.Millisecond))
+			queueStats.RateTokens = bucket.tokens
+		}
+	}
+	if value, ok := values[2].(string); ok {
+		queueStats.MaxInFlight, err = strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return err
+		}
+	}
+	if value, ok := values[3].(string); ok {
+		queueStats.InFlight, err = strconv.ParseInt(value, 10, 64)
+	}
+	return err
+}
+
+func (observer *Observer) fetchPartitionStats(queue string) ([]*PartitionStat, error) {
+	partitions, err := loadPartitions(observer.backend, observer.keys, queue)
+	if err != nil || partitions == 0 {
+		return nil, err
+	}
+	stats := make([]*PartitionStat, partitions)
+	for partition := range stats {
+		stat := &PartitionStat{}
+		stat.Length, err = observer.backend.LLen(observer.keys.queuePartitionKey(queue, int64(partition)))
+		if err != nil {
+			return nil, err
+		}
+		stat.Owner, err = observer.backend.Get(observer.keys.queuePartitionOwnerKey(queue, int64(partition)))
+		if err != nil && err != ErrNoValue {
+			return nil, err
+		}
+		stats[partition] = stat
+	}
+	return stats, nil
 }
 
 // UpdateQueueStats fetches stats for one specific queue and its consumers
-func (observer *Observer) UpdateQueueStats(queue string) {
-	queueStats := &QueueStat{ConsumerStats: make(map[string]*ConsumerStat)}
+// and publishes them together with the other queues of the latest Snapshot
+func (observer *Observer) UpdateQueueStats(queue string) error {
+	queueStats, err := observer.fetchQueueStats(queue)
+	if err != nil {
+		queueStats.Error = err.Error()
+	}
 
-	queueStats.InputRateSecond = observer.fetchStat(queueInputRateKey(queue), 1)
-	queueStats.InputSizeSecond = observer.fetchStat(queueInputSizeKey(queue), 1)
-	queueStats.FailSizeSecond = observer.fetchStat(queueFailedSizeKey(queue), 1)
+	// updates are serialized to not lose concurrent updates of other queues
+	observer.updateMutex.Lock()
+	defer observer.updateMutex.Unlock()
+	last := observer.Snapshot()
+	stats := make(map[string]*QueueStat, len(last.Stats)+1)
+	for name, stat := range last.Stats {
+		stats[name] = stat
+	}
+	stats[queue] = queueStats
+	observer.publish(&Snapshot{Stats: stats, CollectedAt: time.Now()})
+	return err
+}
 
-	queueStats.InputRateMinute = observer.fetchStat(queueInputRateKey(queue), 60)
-	queueStats.InputSizeMinute = observer.fetchStat(queueInputSizeKey(queue), 60)
-	queueStats.FailSizeMinute = observer.fetchStat(queueFailedSizeKey(queue), 60)
+// fetchCounter returns 0 for counters that were never incremented
+func (observer *Observer) fetchCounter(key string) (int64, error) {
+	counter, err := observer.backend.Get(key)
+	if err == ErrNoValue {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseInt(counter, 10, 64)
+}
 
-	queueStats.InputRateHour = observer.fetchStat(queueInputRateKey(queue), 3600)
-	queueStats.InputSizeHour = observer.fetchStat(queueInputSizeKey(queue), 3600)
-	queueStats.FailSizeHour = observer.fetchStat(queueFailedSizeKey(queue), 3600)
+// fetchQueueStats always returns a QueueStat holding everything that could be fetched
+func (observer *Observer) fetchQueueStats(queue string) (queueStats *QueueStat, err error) {
+	queueStats = &QueueStat{ConsumerStats: make(map[string]*ConsumerStat)}
+	// only the first error is kept, fetching stops after it
+	fetch := func(target *int64, keyName string, seconds int64) {
+		if err != nil {
+			return
+		}
+		*target, err = observer.fetchStat(keyName, seconds)
+	}
+	fetchLength := func(target *int64, key string) {
+		if err != nil {
+			return
+		}
+		*target, err = observer.backend.LLen(key)
+	}
 
-	queueStats.WorkRateSecond = 0
-	queueStats.WorkRateMinute = 0
-	queueStats.WorkRateHour = 0
+	fetchLength(&queueStats.InputLength, observer.keys.queueInputKey(queue))
+	fetchLength(&queueStats.FailedLength, observer.keys.queueFailedKey(queue))
+	if err != nil {
+		return queueStats, err
+	}
+	streams, err := observer.backend.Exists(observer.keys.queueStreamKey(queue))
+	if err != nil {
+		return queueStats, err
+	}
+	var streamWorking map[string]int64
+	if streams {
+		queueStats.InputLength, streamWorking, err = streamLengths(observer.backend, observer.keys, queue)
+		if err != nil {
+			return queueStats, err
+		}
+	}
+	queueStats.Partitions, err = observer.fetchPartitionStats(queue)
+	if err != nil {
+		return queueStats, err
+	}
+	for _, partition := range queueStats.Partitions {
+		queueStats.InputLength += partition.Length
+	}
+	queueStats.OldestPackageAge, err = observer.fetchOldestPackageAge(queue, streams, len(queueStats.Partitions))
+	if err != nil {
+		return queueStats, err
+	}
+	queueStats.Paused, err = observer.backend.Exists(observer.keys.queuePausedKey(queue))
+	if err != nil {
+		return queueStats, err
+	}
+	queueStats.Dropped, err = observer.fetchCounter(observer.keys.queueDroppedKey(queue))
+	if err != nil {
+		return queueStats, err
+	}
+	err = observer.fetchLimitStats(queue, queueStats)
+
+	fetch(&queueStats.InputRateSecond, observer.keys.queueInputRateKey(queue), 1)
+	fetch(&queueStats.InputSizeSecond, observer.keys.queueInputSizeKey(queue), 1)
+	fetch(&queueStats.FailSizeSecond, observer.keys.queueFailedSizeKey(queue), 1)
+
+	fetch(&queueStats.InputRateMinute, observer.keys.queueInputRateKey(queue), 60)
+	fetch(&queueStats.InputSizeMinute, observer.keys.queueInputSizeKey(queue), 60)
+	fetch(&queueStats.FailSizeMinute, observer.keys.queueFailedSizeKey(queue), 60)
+
+	fetch(&queueStats.InputRateHour, observer.keys.queueInputRateKey(queue), 3600)
+	fetch(&queueStats.InputSizeHour, observer.keys.queueInputSizeKey(queue), 3600)
+	fetch(&queueStats.FailSizeHour, observer.keys.queueFailedSizeKey(queue), 3600)
+	if err != nil {
+		return queueStats, err
+	}
 
 	consumers, err := observer.getConsumers(queue)
 	if err != nil {
-		log.Fatalf("ERROR FETCHING CONSUMERS for %s %s", queue, err.Error())
-		return
+		return queueStats, fmt.Errorf("fetching consumers: %s", err)
 	}
 
-	for _, consumer := range consumers {
+	fetchConsumer := func(keys keyScheme, consumer string) *ConsumerStat {
 		stat := &ConsumerStat{}
+		fetch(&stat.WorkRateSecond, keys.consumerWorkingRateKey(queue, consumer), 1)
+		fetch(&stat.WorkRateMinute, keys.consumerWorkingRateKey(queue, consumer), 60)
+		fetch(&stat.WorkRateHour, keys.consumerWorkingRateKey(queue, consumer), 3600)
+		fetchLength(&stat.WorkingLength, keys.consumerWorkingQueueKey(queue, consumer))
+		if err == nil {
+			stat.Active, err = observer.isActiveConsumer(keys, queue, consumer)
+		}
+		return stat
+	}
 
-		stat.WorkRateSecond = observer.fetchStat(consumerWorkingRateKey(queue, consumer), 1)
-		stat.WorkRateMinute = observer.fetchStat(consumerWorkingRateKey(queue, consumer), 60)
-		stat.WorkRateHour = observer.fetchStat(consumerWorkingRateKey(queue, consumer), 3600)
+	for _, consumer := range consumers {
+		stat := fetchConsumer(observer.keys, consumer)
+		if err != nil {
+			return queueStats, err
+		}
+		if streams {
+			stat.WorkingLength = streamWorking[consumer]
+		}
 
 		queueStats.WorkRateSecond += stat.WorkRateSecond
 		queueStats.WorkRateMinute += stat.WorkRateMinute
@@ -129,12 +704,44 @@ func (observer *Observer) UpdateQueueStats(queue string) {
 		queueStats.ConsumerStats[consumer] = stat
 	}
 
-	observer.Stats[queue] = queueStats
+	groups, err := observer.backend.SMembers(observer.keys.queueGroupsKey(queue))
+	if err != nil {
+		return queueStats, fmt.Errorf("fetching groups: %s", err)
+	}
+	for _, group := range groups {
+		keys := observer.keys.forGroup(group)
+		groupStats := &GroupStat{ConsumerStats: make(map[string]*ConsumerStat)}
+		fetchLength(&groupStats.Lag, keys.queueInputKey(queue))
+		fetchLength(&groupStats.FailedLength, keys.queueFailedKey(queue))
+		if err != nil {
+			return queueStats, err
+		}
+		consumers, err = observer.backend.SMembers(keys.queueWorkersKey(queue))
+		if err != nil {
+			return queueStats, fmt.Errorf("fetching consumers of group %s: %s", group, err)
+		}
+		for _, consumer := range consumers {
+			stat := fetchConsumer(keys, consumer)
+			if err != nil {
+				return queueStats, err
+			}
+			groupStats.WorkRateSecond += stat.WorkRateSecond
+			groupStats.WorkRateMinute += stat.WorkRateMinute
+			groupStats.WorkRateHour += stat.WorkRateHour
+			groupStats.ConsumerStats[consumer] = stat
+		}
+		if queueStats.Groups == nil {
+			queueStats.Groups = make(map[string]*GroupStat, len(groups))
+		}
+		queueStats.Groups[group] = groupStats
+	}
+
+	return queueStats, nil
 }
 
 // TODO the current implementation does not handle gaps for queue size
 // which appear for queues with little or no traffic
-func (observer *Observer) fetchStat(keyName string, seconds int64) int64 {
+func (observer *Observer) fetchStat(keyName string, seconds int64) (int64, error) {
 	now := time.Now().UTC().Unix() - 2 // we can only look for already written stats
 	keys := make([]string, 0)
 
@@ -143,9 +750,9 @@ func (observer *Observer) fetchStat(keyName string, seconds int64) int64 {
 		keys = append(keys, key)
 		now--
 	}
-	vals, err := observer.redisClient.MGet(keys...).Result()
+	vals, err := observer.backend.MGet(keys...)
 	if err != nil {
-		return 0
+		return 0, err
 	}
 	nilVal := 0
 	sum := int64(0)
@@ -157,14 +764,20 @@ func (observer *Observer) fetchStat(keyName string, seconds int64) int64 {
 		num, _ := strconv.ParseInt(val.(string), 10, 64)
 		sum += num
 	}
-	return sum / seconds
+	return sum / seconds, nil
 }
 
-// ToJSON renders the whole observer as a JSON string
+// ToJSON renders the latest Snapshot as a JSON string, it is empty if the Snapshot can't be marshalled
 func (observer *Observer) ToJSON() string {
-	json, err := json.Marshal(observer)
+	json, _ := observer.SnapshotJSON()
+	return json
+}
+
+// SnapshotJSON renders the latest Snapshot as a JSON string
+func (observer *Observer) SnapshotJSON() (string, error) {
+	json, err := json.Marshal(observer.Snapshot())
 	if err != nil {
-		log.Fatalf("ERROR MARSHALLING OVERSEER %s", err.Error())
+		return "", err
 	}
-	return string(json)
+	return string(json), nil
 }
@@ -0,0 +1,198 @@
+package redismq
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"time"
+
+	. "github.com/matttproud/gocheck"
+)
+
+// should fetch stats for all queues and their consumers
+func (suite *TestSuite) TestObserverUpdateAllStats(c *C) {
+	observer := NewObserver(redisHost, redisPort, redisPassword, redisDB)
+	c.Assert(observer.UpdateAllStats(), IsNil)
+
+	stat, ok := observer.Snapshot().Stats["teststuff"]
+	c.Assert(ok, Equals, true)
+	c.Check(stat.Error, Equals, "")
+	c.Check(stat.ConsumerStats["testconsumer"], NotNil)
+}
+
+// should report queues that didn't finish before the deadline
+func (suite *TestSuite) TestObserverDeadline(c *C) {
+	observer := NewObserver(redisHost, redisPort, redisPassword, redisDB)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	err := observer.UpdateAllStatsContext(ctx)
+	statsErr, ok := err.(*StatsError)
+	c.Assert(ok, Equals, true)
+	c.Check(statsErr.Errors["teststuff"], Equals, context.Canceled)
+	c.Check(observer.Snapshot().Stats["teststuff"].Error, Equals, context.Canceled.Error())
+}
+
+// should publish a new snapshot instead of modifying the old one
+func (suite *TestSuite) TestObserverSnapshotIsImmutable(c *C) {
+	observer := NewObserver(redisHost, redisPort, redisPassword, redisDB)
+	c.Assert(observer.UpdateAllStats(), IsNil)
+	first := observer.Snapshot()
+
+	c.Assert(observer.UpdateQueueStats("teststuff"), IsNil)
+	second := observer.Snapshot()
+	c.Check(second, Not(Equals), first)
+	c.Check(second.Stats["teststuff"], Not(Equals), first.Stats["teststuff"])
+}
+
+// should refresh stats in the background until stopped
+func (suite *TestSuite) TestObserverStartStop(c *C) {
+	observer := NewObserver(redisHost, redisPort, redisPassword, redisDB)
+	c.Check(observer.Snapshot().CollectedAt.IsZero(), Equals, true)
+
+	observer.Start(50 * time.Millisecond)
+	time.Sleep(200 * time.Millisecond)
+	observer.Stop()
+
+	collectedAt := observer.Snapshot().CollectedAt
+	c.Check(collectedAt.IsZero(), Equals, false)
+	time.Sleep(200 * time.Millisecond)
+	c.Check(observer.Snapshot().CollectedAt, Equals, collectedAt)
+}
+
+// should serve the latest snapshot as JSON
+func (suite *TestSuite) TestStatisticsHandler(c *C) {
+	observer := NewObserver(redisHost, redisPort, redisPassword, redisDB)
+	handler := newStatisticsHandler(observer)
+
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest("GET", "/stats", nil))
+	c.Check(recorder.Code, Equals, http.StatusServiceUnavailable)
+
+	c.Assert(observer.UpdateAllStats(), IsNil)
+	recorder = httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest("GET", "/stats", nil))
+	c.Check(recorder.Code, Equals, http.StatusOK)
+
+	var snapshot Snapshot
+	c.Assert(json.Unmarshal(recorder.Body.Bytes(), &snapshot), IsNil)
+	c.Check(snapshot.Stats["teststuff"], NotNil)
+}
+
+// should keep a bounded history of complete refreshes
+func (suite *TestSuite) TestObserverHistory(c *C) {
+	c.Check(suite.queue.Put("testpayload"), Equals, nil)
+	observer := NewObserver(redisHost, redisPort, redisPassword, redisDB)
+	c.Check(observer.History(), HasLen, 0)
+
+	for i := 0; i < historySize+2; i++ {
+		c.Assert(observer.UpdateAllStats(), IsNil)
+	}
+	history := observer.History()
+	c.Assert(history, HasLen, historySize)
+	c.Check(history[len(history)-1].Queues["teststuff"].InputLength, Equals, int64(1))
+	c.Check(observer.Snapshot().Stats["teststuff"].ConsumerStats["testconsumer"].Active, Equals, true)
+}
+
+// should serve the dashboard page
+func (suite *TestSuite) TestDashboardHandler(c *C) {
+	recorder := httptest.NewRecorder()
+	(&dashboardHandler{}).ServeHTTP(recorder, httptest.NewRequest("GET", "/dashboard", nil))
+	c.Check(recorder.Code, Equals, http.StatusOK)
+	c.Check(strings.Contains(recorder.Body.String(), "/stats/history"), Equals, true)
+}
+
+// should push snapshots and consumer changes to subscribers
+func (suite *TestSuite) TestObserverSubscribe(c *C) {
+	observer := NewObserver(redisHost, redisPort, redisPassword, redisDB)
+	events, unsubscribe := observer.Subscribe()
+	defer unsubscribe()
+
+	c.Assert(observer.UpdateAllStats(), IsNil)
+	event := <-events
+	c.Check(event.Type, Equals, EventSnapshot)
+	c.Check(event.Snapshot, Equals, observer.Snapshot())
+
+	suite.consumer.Quit()
+	c.Check(suite.queue.Put("testpayload"), Equals, nil)
+	consumer, err := suite.queue.AddConsumer("otherconsumer")
+	c.Assert(err, IsNil)
+	p, err := consumer.Get()
+	c.Assert(err, IsNil)
+	c.Check(p.Fail(), IsNil)
+
+	c.Assert(observer.UpdateAllStats(), IsNil)
+	types := make(map[string]*Event)
+	for len(events) > 0 {
+		event := <-events
+		types[event.Type+":"+event.Consumer] = event
+	}
+	c.Check(types[EventSnapshot+":"], NotNil)
+	c.Check(types[EventConsumerDied+":testconsumer"], NotNil)
+	c.Check(types[EventConsumerJoined+":otherconsumer"], NotNil)
+	c.Assert(types[EventFailedChanged+":"], NotNil)
+	c.Check(types[EventFailedChanged+":"].FailedLength, Equals, int64(1))
+}
+
+// should stream events until the client disconnects
+func (suite *TestSuite) TestStreamHandler(c *C) {
+	observer := NewObserver(redisHost, redisPort, redisPassword, redisDB)
+	c.Assert(observer.UpdateAllStats(), IsNil)
+	server := httptest.NewServer(&streamHandler{Observer: observer})
+	defer server.Close()
+
+	response, err := http.Get(server.URL)
+	c.Assert(err, IsNil)
+	defer response.Body.Close()
+	c.Check(response.Header.Get("Content-Type"), Equals, "text/event-stream")
+
+	reader := bufio.NewReader(response.Body)
+	line, err := reader.ReadString('\n')
+	c.Assert(err, IsNil)
+	c.Check(line, Equals, "event: snapshot\n")
+}
+
+// should publish updates of single queues like complete refreshes
+func (suite *UnitSuite) TestObserverUpdateQueueStatsPublishes(c *C) {
+	backend := NewMemoryBackend()
+	CreateQueueWithBackend(backend, "memoryupdated")
+	observer := NewObserverWithBackend(backend)
+	events, unsubscribe := observer.Subscribe()
+	defer unsubscribe()
+
+	c.Assert(observer.UpdateQueueStats("memoryupdated"), IsNil)
+	event := <-events
+	c.Check(event.Type, Equals, EventSnapshot)
+	c.Check(event.Snapshot.Stats["memoryupdated"], NotNil)
+	c.Check(observer.Stats["memoryupdated"], Equals, event.Snapshot.Stats["memoryupdated"])
+	rendered, err := observer.SnapshotJSON()
+	c.Check(err, IsNil)
+	c.Check(strings.Contains(rendered, "memoryupdated"), Equals, true)
+	c.Check(observer.ToJSON(), Equals, rendered)
+	c.Check(observer.History(), HasLen, 1)
+}
+
+// should respond with 200 while any queue could be fetched and 503 otherwise
+func (suite *UnitSuite) TestStatisticsHandlerErrors(c *C) {
+	observer := NewObserverWithBackend(NewMemoryBackend())
+	handler := newStatisticsHandler(observer)
+	serve := func() int {
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, httptest.NewRequest("GET", "/stats", nil))
+		return recorder.Code
+	}
+
+	observer.publish(&Snapshot{CollectedAt: time.Now(), Stats: map[string]*QueueStat{
+		"ok":     {ConsumerStats: make(map[string]*ConsumerStat)},
+		"broken": {ConsumerStats: make(map[string]*ConsumerStat), Error: "broken"},
+	}})
+	c.Check(serve(), Equals, http.StatusOK)
+
+	observer.publish(&Snapshot{CollectedAt: time.Now(), Stats: map[string]*QueueStat{
+		"broken": {ConsumerStats: make(map[string]*ConsumerStat), Error: "broken"},
+	}})
+	c.Check(serve(), Equals, http.StatusServiceUnavailable)
+}
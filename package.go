@@ -1,6 +1,8 @@
 package redismq
 
 import (
+	"crypto/rand"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"log"
@@ -9,14 +11,38 @@ import (
 
 // Package provides headers and handling functions around payloads
 type Package struct {
-	Payload    string
-	CreatedAt  time.Time
+	ID        string `json:",omitempty"`
+	Payload   string
+	CreatedAt time.Time
+	// Headers are set when putting the package, e.g. with PutWithHeaders
+	Headers map[string]string `json:",omitempty"`
+	// PartitionKey is set by PutWithKey, packages with the same key are processed in order
+	PartitionKey string `json:",omitempty"`
+	// Error is set by FailWithError
+	Error      string      `json:",omitempty"`
 	Queue      interface{} `json:"-"`
 	Consumer   *Consumer   `json:"-"`
 	Collection *[]*Package `json:"-"`
 	Acked      bool        `json:"-"`
-	//TODO add Headers or smth. when needed
-	//wellle suggested error headers for failed packages
+	// peeked packages are copies that are still in redis and can't be acked, requeued or failed
+	peeked bool
+	// streamID is the entry of packages of stream queues
+	streamID string
+}
+
+func newPackage(payload string, queue interface{}) *Package {
+	return &Package{ID: newPackageID(), CreatedAt: time.Now(), Payload: payload, Queue: queue}
+}
+
+// newPackageID returns a random ID to identify packages e.g. when acking them via HTTP
+func newPackageID() string {
+	id := make([]byte, 16)
+	_, err := rand.Read(id)
+	if err != nil {
+		log.Printf(" Queue failed to generate package id [%s]", err.Error())
+		return ""
+	}
+	return hex.EncodeToString(id)
 }
 
 func unmarshalPackage(input string, queue *Queue, consumer *Consumer) (*Package, error) {
@@ -31,7 +57,7 @@ func unmarshalPackage(input string, queue *Queue, consumer *Consumer) (*Package,
 func (pack *Package) getString() string {
 	json, err := json.Marshal(pack)
 	if err != nil {
-		log.Printf(" Queue failed to marshal content %s [%s]", pack, err.Error())
+		log.Printf(" Queue failed to marshal content %v [%s]", pack, err.Error())
 		// TODO build sensible error handling
 		return ""
 	}
@@ -53,10 +79,17 @@ func (pack *Package) index() int {
 
 // MultiAck removes all packaes from the fetched array up to and including this package
 func (pack *Package) MultiAck() (err error) {
+	if pack.peeked {
+		return fmt.Errorf("cannot MultiAck peeked package")
+	}
 	if pack.Collection == nil {
 		return fmt.Errorf("cannot MultiAck single package")
 	}
 	// TODO write in lua
+	acked := make([]*Package, 0, pack.index()+1)
+	defer func() {
+		pack.Consumer.Queue.releasePackageSlots(acked...)
+	}()
 	for i := 0; i <= pack.index(); i++ {
 		var p *Package
 		p = (*pack.Collection)[i]
@@ -70,16 +103,23 @@ func (pack *Package) MultiAck() (err error) {
 			break
 		}
 		p.Acked = true
+		acked = append(acked, p)
 	}
 	return
 }
 
 // Ack removes the packages from the queue
 func (pack *Package) Ack() error {
+	if pack.peeked {
+		return fmt.Errorf("cannot Ack peeked package")
+	}
 	if pack.Collection != nil {
 		return fmt.Errorf("cannot Ack package in multi package answer")
 	}
 	err := pack.Consumer.ackPackage(pack)
+	if err == nil {
+		pack.Consumer.Queue.releasePackageSlots(pack)
+	}
 	return err
 }
 
@@ -93,15 +133,31 @@ func (pack *Package) Fail() error {
 	return pack.reject(false)
 }
 
+// FailWithError moves a package to the failed queue storing the error message in its Error field
+func (pack *Package) FailWithError(err error) error {
+	pack.Error = err.Error()
+	return pack.reject(false)
+}
+
 func (pack *Package) reject(requeue bool) error {
+	if pack.peeked {
+		return fmt.Errorf("cannot reject peeked package")
+	}
 	if pack.Collection != nil && (*pack.Collection)[pack.index()-1].Acked == false {
 		return fmt.Errorf("cannot reject package while unacked package before it")
 	}
 
-	if !requeue {
-		err := pack.Consumer.failPackage(pack)
-		return err
+	var err error
+	switch {
+	case !requeue && pack.Error != "":
+		err = pack.Consumer.failPackageWithError(pack)
+	case !requeue:
+		err = pack.Consumer.failPackage(pack)
+	default:
+		err = pack.Consumer.requeuePackage(pack)
+	}
+	if err == nil {
+		pack.Consumer.Queue.releasePackageSlots(pack)
 	}
-	err := pack.Consumer.requeuePackage(pack)
 	return err
 }
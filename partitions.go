@@ -0,0 +1,406 @@
+package redismq
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"sort"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// partitionLeaseTTL is how long a consumer owns a partition without renewing its lease
+	partitionLeaseTTL = 2 * time.Second
+	// partitionRebalanceInterval is how often consumers check which partitions they should own
+	partitionRebalanceInterval = 500 * time.Millisecond
+	// partitionPollInterval is how often consumers look for packages in their empty partitions
+	partitionPollInterval = 100 * time.Millisecond
+)
+
+// errPartitionsUnsupported is returned by operations that only work on queues without partitions
+var errPartitionsUnsupported = errors.New("not supported by partitioned queues")
+
+// SetPartitions splits the input queue into count partitions. Packages are put into the partition
+// of their key, see PutWithKey, and every partition is owned by one active consumer at a time,
+// so packages with the same key are processed in the order they were put. Partitions are
+// rebalanced within seconds when consumers join, quit or their heartbeat dies.
+// The count is stored in redis, producers and consumers reload it within a second.
+// It can only be changed while the queue is empty. Queues bounded with SetMaxLength can't be partitioned.
+func (queue *Queue) SetPartitions(count int64) error {
+	if count <= 0 {
+		return fmt.Errorf("partitions must be positive")
+	}
+	if queue.streams {
+		return errStreamUnsupported
+	}
+	bounded, err := queue.isBounded()
+	if err != nil {
+		return err
+	}
+	if bounded {
+		return errPartitionsUnsupported
+	}
+	groups, err := queue.GetGroups()
+	if err != nil {
+		return err
+	}
+	if len(groups) > 0 {
+		return fmt.Errorf("cannot partition queue with groups")
+	}
+	current, err := loadPartitions(queue.backend, queue.keys, queue.Name)
+	if err != nil {
+		return err
+	}
+	if current != count {
+		if queue.GetInputLength() > 0 {
+			return fmt.Errorf("cannot change partitions of queue with packages")
+		}
+		err = queue.backend.Set(queue.keys.queuePartitionsKey(queue.Name), strconv.FormatInt(count, 10), 0)
+		if err != nil {
+			return err
+		}
+	}
+	atomic.StoreInt64(&queue.partitions, count)
+	queue.forgetLayout()
+	return nil
+}
+
+// GetPartitions returns the number of partitions of the queue, 0 if it isn't partitioned
+func (queue *Queue) GetPartitions() int64 {
+	return atomic.LoadInt64(&queue.partitions)
+}
+
+// reloadPartitions reads the number of partitions from redis, it may have been set by another process
+func (queue *Queue) reloadPartitions() error {
+	if queue.streams || queue.keys.group != "" {
+		return nil
+	}
+	count, err := loadPartitions(queue.backend, queue.keys, queue.Name)
+	if err != nil {
+		return err
+	}
+	atomic.StoreInt64(&queue.partitions, count)
+	return nil
+}
+
+// PutWithKey writes the payload into the input queue, in partitioned queues into the partition of key
+func (queue *Queue) PutWithKey(key, payload string) error {
+	p := newPackage(payload, queue)
+	p.PartitionKey = key
+	return queue.push(context.Background(), []*Package{p})
+}
+
+// loadPartitions returns the stored number of partitions of a queue, 0 for queues without partitions
+func loadPartitions(backend Backend, keys keyScheme, name string) (int64, error) {
+	value, err := backend.Get(keys.queuePartitionsKey(name))
+	if err == ErrNoValue {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseInt(value, 10, 64)
+}
+
+// partitionOf returns the partition of a package out of partitions, packages without key are spread
+// by their ID. The count is passed in as it may be reloaded concurrently.
+func partitionOf(p *Package, partitions int64) int64 {
+	key := p.PartitionKey
+	if key == "" {
+		key = p.ID
+	}
+	hash := fnv.New32a()
+	hash.Write([]byte(key))
+	return int64(hash.Sum32()) % partitions
+}
+
+// pushPartitions pushes the packages into their partitions keeping their order within each partition
+func (queue *Queue) pushPartitions(packages []*Package, count int64) error {
+	if maxLength, _ := queue.currentMaxLength(); maxLength > 0 {
+		return errPartitionsUnsupported
+	}
+	partitions := make(map[int64][]string)
+	for _, p := range packages {
+		partition := partitionOf(p, count)
+		partitions[partition] = append(partitions[partition], p.getString())
+	}
+	for partition, values := range partitions {
+		err := queue.backend.LPush(queue.keys.queuePartitionKey(queue.Name, partition), values...)
+		if err != nil {
+			return err
+		}
+		queue.incrRate(queue.keys.queueInputRateKey(queue.Name), int64(len(values)))
+	}
+	return nil
+}
+
+// partitionsLength returns the number of packages in all partitions
+func (queue *Queue) partitionsLength() int64 {
+	length := int64(0)
+	for partition := int64(0); partition < queue.GetPartitions(); partition++ {
+		partitionLength, _ := queue.backend.LLen(queue.keys.queuePartitionKey(queue.Name, partition))
+		length += partitionLength
+	}
+	return length
+}
+
+// partitionKeys returns the keys of all partitions and their leases
+func (queue *Queue) partitionKeys() []string {
+	keys := make([]string, 0, 2*queue.GetPartitions())
+	for partition := int64(0); partition < queue.GetPartitions(); partition++ {
+		keys = append(keys,
+			queue.keys.queuePartitionKey(queue.Name, partition),
+			queue.keys.queuePartitionOwnerKey(queue.Name, partition),
+		)
+	}
+	return keys
+}
+
+// requeueFailedPartitions moves all failed packages back to their partitions out of count
+func (queue *Queue) requeueFailedPartitions(count int64) error {
+	failedKey := queue.keys.queueFailedKey(queue.Name)
+	for l := queue.GetFailedLength(); l > 0; l-- {
+		answer, err := queue.backend.LIndex(failedKey, -1)
+		if err == ErrNoValue {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		p, err := unmarshalPackage(answer, queue, nil)
+		if err != nil {
+			return err
+		}
+		_, _, err = queue.backend.RotateChecked(
+			failedKey,
+			queue.keys.queuePartitionKey(queue.Name, partitionOf(p, count)),
+			[]string{filterRequeue},
+			[]string{answer},
+		)
+		if err != nil {
+			return err
+		}
+		queue.incrRate(queue.keys.queueInputRateKey(queue.Name), 1)
+	}
+	return nil
+}
+
+// activeConsumers returns the sorted names of the consumers of the queue with a live heartbeat
+func (queue *Queue) activeConsumers() ([]string, error) {
+	consumers, err := queue.getConsumers()
+	if err != nil || len(consumers) == 0 {
+		return nil, err
+	}
+	keys := make([]string, len(consumers))
+	for i, consumer := range consumers {
+		keys[i] = queue.keys.consumerHeartbeatKey(queue.Name, consumer)
+	}
+	heartbeats, err := queue.backend.MGet(keys...)
+	if err != nil {
+		return nil, err
+	}
+	active := make([]string, 0, len(consumers))
+	for i, heartbeat := range heartbeats {
+		if heartbeat == "ping" {
+			active = append(active, consumers[i])
+		}
+	}
+	sort.Strings(active)
+	return active, nil
+}
+
+// rebalance acquires the partitions assigned to the consumer and releases the others.
+// Partition i is assigned to the active consumer at index i modulo their number.
+// It must only be called without unacked packages so released partitions stay in order.
+func (consumer *Consumer) rebalance() error {
+	active, err := consumer.Queue.activeConsumers()
+	if err != nil {
+		return err
+	}
+	index := sort.SearchStrings(active, consumer.Name)
+	if index == len(active) || active[index] != consumer.Name {
+		// the heartbeat of the consumer might not be visible yet
+		active = append(active[:index], append([]string{consumer.Name}, active[index:]...)...)
+	}
+
+	consumer.partitionsMutex.Lock()
+	previous := make(map[int64]bool, len(consumer.ownedPartitions))
+	for _, partition := range consumer.ownedPartitions {
+		previous[partition] = true
+	}
+	consumer.partitionsMutex.Unlock()
+
+	partitions := consumer.Queue.GetPartitions()
+	owned := make([]int64, 0, partitions/int64(len(active))+1)
+	for partition := int64(0); partition < partitions; partition++ {
+		key := consumer.Queue.keys.queuePartitionOwnerKey(consumer.Queue.Name, partition)
+		if partition%int64(len(active)) != int64(index) {
+			err = consumer.Queue.backend.ReleaseLease(key, consumer.Name)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		acquired, err := consumer.Queue.backend.AcquireLease(key, consumer.Name, partitionLeaseTTL)
+		if err != nil {
+			return err
+		}
+		if !acquired {
+			continue
+		}
+		if !previous[partition] {
+			// the previous owner might have died with an unacked package of the partition
+			free, err := consumer.takeOverPartition(partition, partitions)
+			if err != nil {
+				return err
+			}
+			if !free {
+				err = consumer.Queue.backend.ReleaseLease(key, consumer.Name)
+				if err != nil {
+					return err
+				}
+				continue
+			}
+		}
+		owned = append(owned, partition)
+	}
+
+	consumer.partitionsMutex.Lock()
+	consumer.ownedPartitions = owned
+	consumer.rebalancedAt = time.Now()
+	consumer.partitionsMutex.Unlock()
+	return nil
+}
+
+// takeOverPartition moves the unacked packages of the partition that dead consumers left in their
+// working queues back in front of the partition. It returns false while an active consumer still
+// has an unacked package of the partition, the partition must not be consumed until it is acked.
+func (consumer *Consumer) takeOverPartition(partition, count int64) (bool, error) {
+	consumers, err := consumer.Queue.getConsumers()
+	if err != nil {
+		return false, err
+	}
+	partitionKey := consumer.Queue.keys.queuePartitionKey(consumer.Queue.Name, partition)
+	for _, name := range consumers {
+		if name == consumer.Name {
+			continue
+		}
+		// consumers of partitioned queues get one package at a time, it is the last of their working queue
+		workingKey := consumer.Queue.keys.consumerWorkingQueueKey(consumer.Queue.Name, name)
+		answer, err := consumer.Queue.backend.LIndex(workingKey, -1)
+		if err == ErrNoValue {
+			continue
+		}
+		if err != nil {
+			return false, err
+		}
+		p, err := unmarshalPackage(answer, consumer.Queue, nil)
+		if err != nil {
+			return false, err
+		}
+		if partitionOf(p, count) != partition {
+			continue
+		}
+		if consumer.Queue.isActiveConsumer(name) {
+			return false, nil
+		}
+		err = consumer.Queue.backend.RPopRPush(workingKey, partitionKey)
+		if err != nil {
+			return false, err
+		}
+		consumer.Queue.releasePackageSlots(p)
+	}
+	return true, nil
+}
+
+// renewLeases extends the leases of the owned partitions, it is called with every heartbeat
+// so partitions stay owned while packages take long to process
+func (consumer *Consumer) renewLeases() {
+	consumer.partitionsMutex.Lock()
+	owned := consumer.ownedPartitions
+	consumer.partitionsMutex.Unlock()
+	for _, partition := range owned {
+		consumer.Queue.backend.AcquireLease(
+			consumer.Queue.keys.queuePartitionOwnerKey(consumer.Queue.Name, partition),
+			consumer.Name,
+			partitionLeaseTTL,
+		)
+	}
+}
+
+// releaseLeases gives up all owned partitions so other consumers take them over right away
+func (consumer *Consumer) releaseLeases() {
+	consumer.partitionsMutex.Lock()
+	owned := consumer.ownedPartitions
+	consumer.ownedPartitions = nil
+	consumer.partitionsMutex.Unlock()
+	for _, partition := range owned {
+		consumer.Queue.backend.ReleaseLease(
+			consumer.Queue.keys.queuePartitionOwnerKey(consumer.Queue.Name, partition),
+			consumer.Name,
+		)
+	}
+}
+
+// popPartitions moves the next package of the owned partitions to the working queue,
+// partitions are tried in turns so none of them starves
+func (consumer *Consumer) popPartitions() (string, error) {
+	consumer.partitionsMutex.Lock()
+	due := time.Since(consumer.rebalancedAt) >= partitionRebalanceInterval
+	consumer.partitionsMutex.Unlock()
+	if due {
+		err := consumer.rebalance()
+		if err != nil {
+			return "", err
+		}
+	}
+
+	consumer.partitionsMutex.Lock()
+	owned := consumer.ownedPartitions
+	start := consumer.nextPartition
+	consumer.partitionsMutex.Unlock()
+	for i := range owned {
+		partition := owned[(start+i)%len(owned)]
+		answer, err := consumer.Queue.backend.RPopLPush(
+			consumer.Queue.keys.queuePartitionKey(consumer.Queue.Name, partition),
+			consumer.Queue.keys.consumerWorkingQueueKey(consumer.Queue.Name, consumer.Name),
+		)
+		if err == ErrNoValue {
+			continue
+		}
+		if err != nil {
+			return "", err
+		}
+		consumer.partitionsMutex.Lock()
+		consumer.nextPartition = start + i + 1
+		consumer.partitionsMutex.Unlock()
+		consumer.Queue.incrRate(
+			consumer.Queue.keys.consumerWorkingRateKey(consumer.Queue.Name, consumer.Name),
+			1,
+		)
+		return answer, nil
+	}
+	return "", ErrNoValue
+}
+
+// partitionFetchOne waits up to wait for the next package of the owned partitions, ErrNoValue if none arrived
+func (consumer *Consumer) partitionFetchOne(wait time.Duration) (*Package, error) {
+	deadline := time.Now().Add(wait)
+	for {
+		answer, err := consumer.popPartitions()
+		if err != ErrNoValue {
+			return consumer.parseAnswer(answer, err)
+		}
+		left := time.Until(deadline)
+		if left <= 0 {
+			return nil, ErrNoValue
+		}
+		if left > partitionPollInterval {
+			left = partitionPollInterval
+		}
+		time.Sleep(left)
+	}
+}
@@ -0,0 +1,184 @@
+package redismq
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	. "github.com/matttproud/gocheck"
+)
+
+// packages with the same key should be processed in order by the owner of their partition
+func (suite *UnitSuite) TestPartitions(c *C) {
+	backend := NewMemoryBackend()
+	queue := CreateQueueWithBackend(backend, "partitioned")
+	c.Check(queue.SetPartitions(0), Not(IsNil))
+	c.Check(queue.SetPartitions(4), IsNil)
+	first, err := queue.AddConsumer("first")
+	c.Assert(err, IsNil)
+	defer first.Quit()
+
+	devices := []string{"a", "b", "c", "d"}
+	for i := 0; i < 3; i++ {
+		for _, device := range devices {
+			c.Check(queue.PutWithKey(device, fmt.Sprintf("%s%d", device, i)), IsNil)
+		}
+	}
+	c.Check(queue.GetInputLength(), Equals, int64(12))
+	c.Check(queue.SetPartitions(2), Not(IsNil))
+	_, err = first.MultiGet(2)
+	c.Check(err, Equals, errPartitionsUnsupported)
+
+	seen := make(map[string][]string)
+	for i := 0; i < 12; i++ {
+		p, err := first.NoWaitGet()
+		c.Assert(err, IsNil)
+		c.Assert(p, NotNil)
+		if i == 0 {
+			c.Check(p.Requeue(), IsNil)
+			p, err = first.NoWaitGet()
+			c.Assert(err, IsNil)
+		}
+		seen[p.PartitionKey] = append(seen[p.PartitionKey], p.Payload)
+		c.Check(p.Ack(), IsNil)
+	}
+	for _, device := range devices {
+		c.Check(seen[device], DeepEquals, []string{device + "0", device + "1", device + "2"})
+	}
+
+	selected, err := SelectQueueWithBackend(backend, "partitioned")
+	c.Assert(err, IsNil)
+	c.Check(selected.GetPartitions(), Equals, int64(4))
+	second, err := selected.AddConsumer("second")
+	c.Assert(err, IsNil)
+	c.Check(second.rebalance(), IsNil)
+	c.Check(second.ownedPartitions, HasLen, 0)
+	c.Check(first.rebalance(), IsNil)
+	c.Check(first.ownedPartitions, DeepEquals, []int64{0, 2})
+	c.Check(second.rebalance(), IsNil)
+	c.Check(second.ownedPartitions, DeepEquals, []int64{1, 3})
+
+	observer := NewObserverWithBackend(backend)
+	c.Check(observer.UpdateQueueStats("partitioned"), IsNil)
+	stat := observer.Snapshot().Stats["partitioned"]
+	c.Assert(stat.Partitions, HasLen, 4)
+	c.Check(stat.Partitions[1].Owner, Equals, "second")
+
+	second.Quit()
+	c.Check(first.rebalance(), IsNil)
+	c.Check(first.ownedPartitions, DeepEquals, []int64{0, 1, 2, 3})
+}
+
+// leases should be exclusive until they expire or are released
+func (suite *TestSuite) TestPartitionLeases(c *C) {
+	backend := NewRedisBackend(suite.redisClient)
+	acquired, err := backend.AcquireLease("lease", "first", partitionLeaseTTL)
+	c.Assert(err, IsNil)
+	c.Check(acquired, Equals, true)
+	acquired, _ = backend.AcquireLease("lease", "second", partitionLeaseTTL)
+	c.Check(acquired, Equals, false)
+	c.Check(backend.ReleaseLease("lease", "second"), IsNil)
+	acquired, _ = backend.AcquireLease("lease", "first", partitionLeaseTTL)
+	c.Check(acquired, Equals, true)
+	c.Check(backend.ReleaseLease("lease", "first"), IsNil)
+	acquired, _ = backend.AcquireLease("lease", "second", partitionLeaseTTL)
+	c.Check(acquired, Equals, true)
+
+	c.Check(suite.queue.SetPartitions(2), IsNil)
+	c.Check(suite.queue.PutWithKey("device", "0"), IsNil)
+	c.Check(suite.queue.PutWithKey("device", "1"), IsNil)
+	p, err := suite.consumer.Get()
+	c.Assert(err, IsNil)
+	c.Check(p.Payload, Equals, "0")
+	c.Check(p.Fail(), IsNil)
+	c.Check(suite.queue.RequeueFailed(), IsNil)
+	c.Check(suite.queue.GetInputLength(), Equals, int64(2))
+}
+
+// the age of the oldest next package of all partitions should be reported
+func (suite *UnitSuite) TestPartitionsOldestPackageAge(c *C) {
+	backend := NewMemoryBackend()
+	queue := CreateQueueWithBackend(backend, "partitionedage")
+	c.Check(queue.SetPartitions(2), IsNil)
+	p := newPackage("old", queue)
+	p.CreatedAt = time.Now().Add(-time.Hour)
+	c.Check(queue.push(context.Background(), []*Package{p}), IsNil)
+
+	observer := NewObserverWithBackend(backend)
+	c.Check(observer.UpdateQueueStats("partitionedage"), IsNil)
+	c.Check(observer.Snapshot().Stats["partitionedage"].OldestPackageAge >= 3600, Equals, true)
+}
+
+// producers should pick up partitions set elsewhere and packages of dead consumers should stay in order
+func (suite *UnitSuite) TestPartitionsReloadAndTakeOver(c *C) {
+	backend := NewMemoryBackend()
+	producer := CreateQueueWithBackend(backend, "takeover")
+	queue := CreateQueueWithBackend(backend, "takeover")
+	c.Check(queue.SetPartitions(2), IsNil)
+	keys := make([]string, 2)
+	for i := 0; keys[0] == "" || keys[1] == ""; i++ {
+		p := newPackage("", queue)
+		p.PartitionKey = fmt.Sprintf("device-%d", i)
+		keys[partitionOf(p, 2)] = p.PartitionKey
+	}
+
+	c.Check(producer.SetMaxLength(10, OverflowReject), Equals, errPartitionsUnsupported)
+	c.Check(producer.GetPartitions(), Equals, int64(2))
+	for i := 0; i < 2; i++ {
+		c.Check(producer.PutWithKey(keys[0], fmt.Sprintf("a%d", i)), IsNil)
+		c.Check(producer.PutWithKey(keys[1], fmt.Sprintf("b%d", i)), IsNil)
+	}
+	c.Check(queue.GetInputLength(), Equals, int64(4))
+
+	dead, err := queue.AddConsumer("dead")
+	c.Assert(err, IsNil)
+	p, err := dead.NoWaitGet()
+	c.Assert(err, IsNil)
+	c.Check(p.PartitionKey, Equals, keys[0])
+	dead.Quit()
+
+	busy, err := queue.AddConsumer("busy")
+	c.Assert(err, IsNil)
+	defer busy.Quit()
+	p, err = busy.NoWaitGet()
+	c.Assert(err, IsNil)
+	c.Check(p.Payload, Equals, "a0")
+	c.Check(p.Ack(), IsNil)
+	p, err = busy.NoWaitGet()
+	c.Assert(err, IsNil)
+	c.Check(p.Payload, Equals, "b0")
+
+	other, err := queue.AddConsumer("other")
+	c.Assert(err, IsNil)
+	defer other.Quit()
+	c.Check(backend.ReleaseLease(queue.keys.queuePartitionOwnerKey("takeover", 1), "busy"), IsNil)
+	c.Check(other.rebalance(), IsNil)
+	c.Check(other.ownedPartitions, HasLen, 0)
+	c.Check(p.Ack(), IsNil)
+	c.Check(other.rebalance(), IsNil)
+	c.Check(other.ownedPartitions, DeepEquals, []int64{1})
+	p, err = other.NoWaitGet()
+	c.Assert(err, IsNil)
+	c.Check(p.Payload, Equals, "b1")
+}
+
+// migrating to the cluster layout should keep the partitions and their packages
+func (suite *TestSuite) TestPartitionsMigrateToClusterLayout(c *C) {
+	suite.consumer.Quit()
+	c.Check(suite.queue.SetPartitions(2), IsNil)
+	c.Check(suite.queue.PutWithKey("device", "0"), IsNil)
+	c.Check(suite.queue.PutWithKey("device", "1"), IsNil)
+
+	c.Check(MigrateToClusterLayout(suite.redisClient, "teststuff"), IsNil)
+	c.Check(suite.queue.GetInputLength(), Equals, int64(0))
+	clustered, err := SelectQueueWithClient(UseClusterLayout(suite.redisClient), "teststuff")
+	c.Assert(err, IsNil)
+	c.Check(clustered.GetPartitions(), Equals, int64(2))
+	c.Check(clustered.GetInputLength(), Equals, int64(2))
+	consumer, err := clustered.AddConsumer("testconsumer")
+	c.Assert(err, IsNil)
+	defer consumer.Quit()
+	p, err := consumer.Get()
+	c.Assert(err, IsNil)
+	c.Check(p.Payload, Equals, "0")
+}
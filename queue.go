@@ -1,8 +1,11 @@
 package redismq
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"strconv"
+	"sync"
 	"time"
 
 	"gopkg.in/redis.v3"
@@ -12,13 +15,48 @@ import (
 // Packages can be put into or get from the queue.
 // To read from a queue you need a consumer.
 type Queue struct {
-	redisClient    *redis.Client
+	backend        Backend
 	Name           string
+	keys           keyScheme
 	rateStatsCache map[int64]map[string]int64
 	rateStatsChan  chan (*dataPoint)
 	lastStatsWrite int64
+	// streams is true for queues stored in a redis stream, see CreateStreamQueue
+	streams bool
+	// partitions is the number of partitions of the input queue, see SetPartitions,
+	// it is reloaded while the queue is used and only accessed atomically
+	partitions int64
+	// the partitions and input keys of the groups are cached for puts, see putLayout
+	layoutMutex    sync.Mutex
+	layoutLoadedAt time.Time
+	groupKeys      []string
+	limits         *limits
+	// ownsClient is false for clients and backends passed in by the user, which are never closed
+	ownsClient bool
 }
 
+// QueueInfo describes the current state of a queue
+type QueueInfo struct {
+	Name         string
+	InputLength  int64
+	FailedLength int64
+	Paused       bool
+	Consumers    []*ConsumerInfo
+}
+
+// ConsumerInfo describes the current state of a consumer
+type ConsumerInfo struct {
+	Name          string
+	Active        bool
+	WorkingLength int64
+}
+
+// ErrConsumerNotFound is returned by ReclaimConsumer for names that were never added to the queue
+var ErrConsumerNotFound = errors.New("consumer doesn't exist")
+
+// ErrConsumerActive is returned by ReclaimConsumer while the consumer's heartbeat is alive
+var ErrConsumerActive = errors.New("consumer is active")
+
 type dataPoint struct {
 	name  string
 	value int64
@@ -28,19 +66,67 @@ type dataPoint struct {
 // CreateQueue return a queue that you can Put() or AddConsumer() to
 // Works like SelectQueue for existing queues
 func CreateQueue(redisHost, redisPort, redisPassword string, redisDB int64, name string) *Queue {
-	return newQueue(redisHost, redisPort, redisPassword, redisDB, name)
+	q := CreateQueueWithClient(newRedisClient(redisHost, redisPort, redisPassword, redisDB), name)
+	q.ownsClient = true
+	return q
+}
+
+// CreateQueueWithClient works like CreateQueue but uses the given client, which lets many queues,
+// their consumers and observers share one connection pool configured with redis.Options.
+// The client isn't closed by the queue.
+func CreateQueueWithClient(redisClient RedisClient, name string) *Queue {
+	return CreateQueueWithBackend(NewRedisBackend(redisClient), name)
+}
+
+// CreateQueueWithBackend works like CreateQueue but stores the queue in the given backend,
+// e.g. a MemoryBackend for tests or embedded use. The backend isn't closed by the queue.
+func CreateQueueWithBackend(backend Backend, name string) *Queue {
+	q := createQueue(backend, name)
+	q.startStatsWriter()
+	return q
+}
+
+// createQueue returns the queue without a stats writer, rates are written right away
+func createQueue(backend Backend, name string) *Queue {
+	q := &Queue{Name: name, backend: backend, keys: keysForBackend(backend), limits: &limits{}}
+	q.streams, _ = q.backend.Exists(q.keys.queueStreamKey(name))
+	q.reloadPartitions()
+	q.loadLimits()
+	q.migrateLegacyWorkers()
+	q.backend.SAdd(q.keys.masterQueueKey(), name)
+	return q
 }
 
 // SelectQueue returns a Queue if a queue with the name exists
 func SelectQueue(redisHost, redisPort, redisPassword string, redisDB int64, name string) (queue *Queue, err error) {
-	redisClient := redis.NewClient(&redis.Options{
-		Addr:     redisHost + ":" + redisPort,
-		Password: redisPassword,
-		DB:       redisDB,
-	})
-	defer redisClient.Close()
+	redisClient := newRedisClient(redisHost, redisPort, redisPassword, redisDB)
+	queue, err = SelectQueueWithClient(redisClient, name)
+	if err != nil {
+		redisClient.Close()
+		return nil, err
+	}
+	queue.ownsClient = true
+	return queue, nil
+}
+
+// SelectQueueWithClient works like SelectQueue but uses the given client, see CreateQueueWithClient
+func SelectQueueWithClient(redisClient RedisClient, name string) (queue *Queue, err error) {
+	return SelectQueueWithBackend(NewRedisBackend(redisClient), name)
+}
 
-	isMember, err := redisClient.SIsMember(masterQueueKey(), name).Result()
+// SelectQueueWithBackend works like SelectQueue but uses the given backend, see CreateQueueWithBackend
+func SelectQueueWithBackend(backend Backend, name string) (queue *Queue, err error) {
+	queue, err = selectQueue(backend, name)
+	if err != nil {
+		return nil, err
+	}
+	queue.startStatsWriter()
+	return queue, nil
+}
+
+// selectQueue works like SelectQueueWithBackend but returns the queue without a stats writer
+func selectQueue(backend Backend, name string) (*Queue, error) {
+	isMember, err := backend.SIsMember(keysForBackend(backend).masterQueueKey(), name)
 	if err != nil {
 		return nil, err
 	}
@@ -48,22 +134,18 @@ func SelectQueue(redisHost, redisPort, redisPassword string, redisDB int64, name
 		return nil, fmt.Errorf("queue with this name doesn't exist")
 	}
 
-	return newQueue(redisHost, redisPort, redisPassword, redisDB, name), nil
+	return createQueue(backend, name), nil
 }
 
-func newQueue(redisHost, redisPort, redisPassword string, redisDB int64, name string) *Queue {
-	q := &Queue{Name: name}
-	q.redisClient = redis.NewClient(&redis.Options{
+func newRedisClient(redisHost, redisPort, redisPassword string, redisDB int64) *redis.Client {
+	return redis.NewClient(&redis.Options{
 		Addr:     redisHost + ":" + redisPort,
 		Password: redisPassword,
 		DB:       redisDB,
 	})
-	q.redisClient.SAdd(masterQueueKey(), name)
-	q.startStatsWriter()
-	return q
 }
 
-// Delete clears all input and failed queues as well as all consumers
+// Delete clears all input and failed queues as well as all consumers and groups
 // will not proceed as long as consumers are running
 func (queue *Queue) Delete() error {
 	consumers, err := queue.getConsumers()
@@ -76,17 +158,25 @@ func (queue *Queue) Delete() error {
 			return fmt.Errorf("cannot delete queue with active consumers")
 		}
 
-		consumer, err := queue.AddConsumer(name)
+		// the consumer isn't added again, a heartbeat would outlive the deleted queue
+		consumer := &Consumer{Name: name, Queue: queue}
+		err = consumer.ResetWorking()
 		if err != nil {
 			return err
 		}
 
-		err = consumer.ResetWorking()
+		err = queue.backend.SRem(queue.keys.queueWorkersKey(queue.Name), name)
 		if err != nil {
 			return err
 		}
+	}
 
-		err = queue.redisClient.SRem(queueWorkersKey(queue.Name), name).Err()
+	groups, err := queue.GetGroups()
+	if err != nil {
+		return err
+	}
+	for _, group := range groups {
+		err = queue.RemoveGroup(group)
 		if err != nil {
 			return err
 		}
@@ -102,68 +192,344 @@ func (queue *Queue) Delete() error {
 		return err
 	}
 
-	err = queue.redisClient.SRem(masterQueueKey(), queue.Name).Err()
+	err = queue.backend.SRem(queue.keys.masterQueueKey(), queue.Name)
 	if err != nil {
 		return err
 	}
-	err = queue.redisClient.Del(queueWorkersKey(queue.Name)).Err()
+	err = queue.backend.Del(
+		queue.keys.queueWorkersKey(queue.Name),
+		queue.keys.queuePausedKey(queue.Name),
+		queue.keys.queueDroppedKey(queue.Name),
+		queue.keys.queueStreamKey(queue.Name),
+		queue.keys.queuePartitionsKey(queue.Name),
+		queue.keys.queueRateLimitKey(queue.Name),
+		queue.keys.queueTokensKey(queue.Name),
+		queue.keys.queueInFlightKey(queue.Name),
+		queue.keys.queueInFlightPackagesKey(queue.Name),
+		queue.keys.queueInFlightLimitKey(queue.Name),
+		queue.keys.queueMaxLengthKey(queue.Name),
+	)
 	if err != nil {
 		return err
 	}
 
-	queue.redisClient.Close()
+	if queue.ownsClient {
+		queue.backend.Close()
+	}
 
 	return nil
 }
 
 // Put writes the payload into the input queue
 func (queue *Queue) Put(payload string) error {
-	p := &Package{CreatedAt: time.Now(), Payload: payload, Queue: queue}
-	lpush := queue.redisClient.LPush(queueInputKey(queue.Name), p.getString())
-	queue.incrRate(queueInputRateKey(queue.Name), 1)
-	return lpush.Err()
+	return queue.PutContext(context.Background(), payload)
+}
+
+// PutContext writes the payload into the input queue,
+// a bounded queue with OverflowBlock waits for space at most until the context is done
+func (queue *Queue) PutContext(ctx context.Context, payload string) error {
+	return queue.push(ctx, []*Package{newPackage(payload, queue)})
+}
+
+// PutWithHeaders writes the payload with headers into the input queue,
+// they can be read from the Headers of the package and used to filter failed packages
+func (queue *Queue) PutWithHeaders(payload string, headers map[string]string) error {
+	p := newPackage(payload, queue)
+	p.Headers = headers
+	return queue.push(context.Background(), []*Package{p})
+}
+
+// MultiPut writes all payloads into the input queue in one operation keeping their order
+func (queue *Queue) MultiPut(payloads ...string) error {
+	_, err := queue.putPackages(payloads)
+	return err
+}
+
+func (queue *Queue) putPackages(payloads []string) ([]*Package, error) {
+	if len(payloads) == 0 {
+		return nil, nil
+	}
+	packages := make([]*Package, len(payloads))
+	for i, payload := range payloads {
+		packages[i] = newPackage(payload, queue)
+	}
+	err := queue.push(context.Background(), packages)
+	if err != nil {
+		return nil, err
+	}
+	return packages, nil
 }
 
 // RequeueFailed moves all failed packages back to the input queue
 func (queue *Queue) RequeueFailed() error {
+	if queue.streams {
+		return queue.streamRequeueFailed()
+	}
+	if partitions := queue.GetPartitions(); partitions > 0 {
+		return queue.requeueFailedPartitions(partitions)
+	}
 	l := queue.GetFailedLength()
 	// TODO implement this in lua
 	for l > 0 {
-		err := queue.redisClient.RPopLPush(queueFailedKey(queue.Name), queueInputKey(queue.Name)).Err()
+		_, err := queue.backend.RPopLPush(queue.keys.queueFailedKey(queue.Name), queue.keys.queueInputKey(queue.Name))
 		if err != nil {
 			return err
 		}
-		queue.incrRate(queueInputRateKey(queue.Name), 1)
+		queue.incrRate(queue.keys.queueInputRateKey(queue.Name), 1)
 		l--
 	}
 	return nil
 }
 
+// Pause stops consumers from getting packages until Resume is called, Put still works.
+// Blocking gets notice the pause within a second and wait, NoWaitGet returns no package.
+func (queue *Queue) Pause() error {
+	return queue.backend.Set(queue.keys.queuePausedKey(queue.Name), "paused", 0)
+}
+
+// Resume lets consumers get packages again after Pause
+func (queue *Queue) Resume() error {
+	return queue.backend.Del(queue.keys.queuePausedKey(queue.Name))
+}
+
+// IsPaused returns true while the queue is paused
+func (queue *Queue) IsPaused() (bool, error) {
+	return queue.backend.Exists(queue.keys.queuePausedKey(queue.Name))
+}
+
 // ResetInput deletes all packages from the input queue
 func (queue *Queue) ResetInput() error {
-	return queue.redisClient.Del(queueInputKey(queue.Name)).Err()
+	if queue.streams {
+		return queue.streamResetInput()
+	}
+	if queue.GetPartitions() > 0 {
+		return queue.backend.Del(append(queue.partitionKeys(), queue.keys.queueInputKey(queue.Name))...)
+	}
+	return queue.backend.Del(queue.keys.queueInputKey(queue.Name))
 }
 
 // ResetFailed deletes all packages from the failed queue
 func (queue *Queue) ResetFailed() error {
-	return queue.redisClient.Del(queueFailedKey(queue.Name)).Err()
+	return queue.backend.Del(queue.keys.queueFailedKey(queue.Name))
 }
 
 // GetInputLength returns the number of packages in the input queue
 func (queue *Queue) GetInputLength() int64 {
-	return queue.redisClient.LLen(queueInputKey(queue.Name)).Val()
+	if queue.streams {
+		length, _, _ := streamLengths(queue.backend, queue.keys, queue.Name)
+		return length
+	}
+	length, _ := queue.backend.LLen(queue.keys.queueInputKey(queue.Name))
+	if queue.GetPartitions() > 0 {
+		length += queue.partitionsLength()
+	}
+	return length
 }
 
 // GetFailedLength returns the number of packages in the failed queue
 func (queue *Queue) GetFailedLength() int64 {
-	return queue.redisClient.LLen(queueFailedKey(queue.Name)).Val()
+	length, _ := queue.backend.LLen(queue.keys.queueFailedKey(queue.Name))
+	return length
+}
+
+// PeekInput returns up to limit packages from the input queue without removing them,
+// starting at offset with the package that would be fetched next. Peeked packages can't be acked.
+func (queue *Queue) PeekInput(offset, limit int64) ([]*Package, error) {
+	if queue.streams {
+		return nil, errStreamUnsupported
+	}
+	if queue.GetPartitions() > 0 {
+		return nil, errPartitionsUnsupported
+	}
+	return queue.peekPackages(queue.keys.queueInputKey(queue.Name), offset, limit)
+}
+
+// PeekFailed returns up to limit packages from the failed queue without removing them,
+// starting at offset with the package that would be fetched next. Peeked packages can't be acked.
+func (queue *Queue) PeekFailed(offset, limit int64) ([]*Package, error) {
+	return queue.peekPackages(queue.keys.queueFailedKey(queue.Name), offset, limit)
+}
+
+// tailWindow is the number of the newest packages looked at per poll by Tail
+const tailWindow = 1000
+
+// Tail calls handler with every package put into the input queue until the context is done.
+// It polls every interval without removing packages, so packages that are consumed before
+// the next poll or more than tailWindow puts per poll are missed.
+func (queue *Queue) Tail(ctx context.Context, interval time.Duration, handler func(*Package)) error {
+	if queue.streams {
+		return errStreamUnsupported
+	}
+	if queue.GetPartitions() > 0 {
+		return errPartitionsUnsupported
+	}
+	// only packages newer than the current newest one are reported
+	last, err := queue.backend.LIndex(queue.keys.queueInputKey(queue.Name), 0)
+	if err != nil && err != ErrNoValue {
+		return err
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+
+		answers, err := queue.backend.LRange(queue.keys.queueInputKey(queue.Name), 0, tailWindow-1)
+		if err != nil {
+			return err
+		}
+		// if the last seen package is gone all older ones are consumed as well
+		fresh := answers
+		for i, answer := range answers {
+			if answer == last {
+				fresh = answers[:i]
+				break
+			}
+		}
+		for i := len(fresh) - 1; i >= 0; i-- {
+			p, err := unmarshalPackage(fresh[i], queue, nil)
+			if err != nil {
+				return err
+			}
+			p.peeked = true
+			handler(p)
+		}
+		if len(answers) > 0 {
+			last = answers[0]
+		}
+	}
+}
+
+// peekPackages returns up to limit packages of a list without removing them,
+// starting with the package that would be fetched next
+func (queue *Queue) peekPackages(key string, offset, limit int64) ([]*Package, error) {
+	if offset < 0 || limit < 0 {
+		return nil, fmt.Errorf("offset and limit must not be negative")
+	}
+	packages := make([]*Package, 0, limit)
+	if limit == 0 {
+		return packages, nil
+	}
+	// packages are fetched from the right end of the list
+	answers, err := queue.backend.LRange(key, -(offset + limit), -(offset + 1))
+	if err != nil {
+		return nil, err
+	}
+	for i := len(answers) - 1; i >= 0; i-- {
+		p, err := unmarshalPackage(answers[i], queue, nil)
+		if err != nil {
+			return nil, err
+		}
+		p.peeked = true
+		packages = append(packages, p)
+	}
+	return packages, nil
+}
+
+// Info returns the lengths of the queue and the state of all its consumers
+func (queue *Queue) Info() (*QueueInfo, error) {
+	names, err := queue.getConsumers()
+	if err != nil {
+		return nil, err
+	}
+	paused, err := queue.IsPaused()
+	if err != nil {
+		return nil, err
+	}
+	info := &QueueInfo{
+		Name:         queue.Name,
+		InputLength:  queue.GetInputLength(),
+		FailedLength: queue.GetFailedLength(),
+		Paused:       paused,
+		Consumers:    make([]*ConsumerInfo, 0, len(names)),
+	}
+	var streamWorking map[string]int64
+	if queue.streams {
+		_, streamWorking, err = streamLengths(queue.backend, queue.keys, queue.Name)
+		if err != nil {
+			return nil, err
+		}
+	}
+	for _, name := range names {
+		workingLength, _ := queue.backend.LLen(queue.keys.consumerWorkingQueueKey(queue.Name, name))
+		if queue.streams {
+			workingLength = streamWorking[name]
+		}
+		info.Consumers = append(info.Consumers, &ConsumerInfo{
+			Name:          name,
+			Active:        queue.isActiveConsumer(name),
+			WorkingLength: workingLength,
+		})
+	}
+	return info, nil
+}
+
+// HasActiveConsumers returns true if any consumer of the queue has a live heartbeat
+func (queue *Queue) HasActiveConsumers() (bool, error) {
+	consumers, err := queue.getConsumers()
+	if err != nil {
+		return false, err
+	}
+	for _, name := range consumers {
+		if queue.isActiveConsumer(name) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// ReclaimConsumer moves all unacked packages of a consumer back to input and returns their number.
+// It fails with ErrConsumerNotFound for unknown consumers and ErrConsumerActive if the consumer is still active.
+func (queue *Queue) ReclaimConsumer(name string) (int64, error) {
+	isMember, err := queue.backend.SIsMember(queue.keys.queueWorkersKey(queue.Name), name)
+	if err != nil {
+		return 0, err
+	}
+	if !isMember {
+		return 0, ErrConsumerNotFound
+	}
+	if queue.isActiveConsumer(name) {
+		return 0, ErrConsumerActive
+	}
+	// the consumer isn't added again, it has no heartbeat and leaves the consumers untouched
+	consumer := &Consumer{Name: name, Queue: queue}
+
+	reclaimed := consumer.GetUnackedLength()
+	return reclaimed, consumer.RequeueWorking()
+}
+
+// migrateLegacyWorkers moves the consumers that older versions registered under the key
+// without prefix to the workers key of the default namespace
+func (queue *Queue) migrateLegacyWorkers() error {
+	if queue.keys.cluster || queue.keys.namespace != "" || queue.keys.group != "" {
+		return nil
+	}
+	legacyKey := legacyWorkersKey(queue.Name)
+	consumers, err := queue.backend.SMembers(legacyKey)
+	if err != nil || len(consumers) == 0 {
+		return err
+	}
+	_, err = queue.backend.SAdd(queue.keys.queueWorkersKey(queue.Name), consumers...)
+	if err != nil {
+		return err
+	}
+	return queue.backend.SRem(legacyKey, consumers...)
 }
 
 func (queue *Queue) getConsumers() (consumers []string, err error) {
-	return queue.redisClient.SMembers(queueWorkersKey(queue.Name)).Result()
+	return queue.backend.SMembers(queue.keys.queueWorkersKey(queue.Name))
 }
 
 func (queue *Queue) incrRate(name string, value int64) {
+	if queue.rateStatsChan == nil {
+		key := fmt.Sprintf("%s::%d", name, time.Now().UTC().Unix())
+		queue.backend.IncrBy(key, value, 2*time.Hour)
+		return
+	}
 	dp := &dataPoint{name: name, value: value}
 	queue.rateStatsChan <- dp
 }
@@ -198,15 +564,14 @@ func (queue *Queue) writeStatsCacheToRedis(now int64) {
 		for name, value := range queue.rateStatsCache[sec] {
 			key := fmt.Sprintf("%s::%d", name, sec)
 			// incrby can handle the situation where multiple inputs are counted
-			queue.redisClient.IncrBy(key, value)
-			// save stats to redis with 2h expiration
-			queue.redisClient.Expire(key, 2*time.Hour)
+			// save stats with 2h expiration
+			queue.backend.IncrBy(key, value, 2*time.Hour)
 		}
 		// track queue lengths
-		inputKey := fmt.Sprintf("%s::%d", queueInputSizeKey(queue.Name), now)
-		failKey := fmt.Sprintf("%s::%d", queueFailedSizeKey(queue.Name), now)
-		queue.redisClient.Set(inputKey, strconv.FormatInt(queue.GetInputLength(), 10), 2*time.Hour)
-		queue.redisClient.Set(failKey, strconv.FormatInt(queue.GetFailedLength(), 10), 2*time.Hour)
+		inputKey := fmt.Sprintf("%s::%d", queue.keys.queueInputSizeKey(queue.Name), now)
+		failKey := fmt.Sprintf("%s::%d", queue.keys.queueFailedSizeKey(queue.Name), now)
+		queue.backend.Set(inputKey, strconv.FormatInt(queue.GetInputLength(), 10), 2*time.Hour)
+		queue.backend.Set(failKey, strconv.FormatInt(queue.GetFailedLength(), 10), 2*time.Hour)
 
 		delete(queue.rateStatsCache, sec)
 	}
@@ -217,7 +582,7 @@ func (queue *Queue) writeStatsCacheToRedis(now int64) {
 func (queue *Queue) AddConsumer(name string) (c *Consumer, err error) {
 	c = &Consumer{Name: name, Queue: queue}
 	//check uniqueness and start heartbeat
-	added, err := queue.redisClient.SAdd(queueWorkersKey(queue.Name), name).Result()
+	added, err := queue.backend.SAdd(queue.keys.queueWorkersKey(queue.Name), name)
 	if err != nil {
 		return nil, err
 	}
@@ -231,6 +596,6 @@ func (queue *Queue) AddConsumer(name string) (c *Consumer, err error) {
 }
 
 func (queue *Queue) isActiveConsumer(name string) bool {
-	val := queue.redisClient.Get(consumerHeartbeatKey(queue.Name, name)).Val()
+	val, _ := queue.backend.Get(queue.keys.consumerHeartbeatKey(queue.Name, name))
 	return val == "ping"
 }
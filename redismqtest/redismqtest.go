@@ -0,0 +1,134 @@
+// Package redismqtest helps applications test their queue handlers without a redis.
+// Queues are kept in a redismq.MemoryBackend, which delivers packages like redis does.
+package redismqtest
+
+import (
+	"fmt"
+
+	"github.com/adjust/redismq"
+)
+
+// T is the part of *testing.T used to report failures, *gocheck.C works as well
+type T interface {
+	Errorf(format string, args ...interface{})
+	Fatalf(format string, args ...interface{})
+}
+
+// NewQueue returns an empty queue stored in its own MemoryBackend.
+// Use redismq.CreateQueueWithBackend to let several queues share one backend.
+func NewQueue(name string) *redismq.Queue {
+	return redismq.CreateQueueWithBackend(redismq.NewMemoryBackend(), name)
+}
+
+// AssertPut checks that a package with the payload was put into the input queue and returns it.
+// All given headers have to be set on the package, further headers are ignored.
+func AssertPut(t T, queue *redismq.Queue, payload string, headers map[string]string) *redismq.Package {
+	packages := inputPackages(t, queue)
+	for _, p := range packages {
+		if p.Payload == payload && hasHeaders(p, headers) {
+			return p
+		}
+	}
+	t.Errorf("no package with payload %q and headers %v in %s, found %s", payload, headers, queue.Name, describe(packages))
+	return nil
+}
+
+// AssertPayloads checks that the input queue holds exactly the payloads in the order they would be fetched
+func AssertPayloads(t T, queue *redismq.Queue, payloads ...string) {
+	packages := inputPackages(t, queue)
+	if len(packages) != len(payloads) {
+		t.Errorf("expected %d packages in %s, found %s", len(payloads), queue.Name, describe(packages))
+		return
+	}
+	for i, p := range packages {
+		if p.Payload != payloads[i] {
+			t.Errorf("expected payload %q at position %d of %s, found %s", payloads[i], i, queue.Name, describe(packages))
+			return
+		}
+	}
+}
+
+// RunConsumer lets handler process the packages of the input queue one by one with the consumer name
+// until the queue is empty and returns their number. Packages that the handler didn't ack, requeue or fail
+// are acked if it returned nil and failed with the error otherwise, as a typical consumer loop would.
+// Requeued packages are processed again.
+func RunConsumer(t T, queue *redismq.Queue, name string, handler func(*redismq.Package) error) int {
+	consumer, err := queue.AddConsumer(name)
+	if err != nil {
+		t.Fatalf("adding consumer %s: %s", name, err)
+		return 0
+	}
+	defer consumer.Quit()
+
+	processed := 0
+	for {
+		p, err := consumer.NoWaitGet()
+		if err != nil {
+			t.Fatalf("getting package: %s", err)
+			return processed
+		}
+		if p == nil {
+			return processed
+		}
+		processed++
+		handlerErr := handler(p)
+		if !consumer.HasUnacked() {
+			continue
+		}
+		if handlerErr != nil {
+			err = p.FailWithError(handlerErr)
+		} else {
+			err = p.Ack()
+		}
+		if err != nil {
+			t.Fatalf("finishing package %s: %s", p.ID, err)
+			return processed
+		}
+	}
+}
+
+// CrashConsumer fetches up to count packages with the consumer name and stops its heartbeat without
+// acking them, like a consumer process that died. The packages stay in its stale working queue and
+// can be reclaimed with Queue.ReclaimConsumer or picked up by a new consumer with the same name.
+func CrashConsumer(t T, queue *redismq.Queue, name string, count int) []*redismq.Package {
+	if queue.GetInputLength() == 0 {
+		t.Fatalf("no packages in %s to crash with", queue.Name)
+		return nil
+	}
+	consumer, err := queue.AddConsumer(name)
+	if err != nil {
+		t.Fatalf("adding consumer %s: %s", name, err)
+		return nil
+	}
+	packages, err := consumer.MultiGet(count)
+	consumer.Quit()
+	if err != nil {
+		t.Fatalf("getting packages: %s", err)
+	}
+	return packages
+}
+
+func inputPackages(t T, queue *redismq.Queue) []*redismq.Package {
+	packages, err := queue.PeekInput(0, queue.GetInputLength())
+	if err != nil {
+		t.Fatalf("peeking %s: %s", queue.Name, err)
+	}
+	return packages
+}
+
+func hasHeaders(p *redismq.Package, headers map[string]string) bool {
+	for name, value := range headers {
+		if header, ok := p.Headers[name]; !ok || header != value {
+			return false
+		}
+	}
+	return true
+}
+
+func describe(packages []*redismq.Package) string {
+	payloads := make([]string, len(packages))
+	for i, p := range packages {
+		payloads[i] = p.Payload
+	}
+	return fmt.Sprintf("%d packages %q", len(packages), payloads)
+}
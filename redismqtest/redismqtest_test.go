@@ -0,0 +1,86 @@
+package redismqtest
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/adjust/redismq"
+	. "github.com/matttproud/gocheck"
+)
+
+func Test(t *testing.T) { TestingT(t) }
+
+type HelperSuite struct{}
+
+var _ = Suite(&HelperSuite{})
+
+// recorder collects failures instead of failing the test
+type recorder struct {
+	failures []string
+}
+
+func (r *recorder) Errorf(format string, args ...interface{}) {
+	r.failures = append(r.failures, fmt.Sprintf(format, args...))
+}
+
+func (r *recorder) Fatalf(format string, args ...interface{}) {
+	r.Errorf(format, args...)
+}
+
+func (suite *HelperSuite) TestAssertPut(c *C) {
+	queue := NewQueue("clicks")
+	c.Assert(queue.PutWithHeaders("first", map[string]string{"customer": "42", "source": "web"}), IsNil)
+	c.Assert(queue.Put("second"), IsNil)
+
+	r := &recorder{}
+	p := AssertPut(r, queue, "first", map[string]string{"customer": "42"})
+	c.Check(r.failures, HasLen, 0)
+	c.Assert(p, NotNil)
+	c.Check(p.Headers["source"], Equals, "web")
+	AssertPayloads(r, queue, "first", "second")
+	c.Check(r.failures, HasLen, 0)
+
+	c.Check(AssertPut(r, queue, "first", map[string]string{"customer": "7"}), IsNil)
+	AssertPayloads(r, queue, "second", "first")
+	c.Check(r.failures, HasLen, 2)
+}
+
+func (suite *HelperSuite) TestRunConsumer(c *C) {
+	queue := NewQueue("clicks")
+	c.Assert(queue.MultiPut("ok", "broken", "acked"), IsNil)
+
+	var seen []string
+	processed := RunConsumer(c, queue, "worker", func(p *redismq.Package) error {
+		seen = append(seen, p.Payload)
+		switch p.Payload {
+		case "broken":
+			return fmt.Errorf("cannot handle")
+		case "acked":
+			return p.Ack()
+		}
+		return nil
+	})
+	c.Check(processed, Equals, 3)
+	c.Check(seen, DeepEquals, []string{"ok", "broken", "acked"})
+	c.Check(queue.GetInputLength(), Equals, int64(0))
+	failed, err := queue.PeekFailed(0, 10)
+	c.Assert(err, IsNil)
+	c.Assert(failed, HasLen, 1)
+	c.Check(failed[0].Error, Equals, "cannot handle")
+}
+
+func (suite *HelperSuite) TestCrashConsumer(c *C) {
+	queue := NewQueue("clicks")
+	c.Assert(queue.MultiPut("1", "2", "3"), IsNil)
+
+	packages := CrashConsumer(c, queue, "worker", 2)
+	c.Assert(packages, HasLen, 2)
+	active, err := queue.HasActiveConsumers()
+	c.Assert(err, IsNil)
+	c.Check(active, Equals, false)
+
+	reclaimed, err := queue.ReclaimConsumer("worker")
+	c.Assert(err, IsNil)
+	c.Check(reclaimed, Equals, int64(2))
+	AssertPayloads(c, queue, "3", "1", "2")
+}
@@ -0,0 +1,46 @@
+package redismq
+
+import (
+	"io"
+	"net"
+	"strings"
+	"time"
+
+	"gopkg.in/redis.v3"
+)
+
+// failoverTimeout is how long blocking gets retry connection errors before returning them,
+// sentinels usually promote a new master well within it
+const failoverTimeout = 30 * time.Second
+
+// NewSentinelClient returns a client that asks the sentinels for the current master of masterName
+// and follows failovers. Pass it to CreateQueueWithClient, NewObserverWithClient and the like.
+func NewSentinelClient(masterName string, sentinelAddrs []string, redisPassword string, redisDB int64) *redis.Client {
+	return redis.NewFailoverClient(&redis.FailoverOptions{
+		MasterName:    masterName,
+		SentinelAddrs: sentinelAddrs,
+		Password:      redisPassword,
+		DB:            redisDB,
+	})
+}
+
+// isRetryableError returns true for errors that occur while the master is down or replaced,
+// the next command reconnects to the master known to the sentinels
+func isRetryableError(err error) bool {
+	if err == nil || err == redis.Nil {
+		return false
+	}
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return true
+	}
+	if _, ok := err.(net.Error); ok {
+		return true
+	}
+	message := err.Error()
+	for _, prefix := range []string{"READONLY", "LOADING", "MASTERDOWN"} {
+		if strings.HasPrefix(message, prefix) {
+			return true
+		}
+	}
+	return false
+}
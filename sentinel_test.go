@@ -0,0 +1,177 @@
+package redismq
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	. "github.com/matttproud/gocheck"
+)
+
+// fakeSentinel is a local stand-in for redis sentinel that answers the commands of failover clients
+type fakeSentinel struct {
+	listener net.Listener
+
+	mutex      sync.Mutex
+	masterAddr string
+}
+
+func startFakeSentinel(c *C, masterAddr string) *fakeSentinel {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	c.Assert(err, IsNil)
+	sentinel := &fakeSentinel{listener: listener, masterAddr: masterAddr}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go sentinel.serve(conn)
+		}
+	}()
+	return sentinel
+}
+
+func (sentinel *fakeSentinel) Addr() string {
+	return sentinel.listener.Addr().String()
+}
+
+func (sentinel *fakeSentinel) Close() {
+	sentinel.listener.Close()
+}
+
+func (sentinel *fakeSentinel) setMaster(addr string) {
+	sentinel.mutex.Lock()
+	sentinel.masterAddr = addr
+	sentinel.mutex.Unlock()
+}
+
+func (sentinel *fakeSentinel) serve(conn net.Conn) {
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	for {
+		args, err := readCommand(reader)
+		if err != nil {
+			return
+		}
+		switch strings.ToLower(args[0]) {
+		case "sentinel":
+			if len(args) > 1 && strings.ToLower(args[1]) == "get-master-addr-by-name" {
+				sentinel.mutex.Lock()
+				host, port, _ := net.SplitHostPort(sentinel.masterAddr)
+				sentinel.mutex.Unlock()
+				fmt.Fprintf(conn, "*2\r\n$%d\r\n%s\r\n$%d\r\n%s\r\n", len(host), host, len(port), port)
+			} else {
+				io.WriteString(conn, "*0\r\n")
+			}
+		case "subscribe", "psubscribe":
+			kind := strings.ToLower(args[0])
+			for i, channel := range args[1:] {
+				fmt.Fprintf(conn, "*3\r\n$%d\r\n%s\r\n$%d\r\n%s\r\n:%d\r\n", len(kind), kind, len(channel), channel, i+1)
+			}
+		case "ping":
+			io.WriteString(conn, "+PONG\r\n")
+		default:
+			io.WriteString(conn, "-ERR unknown command\r\n")
+		}
+	}
+}
+
+// readCommand reads a command sent as an array of bulk strings
+func readCommand(reader *bufio.Reader) ([]string, error) {
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasPrefix(line, "*") {
+		return nil, fmt.Errorf("unexpected %q", line)
+	}
+	count, err := strconv.Atoi(strings.TrimSpace(line[1:]))
+	if err != nil || count < 1 {
+		return nil, fmt.Errorf("unexpected %q", line)
+	}
+	args := make([]string, count)
+	for i := range args {
+		line, err = reader.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		length, err := strconv.Atoi(strings.TrimSpace(strings.TrimPrefix(line, "$")))
+		if err != nil {
+			return nil, err
+		}
+		data := make([]byte, length+2)
+		_, err = io.ReadFull(reader, data)
+		if err != nil {
+			return nil, err
+		}
+		args[i] = string(data[:length])
+	}
+	return args, nil
+}
+
+// should find the master through the sentinels
+func (suite *TestSuite) TestSentinelClient(c *C) {
+	sentinel := startFakeSentinel(c, redisHost+":"+redisPort)
+	defer sentinel.Close()
+	client := NewSentinelClient("mymaster", []string{sentinel.Addr()}, redisPassword, redisDB)
+	defer client.Close()
+
+	queue := CreateQueueWithClient(client, "testsentinel")
+	consumer, err := queue.AddConsumer("testconsumer")
+	c.Assert(err, IsNil)
+	defer consumer.Quit()
+	c.Check(queue.Put("testpayload"), IsNil)
+	p, err := consumer.Get()
+	c.Assert(err, IsNil)
+	c.Check(p.Payload, Equals, "testpayload")
+	c.Check(p.Ack(), IsNil)
+
+	observer := NewObserverWithClient(client)
+	c.Check(observer.UpdateQueueStats("testsentinel"), IsNil)
+}
+
+// should keep blocking gets waiting while the master is unreachable
+func (suite *TestSuite) TestSentinelFailover(c *C) {
+	unused, err := net.Listen("tcp", "127.0.0.1:0")
+	c.Assert(err, IsNil)
+	deadAddr := unused.Addr().String()
+	unused.Close()
+
+	sentinel := startFakeSentinel(c, deadAddr)
+	defer sentinel.Close()
+	client := NewSentinelClient("mymaster", []string{sentinel.Addr()}, redisPassword, redisDB)
+	defer client.Close()
+
+	// AddConsumer needs a master, the consumer doesn't need a heartbeat here
+	consumer := &Consumer{Name: "failoverconsumer", Queue: CreateQueueWithClient(client, "teststuff")}
+	got := make(chan *Package, 1)
+	go func() {
+		p, err := consumer.GetTimeout(10 * time.Second)
+		if err != nil {
+			p = nil
+		}
+		got <- p
+	}()
+
+	time.Sleep(1500 * time.Millisecond)
+	sentinel.setMaster(redisHost + ":" + redisPort)
+	c.Check(suite.queue.Put("testpayload"), IsNil)
+	p := <-got
+	c.Assert(p, NotNil)
+	c.Check(p.Payload, Equals, "testpayload")
+}
+
+// should retry connection errors and errors of replaced masters only
+func (suite *UnitSuite) TestIsRetryableError(c *C) {
+	c.Check(isRetryableError(nil), Equals, false)
+	c.Check(isRetryableError(io.EOF), Equals, true)
+	c.Check(isRetryableError(&net.OpError{Op: "dial", Err: fmt.Errorf("connection refused")}), Equals, true)
+	c.Check(isRetryableError(fmt.Errorf("READONLY You can't write against a read only replica.")), Equals, true)
+	c.Check(isRetryableError(fmt.Errorf("WRONGTYPE Operation against a key holding the wrong kind of value")), Equals, false)
+}
@@ -1,43 +1,246 @@
 package redismq
 
 import (
+	"context"
+	"crypto/subtle"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
+	"strings"
+	"sync"
+	"time"
 )
 
+// statsInterval is how often the Server refreshes the stats of all queues by default
+const statsInterval = time.Second
+
+// ServerOptions configures a Server created with NewServerWithOptions
+type ServerOptions struct {
+	RedisHost     string
+	RedisPort     string
+	RedisPassword string
+	RedisDB       int64
+	// RedisClient is used instead of connecting to RedisHost if set, it isn't closed by Shutdown()
+	RedisClient RedisClient
+	// Backend is used instead of redis if set, e.g. a MemoryBackend, it isn't closed by Shutdown()
+	Backend Backend
+	// Namespace scopes the server to the queues created with a client of UseNamespace
+	Namespace string
+
+	// Addr is the address to listen on, e.g. "127.0.0.1:9999"
+	Addr string
+	// StatsInterval is how often stats are refreshed in the background, defaults to one second
+	StatsInterval time.Duration
+
+	// Username and Password enable basic auth for the stats endpoints and the dashboard.
+	// Token enables "Authorization: Bearer <token>" for them, either credential is accepted.
+	Username string
+	Password string
+	Token    string
+
+	// AdminToken enables the admin API under /admin/, GatewayToken the Gateway under /gateway/.
+	// These endpoints only accept their own token as "Authorization: Bearer <token>".
+	AdminToken   string
+	GatewayToken string
+
+	// Rules are evaluated after every refresh, failing checks are reported by /ready
+	Rules []Rule
+	// Notifiers are alerted when checks of the rules trip or recover,
+	// the same check alerts again at the earliest after NotifyCooldown
+	Notifiers      []Notifier
+	NotifyCooldown time.Duration
+
+	// TLSCertFile and TLSKeyFile enable TLS, TLSConfig can be used to customize it
+	TLSCertFile string
+	TLSKeyFile  string
+	TLSConfig   *tls.Config
+}
+
 // Server is the web server API for monitoring via JSON
 type Server struct {
-	port     string
+	options  ServerOptions
 	observer *Observer
+	backend  Backend
+	gateway  *Gateway
+
+	setUp      sync.Once
+	mux        *http.ServeMux
+	httpServer *http.Server
+	// done is closed by Shutdown to end open event streams
+	done     chan struct{}
+	doneOnce sync.Once
 }
 
-// NewServer returns a Server that can be started with Start()
+// NewServer returns a Server listening on all interfaces that can be started with Start()
 func NewServer(redisHost, redisPort, redisPassword string, redisDb int64, port string) *Server {
-	observer := NewObserver(redisHost, redisPort, redisPassword, redisDb)
-	s := &Server{
-		port:     port,
-		observer: observer,
+	server, _ := NewServerWithOptions(&ServerOptions{
+		RedisHost:     redisHost,
+		RedisPort:     redisPort,
+		RedisPassword: redisPassword,
+		RedisDB:       redisDb,
+		Addr:          ":" + port,
+	})
+	return server
+}
+
+// NewServerWithOptions returns a Server that can be started with ListenAndServe()
+// or mounted into another server using Handler()
+func NewServerWithOptions(options *ServerOptions) (*Server, error) {
+	if (options.Username == "") != (options.Password == "") {
+		return nil, fmt.Errorf("basic auth needs both username and password")
+	}
+	if (options.TLSCertFile == "") != (options.TLSKeyFile == "") {
+		return nil, fmt.Errorf("TLS needs both certificate and key file")
+	}
+
+	backend := options.Backend
+	if backend == nil {
+		redisClient := options.RedisClient
+		if redisClient == nil {
+			redisClient = newRedisClient(options.RedisHost, options.RedisPort, options.RedisPassword, options.RedisDB)
+		}
+		if options.Namespace != "" {
+			redisClient = UseNamespace(redisClient, options.Namespace)
+		}
+		backend = NewRedisBackend(redisClient)
 	}
-	return s
+	server := &Server{
+		options:  *options,
+		observer: NewObserverWithBackend(backend),
+		backend:  backend,
+		mux:      http.NewServeMux(),
+		done:     make(chan struct{}),
+	}
+	server.observer.SetRules(options.Rules)
+	for _, notifier := range options.Notifiers {
+		server.observer.AddNotifier(notifier, options.NotifyCooldown)
+	}
+	if server.options.StatsInterval <= 0 {
+		server.options.StatsInterval = statsInterval
+	}
+	server.httpServer = &http.Server{
+		Addr:      server.options.Addr,
+		Handler:   server.mux,
+		TLSConfig: server.options.TLSConfig,
+	}
+	return server, nil
+}
+
+// EnableAdmin serves the admin API under /admin/ for requests carrying the token
+// as "Authorization: Bearer <token>". It has to be called before the Server is started.
+func (server *Server) EnableAdmin(token string) error {
+	if token == "" {
+		return fmt.Errorf("admin token must not be empty")
+	}
+	server.options.AdminToken = token
+	return nil
+}
+
+// EnableGateway serves a Gateway under /gateway/ for requests carrying the token
+// as "Authorization: Bearer <token>". It has to be called before the Server is started.
+func (server *Server) EnableGateway(token string) error {
+	if token == "" {
+		return fmt.Errorf("gateway token must not be empty")
+	}
+	server.options.GatewayToken = token
+	return nil
+}
+
+// Handler returns the routes of the Server to mount them into another server
+// and starts refreshing stats in the background until Shutdown() is called.
+// Mounted under a prefix it has to be wrapped in http.StripPrefix.
+func (server *Server) Handler() http.Handler {
+	server.setUp.Do(func() {
+		server.setUpRoutes()
+		server.observer.Start(server.options.StatsInterval)
+	})
+	return server.mux
 }
 
 func (server *Server) setUpRoutes() {
-	http.Handle("/stats", newStatisticsHandler(server.observer))
+	options := server.options
+	server.mux.Handle("/stats", server.authenticate(newStatisticsHandler(server.observer)))
+	server.mux.Handle("/stats/history", server.authenticate(&historyHandler{Observer: server.observer}))
+	server.mux.Handle("/stats/stream", server.authenticate(&streamHandler{Observer: server.observer, done: server.done}))
+	server.mux.Handle("/dashboard", server.authenticate(&dashboardHandler{}))
+	// probes usually can't authenticate
+	server.mux.Handle("/healthz", &healthHandler{Observer: server.observer})
+	server.mux.Handle("/ready", &readyHandler{Observer: server.observer})
+	if options.AdminToken != "" {
+		server.mux.Handle("/admin/", requireToken(options.AdminToken, newAdminHandler(server)))
+	}
+	if options.GatewayToken != "" {
+		server.gateway = NewGatewayWithBackend(server.backend)
+		server.mux.Handle("/gateway/", requireToken(options.GatewayToken, http.StripPrefix("/gateway", server.gateway)))
+	}
 }
 
-// Start enables the Server to listen on his port
+// ListenAndServe listens on the configured address until Shutdown() is called,
+// in which case http.ErrServerClosed is returned
+func (server *Server) ListenAndServe() error {
+	server.Handler()
+	if server.options.TLSCertFile != "" {
+		return server.httpServer.ListenAndServeTLS(server.options.TLSCertFile, server.options.TLSKeyFile)
+	}
+	return server.httpServer.ListenAndServe()
+}
+
+// Start enables the Server to listen in the background, errors are logged
 func (server *Server) Start() {
 	go func() {
-		server.setUpRoutes()
-		log.Printf("STARTING REDISMQ SERVER ON PORT %s", server.port)
-		err := http.ListenAndServe(":"+server.port, nil)
-		if err != nil {
-			log.Fatalf("REDISMQ SERVER SHUTTING DOWN [%s]\n\n", err.Error())
+		log.Printf("STARTING REDISMQ SERVER ON %s", server.options.Addr)
+		err := server.ListenAndServe()
+		if err != nil && err != http.ErrServerClosed {
+			log.Printf("REDISMQ SERVER SHUTTING DOWN [%s]\n\n", err.Error())
 		}
 	}()
 }
 
+// Shutdown gracefully stops the listener, open event streams, the background refresh of stats,
+// the notifiers and the consumers of the gateway
+func (server *Server) Shutdown(ctx context.Context) error {
+	// event streams never finish on their own and would hold up the listener
+	server.doneOnce.Do(func() {
+		close(server.done)
+	})
+	err := server.httpServer.Shutdown(ctx)
+	server.observer.Stop()
+	server.observer.StopNotifiers()
+	if server.gateway != nil {
+		server.gateway.Close()
+	}
+	if server.options.RedisClient == nil && server.options.Backend == nil {
+		server.backend.Close()
+	}
+	return err
+}
+
+// authenticate applies basic or token auth if configured
+func (server *Server) authenticate(handler http.Handler) http.Handler {
+	options := server.options
+	if options.Username == "" && options.Token == "" {
+		return handler
+	}
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		if options.Token != "" && validToken(request, options.Token) {
+			handler.ServeHTTP(writer, request)
+			return
+		}
+		username, password, ok := request.BasicAuth()
+		if options.Username != "" && ok && equalSecret(username, options.Username) && equalSecret(password, options.Password) {
+			handler.ServeHTTP(writer, request)
+			return
+		}
+		if options.Username != "" {
+			writer.Header().Set("WWW-Authenticate", `Basic realm="redismq"`)
+		}
+		writeError(writer, http.StatusUnauthorized, fmt.Errorf("unauthorized"))
+	})
+}
+
 type statisticsHandler struct {
 	*Observer
 }
@@ -49,7 +252,64 @@ func newStatisticsHandler(observer *Observer) *statisticsHandler {
 	return handler
 }
 
+// ServeHTTP renders the latest Snapshot of the Observer without doing any redis work.
+// It responds with 200 if any stats could be fetched, the failed queues carry error fields,
+// and 503 if the latest refresh failed completely, in which case the body holds the stale stats.
 func (handler *statisticsHandler) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
-	handler.Observer.UpdateAllStats()
-	fmt.Fprintln(writer, handler.Observer.ToJSON())
+	snapshot := handler.Observer.Snapshot()
+	if snapshot.CollectedAt.IsZero() {
+		message := snapshot.Error
+		if message == "" {
+			message = "no stats collected yet"
+		}
+		writeError(writer, http.StatusServiceUnavailable, errors.New(message))
+		return
+	}
+
+	status := http.StatusOK
+	if snapshot.Error != "" {
+		status = http.StatusServiceUnavailable
+	} else if len(snapshot.Stats) > 0 {
+		status = http.StatusServiceUnavailable
+		for _, stat := range snapshot.Stats {
+			if stat.Error == "" {
+				status = http.StatusOK
+				break
+			}
+		}
+	}
+
+	writeJSON(writer, status, snapshot)
+}
+
+// requireToken only passes on requests carrying "Authorization: Bearer <token>"
+func requireToken(token string, handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		if !validToken(request, token) {
+			writeError(writer, http.StatusUnauthorized, fmt.Errorf("unauthorized"))
+			return
+		}
+		handler.ServeHTTP(writer, request)
+	})
+}
+
+func validToken(request *http.Request, token string) bool {
+	header := request.Header.Get("Authorization")
+	if !strings.HasPrefix(header, "Bearer ") {
+		return false
+	}
+	return equalSecret(strings.TrimPrefix(header, "Bearer "), token)
+}
+
+func equalSecret(given, expected string) bool {
+	return subtle.ConstantTimeCompare([]byte(given), []byte(expected)) == 1
+}
+
+func writeJSON(writer http.ResponseWriter, status int, value interface{}) {
+	writer.Header().Set("Content-Type", "application/json")
+	writer.WriteHeader(status)
+	err := json.NewEncoder(writer).Encode(value)
+	if err != nil {
+		log.Printf("REDISMQ SERVER FAILED TO WRITE RESPONSE [%s]", err.Error())
+	}
 }
@@ -0,0 +1,129 @@
+package redismq
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"time"
+
+	. "github.com/matttproud/gocheck"
+)
+
+func serverOptions() *ServerOptions {
+	return &ServerOptions{
+		RedisHost:     redisHost,
+		RedisPort:     redisPort,
+		RedisPassword: redisPassword,
+		RedisDB:       redisDB,
+		Addr:          "127.0.0.1:0",
+		StatsInterval: 50 * time.Millisecond,
+	}
+}
+
+// should refuse incomplete options
+func (suite *TestSuite) TestServerOptionsValidation(c *C) {
+	options := serverOptions()
+	options.Username = "admin"
+	_, err := NewServerWithOptions(options)
+	c.Check(err, NotNil)
+
+	options = serverOptions()
+	options.TLSCertFile = "cert.pem"
+	_, err = NewServerWithOptions(options)
+	c.Check(err, NotNil)
+}
+
+// should protect the stats endpoints with basic or token auth
+func (suite *TestSuite) TestServerAuth(c *C) {
+	options := serverOptions()
+	options.Username = "admin"
+	options.Password = "secret"
+	options.Token = "token"
+	server, err := NewServerWithOptions(options)
+	c.Assert(err, IsNil)
+	defer server.Shutdown(context.Background())
+	handler := server.Handler()
+
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest("GET", "/dashboard", nil))
+	c.Check(recorder.Code, Equals, http.StatusUnauthorized)
+	c.Check(recorder.Header().Get("WWW-Authenticate"), Not(Equals), "")
+
+	request := httptest.NewRequest("GET", "/dashboard", nil)
+	request.SetBasicAuth("admin", "secret")
+	recorder = httptest.NewRecorder()
+	handler.ServeHTTP(recorder, request)
+	c.Check(recorder.Code, Equals, http.StatusOK)
+
+	request = httptest.NewRequest("GET", "/dashboard", nil)
+	request.Header.Set("Authorization", "Bearer token")
+	recorder = httptest.NewRecorder()
+	handler.ServeHTTP(recorder, request)
+	c.Check(recorder.Code, Equals, http.StatusOK)
+}
+
+// should only mount admin and gateway when enabled
+func (suite *TestSuite) TestServerOptionalRoutes(c *C) {
+	server, err := NewServerWithOptions(serverOptions())
+	c.Assert(err, IsNil)
+	c.Assert(server.EnableAdmin("secret"), IsNil)
+	defer server.Shutdown(context.Background())
+	handler := server.Handler()
+
+	request := httptest.NewRequest("GET", "/admin/queues", nil)
+	request.Header.Set("Authorization", "Bearer secret")
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, request)
+	c.Check(recorder.Code, Equals, http.StatusOK)
+
+	recorder = httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest("POST", "/gateway/queues/teststuff/packages", nil))
+	c.Check(recorder.Code, Equals, http.StatusNotFound)
+}
+
+// should stop listening and refreshing on shutdown
+func (suite *TestSuite) TestServerShutdown(c *C) {
+	server, err := NewServerWithOptions(serverOptions())
+	c.Assert(err, IsNil)
+
+	stopped := make(chan error, 1)
+	go func() {
+		stopped <- server.ListenAndServe()
+	}()
+	time.Sleep(200 * time.Millisecond)
+	c.Check(server.observer.Snapshot().CollectedAt.IsZero(), Equals, false)
+
+	c.Check(server.Shutdown(context.Background()), IsNil)
+	c.Check(<-stopped, Equals, http.ErrServerClosed)
+	collectedAt := server.observer.Snapshot().CollectedAt
+	time.Sleep(200 * time.Millisecond)
+	c.Check(server.observer.Snapshot().CollectedAt, Equals, collectedAt)
+}
+
+// should end open event streams on shutdown
+func (suite *UnitSuite) TestServerShutdownEndsStreams(c *C) {
+	server, err := NewServerWithOptions(&ServerOptions{Backend: NewMemoryBackend(), StatsInterval: 50 * time.Millisecond})
+	c.Assert(err, IsNil)
+	listener := httptest.NewServer(server.Handler())
+	defer listener.Close()
+
+	response, err := http.Get(listener.URL + "/stats/stream")
+	c.Assert(err, IsNil)
+	defer response.Body.Close()
+	ended := make(chan error, 1)
+	go func() {
+		_, err := io.Copy(io.Discard, response.Body)
+		ended <- err
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	c.Check(server.Shutdown(ctx), IsNil)
+	select {
+	case err := <-ended:
+		c.Check(err, IsNil)
+	case <-time.After(time.Second):
+		c.Error("stream still open after shutdown")
+	}
+}
@@ -0,0 +1,71 @@
+package redismq
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// streamKeepAlive is the interval of comments sent to keep idle connections open
+const streamKeepAlive = 15 * time.Second
+
+// streamHandler pushes the events of the Observer as Server-Sent Events.
+// All subscribers share the refreshes of the Observer so viewers don't add redis load.
+// The latest Snapshot is sent right after connecting, streams end when done is closed.
+type streamHandler struct {
+	*Observer
+	done <-chan struct{}
+}
+
+func (handler *streamHandler) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
+	flusher, ok := writer.(http.Flusher)
+	if !ok {
+		writeError(writer, http.StatusInternalServerError, fmt.Errorf("streaming unsupported"))
+		return
+	}
+
+	events, unsubscribe := handler.Observer.Subscribe()
+	defer unsubscribe()
+
+	writer.Header().Set("Content-Type", "text/event-stream")
+	writer.Header().Set("Cache-Control", "no-cache")
+	writer.Header().Set("Connection", "keep-alive")
+	writer.WriteHeader(http.StatusOK)
+
+	if snapshot := handler.Observer.Snapshot(); !snapshot.CollectedAt.IsZero() {
+		if writeEvent(writer, &Event{Type: EventSnapshot, Snapshot: snapshot}) != nil {
+			return
+		}
+	}
+	flusher.Flush()
+
+	keepAlive := time.NewTicker(streamKeepAlive)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case event := <-events:
+			if writeEvent(writer, event) != nil {
+				return
+			}
+		case <-keepAlive.C:
+			if _, err := fmt.Fprint(writer, ": keep-alive\n\n"); err != nil {
+				return
+			}
+		case <-request.Context().Done():
+			return
+		case <-handler.done:
+			return
+		}
+		flusher.Flush()
+	}
+}
+
+func writeEvent(writer http.ResponseWriter, event *Event) error {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(writer, "event: %s\ndata: %s\n\n", event.Type, data)
+	return err
+}
@@ -0,0 +1,420 @@
+package redismq
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"gopkg.in/redis.v3"
+)
+
+// streamGroup is the consumer group all consumers of a stream queue belong to
+const streamGroup = "redismq"
+
+// streamField is the field of stream entries holding the package envelope
+const streamField = "package"
+
+// streamBatch is the number of entries read or moved per call when resetting or requeueing stream queues
+const streamBatch = 1000
+
+// errStreamUnsupported is returned by operations that only work on queues stored in lists
+var errStreamUnsupported = errors.New("not supported by stream queues")
+
+// CreateStreamQueue returns a queue stored in a redis stream instead of lists,
+// it needs redis 6.2 or newer. Works like SelectQueue for existing stream queues.
+func CreateStreamQueue(redisHost, redisPort, redisPassword string, redisDB int64, name string) (*Queue, error) {
+	redisClient := newRedisClient(redisHost, redisPort, redisPassword, redisDB)
+	queue, err := CreateStreamQueueWithClient(redisClient, name)
+	if err != nil {
+		redisClient.Close()
+		return nil, err
+	}
+	queue.ownsClient = true
+	return queue, nil
+}
+
+// CreateStreamQueueWithClient works like CreateStreamQueue but uses the given client, see CreateQueueWithClient.
+// Packages of stream queues are delivered to the consumers of one consumer group. Consumers may get
+// packages before acking the previous ones, ClaimIdle takes over packages of consumers that stopped
+// working on them. Once created every constructor selects the stream,
+// lists and streams can be picked per queue. Peeking the input or working queue, Tail, Export,
+// Import, RequeueFailedMatching, GetFailed and bounds aren't supported by stream queues.
+func CreateStreamQueueWithClient(redisClient RedisClient, name string) (*Queue, error) {
+	keys := keysFor(redisClient)
+	length, err := redisClient.LLen(keys.queueInputKey(name)).Result()
+	if err != nil {
+		return nil, err
+	}
+	if length > 0 {
+		return nil, fmt.Errorf("queue %s has packages in lists", name)
+	}
+	cmd := redis.NewCmd("XGROUP", "CREATE", keys.queueStreamKey(name), streamGroup, "0", "MKSTREAM")
+	redisClient.Process(cmd)
+	if err := cmd.Err(); err != nil && !strings.HasPrefix(err.Error(), "BUSYGROUP") {
+		return nil, err
+	}
+	return CreateQueueWithClient(redisClient, name), nil
+}
+
+// streamCommand runs a stream command, stream queues are always stored in redis
+func (queue *Queue) streamCommand(args ...interface{}) (interface{}, error) {
+	redisBackend, ok := queue.backend.(*RedisBackend)
+	if !ok {
+		return nil, errStreamUnsupported
+	}
+	cmd := redis.NewCmd(args...)
+	redisBackend.client.Process(cmd)
+	return cmd.Result()
+}
+
+// streamEval runs a script on the stream and the failed queue
+func (queue *Queue) streamEval(script string, args ...string) (interface{}, error) {
+	redisBackend, ok := queue.backend.(*RedisBackend)
+	if !ok {
+		return nil, errStreamUnsupported
+	}
+	return redisBackend.client.Eval(
+		script,
+		[]string{queue.keys.queueStreamKey(queue.Name), queue.keys.queueFailedKey(queue.Name)},
+		args,
+	).Result()
+}
+
+// streamPushScript adds every value of ARGV as an entry
+var streamPushScript = `
+for i = 1, #ARGV do
+	redis.call('XADD', KEYS[1], '*', 'package', ARGV[i])
+end
+return #ARGV`
+
+func (queue *Queue) streamPush(values []string) error {
+	if maxLength, _ := queue.currentMaxLength(); maxLength > 0 {
+		return errStreamUnsupported
+	}
+	_, err := queue.streamEval(streamPushScript, values...)
+	if err != nil {
+		return err
+	}
+	queue.incrRate(queue.keys.queueInputRateKey(queue.Name), int64(len(values)))
+	return nil
+}
+
+// streamLengthsScript returns the number of undelivered entries
+// followed by pairs of consumer and pending entries
+var streamLengthsScript = `
+local pending = redis.call('XPENDING', KEYS[1], ARGV[1])
+local result = {redis.call('XLEN', KEYS[1]) - pending[1]}
+if pending[4] then
+	for _, consumer in ipairs(pending[4]) do
+		table.insert(result, consumer[1])
+		table.insert(result, tonumber(consumer[2]))
+	end
+end
+return result`
+
+// streamLengths returns the number of packages in the input queue and working queues of a stream queue
+func streamLengths(backend Backend, keys keyScheme, name string) (int64, map[string]int64, error) {
+	redisBackend, ok := backend.(*RedisBackend)
+	if !ok {
+		return 0, nil, errStreamUnsupported
+	}
+	result, err := redisBackend.client.Eval(
+		streamLengthsScript,
+		[]string{keys.queueStreamKey(name)},
+		[]string{streamGroup},
+	).Result()
+	if err != nil {
+		return 0, nil, err
+	}
+	values, ok := result.([]interface{})
+	if !ok || len(values)%2 != 1 {
+		return 0, nil, fmt.Errorf("unexpected stream lengths %v", result)
+	}
+	input, ok := values[0].(int64)
+	if !ok {
+		return 0, nil, fmt.Errorf("unexpected stream lengths %v", result)
+	}
+	working := make(map[string]int64)
+	for i := 1; i < len(values); i += 2 {
+		consumer, ok := values[i].(string)
+		if !ok {
+			return 0, nil, fmt.Errorf("unexpected stream lengths %v", result)
+		}
+		working[consumer], ok = values[i+1].(int64)
+		if !ok {
+			return 0, nil, fmt.Errorf("unexpected stream lengths %v", result)
+		}
+	}
+	return input, working, nil
+}
+
+// streamNextScript returns the first entry not yet delivered to the consumers of group ARGV[1]
+var streamNextScript = `
+for _, group in ipairs(redis.call('XINFO', 'GROUPS', KEYS[1])) do
+	local fields = {}
+	for i = 1, #group, 2 do
+		fields[group[i]] = group[i + 1]
+	end
+	if fields['name'] == ARGV[1] then
+		local entries = redis.call('XRANGE', KEYS[1], '(' .. fields['last-delivered-id'], '+', 'COUNT', 1)
+		if entries[1] then
+			return entries[1][2][2]
+		end
+	end
+end
+return false`
+
+// streamNext returns the package that would be fetched next from a stream queue, ErrNoValue if there is none
+func streamNext(backend Backend, keys keyScheme, name string) (string, error) {
+	redisBackend, ok := backend.(*RedisBackend)
+	if !ok {
+		return "", errStreamUnsupported
+	}
+	answer, err := redisBackend.client.Eval(
+		streamNextScript,
+		[]string{keys.queueStreamKey(name)},
+		[]string{streamGroup},
+	).Result()
+	if err == redis.Nil {
+		return "", ErrNoValue
+	}
+	if err != nil {
+		return "", err
+	}
+	envelope, ok := answer.(string)
+	if !ok {
+		return "", fmt.Errorf("unexpected stream entry %v", answer)
+	}
+	return envelope, nil
+}
+
+// streamRequeueFailedScript moves up to ARGV[1] failed packages to the stream and returns their number
+var streamRequeueFailedScript = `
+for i = 1, tonumber(ARGV[1]) do
+	local answer = redis.call('RPOP', KEYS[2])
+	if not answer then
+		return i - 1
+	end
+	redis.call('XADD', KEYS[1], '*', 'package', answer)
+end
+return tonumber(ARGV[1])`
+
+// streamRequeueFailed moves the failed packages in batches so redis isn't blocked by large failed queues
+func (queue *Queue) streamRequeueFailed() error {
+	for {
+		result, err := queue.streamEval(streamRequeueFailedScript, fmt.Sprintf("%d", streamBatch))
+		if err != nil {
+			return err
+		}
+		requeued, ok := result.(int64)
+		if !ok {
+			return fmt.Errorf("unexpected requeue result %v", result)
+		}
+		if requeued > 0 {
+			queue.incrRate(queue.keys.queueInputRateKey(queue.Name), requeued)
+		}
+		if requeued < streamBatch {
+			return nil
+		}
+	}
+}
+
+// streamResetInput deletes all undelivered entries by reading them with a consumer used only for that
+func (queue *Queue) streamResetInput() error {
+	reset := &Consumer{Name: queue.keys.queueStreamKey(queue.Name) + "::reset", Queue: queue}
+	for {
+		packages, err := reset.streamRead(streamBatch, 0, ">")
+		if err != nil {
+			return err
+		}
+		for _, p := range packages {
+			err = reset.streamAck(p)
+			if err != nil {
+				return err
+			}
+		}
+		if len(packages) < streamBatch {
+			break
+		}
+	}
+	_, err := queue.streamCommand("XGROUP", "DELCONSUMER", queue.keys.queueStreamKey(queue.Name), streamGroup, reset.Name)
+	return err
+}
+
+// streamRead reads up to count entries with XREADGROUP waiting up to block, 0 doesn't wait.
+// The id ">" reads new entries, "0" the pending entries of the consumer.
+func (consumer *Consumer) streamRead(count int64, block time.Duration, id string) ([]*Package, error) {
+	args := []interface{}{"XREADGROUP", "GROUP", streamGroup, consumer.Name, "COUNT", count}
+	if block > 0 {
+		args = append(args, "BLOCK", int64(block/time.Millisecond))
+	}
+	args = append(args, "STREAMS", consumer.Queue.keys.queueStreamKey(consumer.Queue.Name), id)
+	result, err := consumer.Queue.streamCommand(args...)
+	if err == redis.Nil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	streams, ok := result.([]interface{})
+	if !ok || len(streams) != 1 {
+		return nil, fmt.Errorf("unexpected stream reply %v", result)
+	}
+	stream, ok := streams[0].([]interface{})
+	if !ok || len(stream) != 2 {
+		return nil, fmt.Errorf("unexpected stream reply %v", result)
+	}
+	packages, err := consumer.parseStreamEntries(stream[1])
+	if err != nil {
+		return nil, err
+	}
+	if id == ">" && len(packages) > 0 {
+		consumer.Queue.incrRate(
+			consumer.Queue.keys.consumerWorkingRateKey(consumer.Queue.Name, consumer.Name),
+			int64(len(packages)),
+		)
+	}
+	return packages, nil
+}
+
+// parseStreamEntries returns the packages of entries as returned by XREADGROUP and XAUTOCLAIM.
+// Pending entries that were deleted have no fields, they are acked right away.
+func (consumer *Consumer) parseStreamEntries(reply interface{}) ([]*Package, error) {
+	entries, ok := reply.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("unexpected stream entries %v", reply)
+	}
+	packages := make([]*Package, 0, len(entries))
+	for _, entry := range entries {
+		fields, ok := entry.([]interface{})
+		if !ok || len(fields) != 2 {
+			return nil, fmt.Errorf("unexpected stream entry %v", entry)
+		}
+		id, ok := fields[0].(string)
+		if !ok {
+			return nil, fmt.Errorf("unexpected stream entry %v", entry)
+		}
+		values, _ := fields[1].([]interface{})
+		if len(values) != 2 || values[0] != streamField {
+			_, err := consumer.Queue.streamCommand("XACK", consumer.Queue.keys.queueStreamKey(consumer.Queue.Name), streamGroup, id)
+			if err != nil {
+				return nil, err
+			}
+			continue
+		}
+		envelope, ok := values[1].(string)
+		if !ok {
+			return nil, fmt.Errorf("unexpected stream entry %v", entry)
+		}
+		p, err := unmarshalPackage(envelope, consumer.Queue, consumer)
+		if err != nil {
+			return nil, err
+		}
+		p.streamID = id
+		packages = append(packages, p)
+	}
+	return packages, nil
+}
+
+// streamFetchOne waits up to wait for the next package, ErrNoValue if none arrived
+func (consumer *Consumer) streamFetchOne(wait time.Duration) (*Package, error) {
+	packages, err := consumer.streamRead(1, wait, ">")
+	if err != nil {
+		return nil, err
+	}
+	if len(packages) == 0 {
+		return nil, ErrNoValue
+	}
+	return packages[0], nil
+}
+
+// ClaimIdle takes over up to count packages of a stream queue that other consumers of the queue
+// got at least minIdle ago without acking them, e.g. because they crashed, and returns them.
+func (consumer *Consumer) ClaimIdle(minIdle time.Duration, count int64) ([]*Package, error) {
+	if !consumer.Queue.streams {
+		return nil, fmt.Errorf("only supported by stream queues")
+	}
+	result, err := consumer.Queue.streamCommand(
+		"XAUTOCLAIM", consumer.Queue.keys.queueStreamKey(consumer.Queue.Name), streamGroup, consumer.Name,
+		int64(minIdle/time.Millisecond), "0-0", "COUNT", count,
+	)
+	if err != nil {
+		return nil, err
+	}
+	values, ok := result.([]interface{})
+	if !ok || len(values) < 2 {
+		return nil, fmt.Errorf("unexpected claim reply %v", result)
+	}
+	return consumer.parseStreamEntries(values[1])
+}
+
+// streamUnackedLength returns the number of pending entries of the consumer
+func (consumer *Consumer) streamUnackedLength() int64 {
+	_, working, _ := streamLengths(consumer.Queue.backend, consumer.Queue.keys, consumer.Queue.Name)
+	return working[consumer.Name]
+}
+
+// streamGetUnacked returns the oldest pending package of the consumer
+func (consumer *Consumer) streamGetUnacked() (*Package, error) {
+	packages, err := consumer.streamRead(1, 0, "0")
+	if err != nil {
+		return nil, err
+	}
+	if len(packages) == 0 {
+		return nil, fmt.Errorf("no unacked Packages found")
+	}
+	return packages[0], nil
+}
+
+func (consumer *Consumer) streamResetWorking() error {
+	for {
+		packages, err := consumer.streamRead(streamBatch, 0, "0")
+		if err != nil || len(packages) == 0 {
+			return err
+		}
+		for _, p := range packages {
+			err = consumer.streamAck(p)
+			if err != nil {
+				return err
+			}
+		}
+		consumer.Queue.releasePackageSlots(packages...)
+	}
+}
+
+// streamAckScript removes the entry ARGV[2] after acking it for group ARGV[1]
+var streamAckScript = `
+redis.call('XACK', KEYS[1], ARGV[1], ARGV[2])
+return redis.call('XDEL', KEYS[1], ARGV[2])`
+
+func (consumer *Consumer) streamAck(p *Package) error {
+	_, err := consumer.Queue.streamEval(streamAckScript, streamGroup, p.streamID)
+	return err
+}
+
+// streamRejectScript acks and removes the entry ARGV[2] and adds ARGV[4] to the stream for
+// ARGV[3] "requeue" or to the failed queue otherwise, unless the entry was acked before
+var streamRejectScript = `
+if redis.call('XACK', KEYS[1], ARGV[1], ARGV[2]) == 0 then
+	return 0
+end
+redis.call('XDEL', KEYS[1], ARGV[2])
+if ARGV[3] == 'requeue' then
+	redis.call('XADD', KEYS[1], '*', 'package', ARGV[4])
+else
+	redis.call('LPUSH', KEYS[2], ARGV[4])
+end
+return 1`
+
+func (consumer *Consumer) streamReject(p *Package, requeue bool) error {
+	destination := "failed"
+	if requeue {
+		destination = "requeue"
+	}
+	_, err := consumer.Queue.streamEval(streamRejectScript, streamGroup, p.streamID, destination, p.getString())
+	if err == nil && requeue {
+		consumer.Queue.incrRate(consumer.Queue.keys.queueInputRateKey(consumer.Queue.Name), 1)
+	}
+	return err
+}
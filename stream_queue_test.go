@@ -0,0 +1,153 @@
+package redismq
+
+import (
+	"fmt"
+	"time"
+
+	. "github.com/matttproud/gocheck"
+)
+
+// stream queues should deliver, ack, requeue and fail packages like list queues
+func (suite *TestSuite) TestStreamQueue(c *C) {
+	queue, err := CreateStreamQueueWithClient(suite.redisClient, "teststream")
+	c.Assert(err, IsNil)
+	consumer, err := queue.AddConsumer("streamconsumer")
+	c.Assert(err, IsNil)
+	defer consumer.Quit()
+	for i := 0; i < 4; i++ {
+		c.Check(queue.Put(fmt.Sprintf("%d", i)), IsNil)
+	}
+	c.Check(suite.redisClient.LLen("redismq::teststream").Val(), Equals, int64(0))
+	c.Check(queue.GetInputLength(), Equals, int64(4))
+
+	first, err := consumer.Get()
+	c.Assert(err, IsNil)
+	c.Check(first.Payload, Equals, "0")
+	second, err := consumer.Get()
+	c.Assert(err, IsNil)
+	c.Check(second.Payload, Equals, "1")
+	c.Check(consumer.GetUnackedLength(), Equals, int64(2))
+	c.Check(queue.GetInputLength(), Equals, int64(2))
+	next, err := streamNext(queue.backend, queue.keys, queue.Name)
+	c.Assert(err, IsNil)
+	p, err := unmarshalPackage(next, queue, nil)
+	c.Assert(err, IsNil)
+	c.Check(p.Payload, Equals, "2")
+
+	c.Check(second.Ack(), IsNil)
+	c.Check(first.Fail(), IsNil)
+	c.Check(consumer.GetUnackedLength(), Equals, int64(0))
+	c.Check(queue.GetFailedLength(), Equals, int64(1))
+
+	packages, err := consumer.MultiGet(5)
+	c.Assert(err, IsNil)
+	c.Assert(packages, HasLen, 2)
+	c.Check(packages[1].Payload, Equals, "3")
+	c.Check(packages[0].MultiAck(), IsNil)
+	c.Check(packages[1].Requeue(), IsNil)
+
+	c.Check(queue.RequeueFailed(), IsNil)
+	c.Check(queue.GetInputLength(), Equals, int64(2))
+	p, err = consumer.Get()
+	c.Assert(err, IsNil)
+	c.Check(p.Payload, Equals, "3")
+	p, err = consumer.NoWaitGet()
+	c.Assert(err, IsNil)
+	c.Check(p.Payload, Equals, "0")
+	p, err = consumer.NoWaitGet()
+	c.Check(err, IsNil)
+	c.Check(p, IsNil)
+
+	selected, err := SelectQueueWithClient(suite.redisClient, "teststream")
+	c.Assert(err, IsNil)
+	info, err := selected.Info()
+	c.Assert(err, IsNil)
+	c.Assert(info.Consumers, HasLen, 1)
+	c.Check(info.Consumers[0].WorkingLength, Equals, int64(2))
+	_, err = selected.PeekInput(0, 1)
+	c.Check(err, Equals, errStreamUnsupported)
+}
+
+// packages of crashed consumers should be claimed by other consumers
+func (suite *TestSuite) TestStreamQueueClaimIdle(c *C) {
+	queue, err := CreateStreamQueueWithClient(suite.redisClient, "teststream")
+	c.Assert(err, IsNil)
+	crashed, err := queue.AddConsumer("crashed")
+	c.Assert(err, IsNil)
+	c.Check(queue.MultiPut("0", "1"), IsNil)
+	_, err = crashed.MultiGet(2)
+	c.Assert(err, IsNil)
+	crashed.Quit()
+
+	consumer, err := queue.AddConsumer("claiming")
+	c.Assert(err, IsNil)
+	defer consumer.Quit()
+	packages, err := consumer.ClaimIdle(time.Hour, 10)
+	c.Assert(err, IsNil)
+	c.Check(packages, HasLen, 0)
+	time.Sleep(20 * time.Millisecond)
+	packages, err = consumer.ClaimIdle(10*time.Millisecond, 10)
+	c.Assert(err, IsNil)
+	c.Assert(packages, HasLen, 2)
+	c.Check(packages[0].Payload, Equals, "0")
+	c.Check(packages[1].Ack(), IsNil)
+	c.Check(consumer.GetUnackedLength(), Equals, int64(1))
+	c.Check(crashed.GetUnackedLength(), Equals, int64(0))
+
+	unacked, err := consumer.GetUnacked()
+	c.Assert(err, IsNil)
+	c.Check(unacked.Payload, Equals, "0")
+	c.Check(consumer.ResetWorking(), IsNil)
+	c.Check(queue.Delete(), Not(IsNil))
+	consumer.Quit()
+	c.Check(queue.Delete(), IsNil)
+	c.Check(suite.redisClient.Exists("redismq::teststream::stream").Val(), Equals, false)
+}
+
+// stream queues can't replace queues that still have packages in lists
+func (suite *TestSuite) TestStreamQueueRefusesListQueue(c *C) {
+	c.Check(suite.queue.Put("listed"), IsNil)
+	_, err := CreateStreamQueueWithClient(suite.redisClient, "teststuff")
+	c.Check(err, Not(IsNil))
+}
+
+// buffered writes to stream queues should end up in the stream, failed packages are requeued in batches
+func (suite *TestSuite) TestStreamQueueBufferedAndRequeue(c *C) {
+	queue, err := CreateStreamQueueWithClient(suite.redisClient, "teststream")
+	c.Assert(err, IsNil)
+	buffered := CreateBufferedQueueWithClient(suite.redisClient, "teststream", 10)
+	c.Assert(buffered.Start(), IsNil)
+	c.Check(buffered.Put("buffered"), IsNil)
+	buffered.FlushBuffer()
+	c.Check(suite.redisClient.LLen("redismq::teststream").Val(), Equals, int64(0))
+	c.Check(queue.GetInputLength(), Equals, int64(1))
+
+	for i := 0; i < streamBatch+1; i++ {
+		suite.redisClient.LPush("redismq::teststream::failed", newPackage(fmt.Sprintf("%d", i), queue).getString())
+	}
+	c.Check(queue.RequeueFailed(), IsNil)
+	c.Check(queue.GetFailedLength(), Equals, int64(0))
+	c.Check(queue.GetInputLength(), Equals, int64(streamBatch+2))
+}
+
+// migrated stream queues should keep their stream
+func (suite *TestSuite) TestStreamQueueMigrateToClusterLayout(c *C) {
+	queue, err := CreateStreamQueueWithClient(suite.redisClient, "teststream")
+	c.Assert(err, IsNil)
+	c.Check(queue.MultiPut("0", "1"), IsNil)
+	c.Check(MigrateToClusterLayout(suite.redisClient, "teststream"), IsNil)
+	c.Check(suite.redisClient.Exists("redismq::teststream::stream").Val(), Equals, false)
+
+	clustered := CreateQueueWithClient(UseClusterLayout(suite.redisClient), "teststream")
+	c.Check(clustered.GetInputLength(), Equals, int64(2))
+	consumer, err := clustered.AddConsumer("streamconsumer")
+	c.Assert(err, IsNil)
+	defer consumer.Quit()
+	p, err := consumer.Get()
+	c.Assert(err, IsNil)
+	c.Check(p.Payload, Equals, "0")
+
+	_, err = CreateStreamQueueWithClient(suite.redisClient, "teststream")
+	c.Assert(err, IsNil)
+	c.Check(MigrateToClusterLayout(suite.redisClient, "teststream"), Not(IsNil))
+}